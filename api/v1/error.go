@@ -2,9 +2,12 @@ package log_v1
 
 import (
 	"fmt"
+	"time"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 type ErrOffsetOutOfRange struct {
@@ -32,3 +35,330 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+// Returned by a follower which can't write, LeaderAddr is empty if the leader is unknown
+type ErrNotLeader struct {
+	LeaderAddr string
+}
+
+func (e ErrNotLeader) GRPCStatus() *status.Status {
+	code := codes.FailedPrecondition
+	msg := fmt.Sprintf("not leader, leader is %s", e.LeaderAddr)
+	if e.LeaderAddr == "" {
+		code = codes.Unavailable
+		msg = "not leader, leader is unknown"
+	}
+
+	st := status.New(code, msg)
+
+	d := &errdetails.ErrorInfo{
+		Reason: "NOT_LEADER",
+		Domain: "proglog",
+		Metadata: map[string]string{
+			"leader_addr": e.LeaderAddr,
+		},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+
+	return std
+}
+
+func (e ErrNotLeader) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrTopicNotFound struct {
+	Topic string
+}
+
+func (e ErrTopicNotFound) GRPCStatus() *status.Status {
+	return status.New(codes.NotFound, fmt.Sprintf("topic not found: %s", e.Topic))
+}
+
+func (e ErrTopicNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrTopicExists struct {
+	Topic string
+}
+
+func (e ErrTopicExists) GRPCStatus() *status.Status {
+	return status.New(codes.AlreadyExists, fmt.Sprintf("topic already exists: %s", e.Topic))
+}
+
+func (e ErrTopicExists) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrInvalidTopic struct {
+	Topic string
+}
+
+func (e ErrInvalidTopic) GRPCStatus() *status.Status {
+	return status.New(codes.InvalidArgument, fmt.Sprintf("invalid topic name: %q", e.Topic))
+}
+
+func (e ErrInvalidTopic) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrPartitionNotFound struct {
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrPartitionNotFound) GRPCStatus() *status.Status {
+	return status.New(codes.NotFound, fmt.Sprintf("partition not found: %s/%d", e.Topic, e.Partition))
+}
+
+func (e ErrPartitionNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// Returned by a log which is closed, like the partitions of a deleted topic
+type ErrLogClosed struct{}
+
+func (e ErrLogClosed) GRPCStatus() *status.Status {
+	return status.New(codes.Unavailable, "log is closed")
+}
+
+func (e ErrLogClosed) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrOffsetNotCommitted struct {
+	Group     string
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrOffsetNotCommitted) GRPCStatus() *status.Status {
+	return status.New(
+		codes.NotFound,
+		fmt.Sprintf("no committed offset for group %s: %s/%d", e.Group, e.Topic, e.Partition),
+	)
+}
+
+func (e ErrOffsetNotCommitted) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// Returned to a member which isn't in the group any more, it should join again
+type ErrUnknownMember struct {
+	Group    string
+	MemberID string
+}
+
+func (e ErrUnknownMember) GRPCStatus() *status.Status {
+	return status.New(
+		codes.NotFound,
+		fmt.Sprintf("unknown member %s of group %s", e.MemberID, e.Group),
+	)
+}
+
+func (e ErrUnknownMember) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// Returned to a member whose generation is stale, it should join again
+type ErrStaleGeneration struct {
+	Group      string
+	Generation uint64
+}
+
+func (e ErrStaleGeneration) GRPCStatus() *status.Status {
+	return status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("group %s is rebalanced, current generation is %d", e.Group, e.Generation),
+	)
+}
+
+func (e ErrStaleGeneration) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// Returned for a duplicate record which is too old to know its original offset
+type ErrDuplicateSequence struct {
+	ProducerID uint64
+	Sequence   uint64
+}
+
+func (e ErrDuplicateSequence) GRPCStatus() *status.Status {
+	return status.New(
+		codes.AlreadyExists,
+		fmt.Sprintf("duplicate sequence %d of producer %d", e.Sequence, e.ProducerID),
+	)
+}
+
+func (e ErrDuplicateSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// Returned for a transaction which is committed, aborted or timed out
+type ErrUnknownTransaction struct {
+	TransactionID uint64
+}
+
+func (e ErrUnknownTransaction) GRPCStatus() *status.Status {
+	return status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("transaction %d isn't ongoing", e.TransactionID),
+	)
+}
+
+func (e ErrUnknownTransaction) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// Returned when a subject writes to or ends a transaction which another subject began
+type ErrTransactionNotOwned struct {
+	TransactionID uint64
+	Subject       string
+}
+
+func (e ErrTransactionNotOwned) GRPCStatus() *status.Status {
+	return status.New(
+		codes.PermissionDenied,
+		fmt.Sprintf("transaction %d isn't owned by %s", e.TransactionID, e.Subject),
+	)
+}
+
+func (e ErrTransactionNotOwned) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// Returned when a transaction is ended against its recorded decision
+type ErrTransactionDecided struct {
+	TransactionID uint64
+	Decision      ControlType
+}
+
+func (e ErrTransactionDecided) GRPCStatus() *status.Status {
+	return status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("transaction %d is already decided to %s", e.TransactionID, e.Decision),
+	)
+}
+
+func (e ErrTransactionDecided) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// Returned for a control record, or a record of an aborted transaction to a read committed consumer
+type ErrRecordNotVisible struct {
+	Offset uint64
+}
+
+func (e ErrRecordNotVisible) GRPCStatus() *status.Status {
+	return status.New(
+		codes.NotFound,
+		fmt.Sprintf("record at offset %d isn't visible", e.Offset),
+	)
+}
+
+func (e ErrRecordNotVisible) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// Returned when a subject exceeds its quota, it may retry once RetryAfter passes
+type ErrQuotaExceeded struct {
+	Subject    string
+	Quota      string
+	RetryAfter time.Duration
+}
+
+func (e ErrQuotaExceeded) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.ResourceExhausted,
+		fmt.Sprintf("%s quota of %q exceeded, retry after %s", e.Quota, e.Subject, e.RetryAfter),
+	)
+
+	d := &errdetails.RetryInfo{
+		RetryDelay: durationpb.New(e.RetryAfter),
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+
+	return std
+}
+
+func (e ErrQuotaExceeded) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// Returned for a record larger than the maximum size once marshaled
+type ErrRecordTooLarge struct {
+	Size uint64
+	Max  uint64
+}
+
+func (e ErrRecordTooLarge) GRPCStatus() *status.Status {
+	return status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("record of %d bytes exceeds the maximum of %d bytes", e.Size, e.Max),
+	)
+}
+
+func (e ErrRecordTooLarge) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// Returned while the server's disk is full, records can still be consumed
+type ErrDiskFull struct{}
+
+func (e ErrDiskFull) GRPCStatus() *status.Status {
+	st := status.New(codes.ResourceExhausted, "disk is full, the log is read-only")
+
+	d := &errdetails.ErrorInfo{
+		Reason: "DISK_FULL",
+		Domain: "proglog",
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+
+	return std
+}
+
+func (e ErrDiskFull) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// Returned for requests which the server doesn't accept in its mode
+type ErrNodeMode struct {
+	Mode NodeMode
+}
+
+func (e ErrNodeMode) GRPCStatus() *status.Status {
+	var st *status.Status
+	switch e.Mode {
+	case NodeMode_READ_ONLY:
+		st = status.New(codes.FailedPrecondition, "server is read-only")
+	case NodeMode_DRAIN:
+		st = status.New(codes.Unavailable, "server is draining, new streams aren't accepted")
+	default:
+		st = status.New(codes.Unavailable, "server is in maintenance")
+	}
+
+	d := &errdetails.ErrorInfo{
+		Reason: e.Mode.String(),
+		Domain: "proglog",
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+
+	return std
+}
+
+func (e ErrNodeMode) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
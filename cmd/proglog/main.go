@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/config"
+	"github.com/wuxl-lang/proglog/internal/certs"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const usage = `usage: proglog <command> [flags]
+
+commands:
+  certs    create a CA, and issue server and client certificates
+  audit    list authorization decisions recorded by a server
+  admin    describe, truncate, reset or roll a segment of a topic's log on a server, or switch its mode
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "certs":
+		err = runCerts(os.Args[2:])
+	case "audit":
+		err = runAudit(os.Args[2:])
+	case "admin":
+		err = runAdmin(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "proglog %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func runCerts(args []string) error {
+	fs := flag.NewFlagSet("certs", flag.ExitOnError)
+
+	home, _ := os.UserHomeDir()
+	dir := fs.String("dir", filepath.Join(home, ".proglog"), "directory to write certificates to, the CA in it is reused")
+	hosts := fs.String("server-hosts", "127.0.0.1,localhost", "comma separated DNS names and IP addresses of the server certificate")
+	clients := fs.String("clients", "client,root,nobody", "comma separated CNs of client certificates")
+	expiry := fs.Duration("expiry", 8760*time.Hour, "validity of issued certificates")
+	fs.Parse(args)
+
+	return certs.Generate(certs.Config{
+		Dir:         *dir,
+		ServerHosts: split(*hosts),
+		Clients:     split(*clients),
+		Expiry:      *expiry,
+	})
+}
+
+func runAudit(args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+
+	conn := addConnFlags(fs)
+	subject := fs.String("subject", "", "only list decisions of the subject")
+	object := fs.String("object", "", "only list decisions on the object, like topic:orders")
+	action := fs.String("action", "", "only list decisions of the action, like consume")
+	denied := fs.Bool("denied", false, "only list denials")
+	since := fs.Duration("since", 0, "only list decisions within the duration")
+	limit := fs.Uint("limit", 100, "maximum number of decisions, the latest are listed")
+	before := fs.Uint64("before", 0, "only list decisions before the offset, which is printed to list older ones")
+	fs.Parse(args)
+
+	cc, err := conn.dial()
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+
+	req := &api.ListAuditEventsRequest{
+		Subject:      *subject,
+		Object:       *object,
+		Action:       *action,
+		DeniedOnly:   *denied,
+		Limit:        uint32(*limit),
+		BeforeOffset: *before,
+	}
+	if *since > 0 {
+		req.Since = time.Now().Add(-*since).UnixNano()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := api.NewLogClient(cc).ListAuditEvents(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range res.Events {
+		decision := "allow"
+		if !e.Allowed {
+			decision = "deny"
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\n",
+			time.Unix(0, e.Time).UTC().Format(time.RFC3339Nano), decision, e.Subject, e.Action, e.Object, e.PeerAddr)
+	}
+	if res.NextOffset != 0 {
+		fmt.Fprintf(os.Stderr, "older decisions: -before %d\n", res.NextOffset)
+	}
+
+	return nil
+}
+
+const adminUsage = `usage: proglog admin <describe|truncate|reset|roll|mode> [flags]
+`
+
+func runAdmin(args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, adminUsage)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("admin "+args[0], flag.ExitOnError)
+	conn := addConnFlags(fs)
+	topic := fs.String("topic", "", "topic of the log, the default topic if it is empty")
+	partition := fs.Uint("partition", 0, "partition of the topic")
+	offset := fs.Uint64("offset", 0, "truncate segments whose records are all at or below the offset")
+	mode := fs.String("set", "", "mode to switch the server to: normal, read-only, drain or maintenance")
+	fs.Parse(args[1:])
+
+	cc, err := conn.dial()
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := api.NewAdminClient(cc)
+	switch args[0] {
+	case "describe":
+		res, err := client.DescribeLog(ctx, &api.DescribeLogRequest{Topic: *topic})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("topic %s, max store bytes %d, max index bytes %d, max record bytes %d\n",
+			res.Topic, res.Config.MaxStoreBytes, res.Config.MaxIndexBytes, res.Config.MaxRecordBytes)
+		for _, p := range res.Partitions {
+			fmt.Printf("partition %d\tlowest %d\thighest %d\tend %d\tbytes %d\tsegments %d\n",
+				p.Partition, p.LowestOffset, p.HighestOffset, p.EndOffset, p.Bytes, len(p.Segments))
+			for _, s := range p.Segments {
+				fmt.Printf("  segment %d-%d\tstore %d\tindex %d\n", s.BaseOffset, s.NextOffset, s.StoreBytes, s.IndexBytes)
+			}
+		}
+	case "truncate":
+		res, err := client.Truncate(ctx, &api.TruncateRequest{Topic: *topic, Partition: uint32(*partition), Offset: *offset})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("lowest offset %d\n", res.LowestOffset)
+	case "reset":
+		if _, err := client.Reset(ctx, &api.ResetRequest{Topic: *topic, Partition: uint32(*partition)}); err != nil {
+			return err
+		}
+	case "roll":
+		res, err := client.RollSegment(ctx, &api.RollSegmentRequest{Topic: *topic, Partition: uint32(*partition)})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("active segment %d\n", res.BaseOffset)
+	case "mode":
+		if *mode != "" {
+			value, ok := api.NodeMode_value[strings.ToUpper(strings.Replace(*mode, "-", "_", -1))]
+			if !ok {
+				return fmt.Errorf("unknown mode %q", *mode)
+			}
+
+			res, err := client.SetMode(ctx, &api.SetModeRequest{Mode: api.NodeMode(value)})
+			if err != nil {
+				return err
+			}
+			fmt.Printf("previous mode %s\n", res.Previous)
+		}
+
+		res, err := client.GetMode(ctx, &api.GetModeRequest{})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("mode %s, active streams %d\n", res.Mode, res.ActiveStreams)
+	default:
+		fmt.Fprint(os.Stderr, adminUsage)
+		os.Exit(2)
+	}
+
+	return nil
+}
+
+// Flags of the connection to a server, shared by the commands which call it
+type connFlags struct {
+	addr     *string
+	certFile *string
+	keyFile  *string
+	caFile   *string
+}
+
+func addConnFlags(fs *flag.FlagSet) *connFlags {
+	return &connFlags{
+		addr:     fs.String("addr", "127.0.0.1:8400", "RPC address of the server"),
+		certFile: fs.String("cert", config.RootClientCertFile, "client certificate of an admin"),
+		keyFile:  fs.String("key", config.RootClientKeyFile, "client key of an admin"),
+		caFile:   fs.String("ca", config.CAFile, "CA which issued the server certificate"),
+	}
+}
+
+func (c *connFlags) dial() (*grpc.ClientConn, error) {
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: *c.certFile,
+		KeyFile:  *c.keyFile,
+		CAFile:   *c.caFile,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return grpc.Dial(*c.addr, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+}
+
+func split(s string) []string {
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,194 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Certificates which expire within the duration are logged when they are loaded
+var CertExpiryWarning = 72 * time.Hour
+
+var (
+	expiriesMu sync.Mutex
+	expiries   = make(map[string]time.Time)
+)
+
+// Expiry of the loaded certificates by file, so that they can be monitored
+func CertificateExpiries() map[string]time.Time {
+	expiriesMu.Lock()
+	defer expiriesMu.Unlock()
+
+	m := make(map[string]time.Time, len(expiries))
+	for file, expiry := range expiries {
+		m[file] = expiry
+	}
+
+	return m
+}
+
+// reloader loads the key pair and the CA bundle again when their files change.
+// Files are checked on handshakes at most once per interval, so rotated certificates are used
+// by new connections, and existing connections are kept.
+type reloader struct {
+	mu sync.Mutex
+
+	cfg       TLSConfig
+	lastCheck time.Time
+	modTimes  [3]time.Time
+
+	cert *tls.Certificate
+	ca   *x509.CertPool
+}
+
+func newReloader(cfg TLSConfig) (*reloader, error) {
+	r := &reloader{cfg: cfg}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	r.lastCheck = time.Now()
+
+	return r, nil
+}
+
+// Current key pair and CA bundle, which are reloaded if their files are modified
+func (r *reloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.lastCheck) < r.cfg.ReloadInterval {
+		return r.cert, r.ca
+	}
+	r.lastCheck = time.Now()
+
+	if r.fileModTimes() != r.modTimes {
+		// Files may be half written during rotation, keep the loaded ones until they are valid
+		if err := r.load(); err != nil {
+			log.Printf("[ERROR] proglog: failed to reload certificates: %v", err)
+		}
+	}
+
+	return r.cert, r.ca
+}
+
+// Caller must hold the lock, or own the reloader
+func (r *reloader) load() error {
+	modTimes := r.fileModTimes()
+
+	var cert *tls.Certificate
+	if r.cfg.CertFile != "" && r.cfg.KeyFile != "" {
+		c, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+		if err != nil {
+			return err
+		}
+
+		leaf, err := x509.ParseCertificate(c.Certificate[0])
+		if err != nil {
+			return err
+		}
+		c.Leaf = leaf
+		cert = &c
+
+		recordExpiry(r.cfg.CertFile, leaf)
+	}
+
+	var ca *x509.CertPool
+	if r.cfg.CAFile != "" {
+		var err error
+		ca, err = loadCA(r.cfg.CAFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.cert, r.ca, r.modTimes = cert, ca, modTimes
+
+	return nil
+}
+
+func (r *reloader) fileModTimes() [3]time.Time {
+	var times [3]time.Time
+	for i, file := range []string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.CAFile} {
+		if info, err := os.Stat(file); err == nil {
+			times[i] = info.ModTime()
+		}
+	}
+
+	return times
+}
+
+func (r *reloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, _ := r.current()
+	if cert == nil {
+		return nil, fmt.Errorf("no certificate is configured")
+	}
+
+	return cert, nil
+}
+
+func (r *reloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cert, _ := r.current()
+	if cert == nil {
+		// Send no certificate, the server rejects it if it requires one
+		return &tls.Certificate{}, nil
+	}
+
+	return cert, nil
+}
+
+// Verify the server's certificate with the current CA bundle,
+// since the bundle in the config isn't reloaded.
+// Server names which are IP addresses aren't sent in the handshake, so they must be set in the config.
+func (r *reloader) verifyServer(cs tls.ConnectionState) error {
+	name := cs.ServerName
+	if name == "" {
+		name = r.cfg.ServerAddress
+	}
+	if name == "" {
+		return fmt.Errorf("server name is required to verify the server's certificate")
+	}
+
+	_, ca := r.current()
+
+	opts := x509.VerifyOptions{
+		Roots:         ca,
+		DNSName:       name,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err := cs.PeerCertificates[0].Verify(opts)
+
+	return err
+}
+
+func loadCA(file string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	ca := x509.NewCertPool()
+	if ok := ca.AppendCertsFromPEM(b); !ok {
+		return nil, fmt.Errorf("failed to parse root certificate: %q", file)
+	}
+
+	return ca, nil
+}
+
+func recordExpiry(file string, cert *x509.Certificate) {
+	expiriesMu.Lock()
+	expiries[file] = cert.NotAfter
+	expiriesMu.Unlock()
+
+	if time.Until(cert.NotAfter) < CertExpiryWarning {
+		log.Printf("[WARN] proglog: certificate %s expires at %s", file, cert.NotAfter.Format(time.RFC3339))
+	}
+}
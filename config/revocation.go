@@ -0,0 +1,232 @@
+package config
+
+import (
+	"bufio"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// revocation rejects peer certificates which are revoked by the CRL, or listed in the denylist.
+// Serial numbers are only unique per issuer, so certificates are revoked by their issuer and serial number.
+// Files are checked at most once per interval like the certificates.
+type revocation struct {
+	mu sync.Mutex
+
+	cfg       TLSConfig
+	lastCheck time.Time
+	modTimes  [3]time.Time
+
+	revoked map[revokedKey]bool
+}
+
+type revokedKey struct {
+	// Distinguished name of the issuer
+	issuer string
+	serial string
+}
+
+func keyOf(issuer pkix.Name, serial *big.Int) revokedKey {
+	return revokedKey{issuer: issuer.String(), serial: serial.String()}
+}
+
+func newRevocation(cfg TLSConfig) (*revocation, error) {
+	r := &revocation{cfg: cfg}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	r.lastCheck = time.Now()
+
+	return r, nil
+}
+
+// Implement tls.Config.VerifyPeerCertificate.
+// The certificates sent by the peer are checked, since the chains aren't verified yet
+// if the client verifies the server with a reloaded CA bundle.
+func (r *revocation) verifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	revoked := r.current()
+
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+
+		if revoked[keyOf(cert.Issuer, cert.SerialNumber)] {
+			return fmt.Errorf("certificate %s of %s is revoked", cert.SerialNumber, cert.Subject.CommonName)
+		}
+	}
+
+	return nil
+}
+
+func (r *revocation) current() map[revokedKey]bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cfg.ReloadInterval == 0 || time.Since(r.lastCheck) < r.cfg.ReloadInterval {
+		return r.revoked
+	}
+	r.lastCheck = time.Now()
+
+	if r.fileModTimes() != r.modTimes {
+		// Keep revoking the loaded serial numbers until the files are valid
+		if err := r.load(); err != nil {
+			log.Printf("[ERROR] proglog: failed to reload revoked certificates: %v", err)
+		}
+	}
+
+	return r.revoked
+}
+
+// Caller must hold the lock, or own the revocation
+func (r *revocation) load() error {
+	modTimes := r.fileModTimes()
+	revoked := make(map[revokedKey]bool)
+
+	if r.cfg.CRLFile != "" {
+		keys, err := loadCRL(r.cfg.CRLFile, r.cfg.CAFile)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			revoked[key] = true
+		}
+	}
+
+	if r.cfg.DenylistFile != "" {
+		keys, err := loadDenylist(r.cfg.DenylistFile)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			revoked[key] = true
+		}
+	}
+
+	r.revoked, r.modTimes = revoked, modTimes
+
+	return nil
+}
+
+func (r *revocation) fileModTimes() [3]time.Time {
+	var times [3]time.Time
+	for i, file := range []string{r.cfg.CRLFile, r.cfg.DenylistFile, r.cfg.CAFile} {
+		if info, err := os.Stat(file); err == nil {
+			times[i] = info.ModTime()
+		}
+	}
+
+	return times
+}
+
+// Certificates revoked by the CRL, which must be signed by its issuer in the CA bundle
+func loadCRL(file, caFile string) ([]revokedKey, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	crl, err := x509.ParseCRL(b)
+	if err != nil {
+		return nil, err
+	}
+
+	cas, err := loadCACerts(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var issuer pkix.Name
+	issuer.FillFromRDNSequence(&crl.TBSCertList.Issuer)
+
+	signed := false
+	for _, ca := range cas {
+		if ca.Subject.String() == issuer.String() && ca.CheckCRLSignature(crl) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return nil, fmt.Errorf("CRL %q isn't signed by its issuer %s in the CA bundle", file, issuer)
+	}
+
+	if crl.HasExpired(time.Now()) {
+		log.Printf("[WARN] proglog: CRL %s is past its next update", file)
+	}
+
+	var keys []revokedKey
+	for _, cert := range crl.TBSCertList.RevokedCertificates {
+		keys = append(keys, keyOf(issuer, cert.SerialNumber))
+	}
+
+	return keys, nil
+}
+
+// Certificates in the denylist, one per line: the serial number in decimal or hex with 0x prefix,
+// then the distinguished name of the issuer, e.g. "0x4 CN=proglog CA,O=proglog".
+// Lines starting with # are comments.
+func loadDenylist(file string) ([]revokedKey, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []revokedKey
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || strings.TrimSpace(fields[1]) == "" {
+			return nil, fmt.Errorf("missing issuer of serial number %q in %q", line, file)
+		}
+
+		serial, ok := new(big.Int).SetString(fields[0], 0)
+		if !ok {
+			return nil, fmt.Errorf("invalid serial number %q in %q", fields[0], file)
+		}
+		keys = append(keys, revokedKey{issuer: strings.TrimSpace(fields[1]), serial: serial.String()})
+	}
+
+	return keys, scanner.Err()
+}
+
+func loadCACerts(file string) ([]*x509.Certificate, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var cas []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		cas = append(cas, ca)
+	}
+
+	return cas, nil
+}
@@ -3,8 +3,7 @@ package config
 import (
 	"crypto/tls"
 	"crypto/x509"
-	"fmt"
-	"io/ioutil"
+	"time"
 )
 
 type TLSConfig struct {
@@ -13,9 +12,36 @@ type TLSConfig struct {
 	CAFile        string
 	ServerAddress string
 	Server        bool
+	// Reload rotated files, checking them at most once per interval. Files are loaded once if it is zero.
+	ReloadInterval time.Duration
+	// Peer certificates revoked by the CRL, which is signed by its issuer in the CA bundle, are rejected
+	CRLFile string
+	// Peer certificates whose serial numbers and issuers are listed in the file are rejected
+	DenylistFile string
 }
 
 func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	tlsConfig, err := setupTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.CRLFile != "" || cfg.DenylistFile != "" {
+		r, err := newRevocation(cfg)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.VerifyPeerCertificate = r.verifyPeerCertificate
+	}
+
+	return tlsConfig, nil
+}
+
+func setupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	if cfg.ReloadInterval > 0 {
+		return setupReloadingTLSConfig(cfg)
+	}
+
 	var err error
 	tlsConfig := &tls.Config{}
 
@@ -27,18 +53,20 @@ func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
 		if err != nil {
 			return nil, err
 		}
-	}
 
-	if cfg.CAFile != "" {
-		b, err := ioutil.ReadFile(cfg.CAFile)
+		// Files which aren't reloaded are monitored too
+		leaf, err := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
 		if err != nil {
 			return nil, err
 		}
+		tlsConfig.Certificates[0].Leaf = leaf
+		recordExpiry(cfg.CertFile, leaf)
+	}
 
-		ca := x509.NewCertPool()
-		ok := ca.AppendCertsFromPEM([]byte(b))
-		if !ok {
-			return nil, fmt.Errorf("failed to parse root certificate: %q", cfg.CAFile)
+	if cfg.CAFile != "" {
+		ca, err := loadCA(cfg.CAFile)
+		if err != nil {
+			return nil, err
 		}
 
 		if cfg.Server {
@@ -55,3 +83,41 @@ func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
 
 	return tlsConfig, nil
 }
+
+// The key pair is read by callbacks on every handshake, and the CA bundle is read by
+// a per handshake config on the server, or by the verification of the server's certificate on the client.
+func setupReloadingTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	r, err := newReloader(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{ServerName: cfg.ServerAddress}
+
+	if cfg.Server {
+		tlsConfig.GetCertificate = r.getCertificate
+		if cfg.CAFile != "" {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				_, ca := r.current()
+
+				c := tlsConfig.Clone()
+				c.GetConfigForClient = nil
+				c.ClientCAs = ca
+
+				return c, nil
+			}
+		}
+
+		return tlsConfig, nil
+	}
+
+	tlsConfig.GetClientCertificate = r.getClientCertificate
+	if cfg.CAFile != "" {
+		// Skip the verification with the static bundle, the server is verified with the current one instead
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = r.verifyServer
+	}
+
+	return tlsConfig, nil
+}
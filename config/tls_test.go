@@ -0,0 +1,300 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca, caKey := newCert(t, nil, nil, 1, "ca", time.Hour)
+	writeCA(t, dir, "ca.pem", ca)
+
+	writeCert(t, dir, "server", ca, caKey, 2)
+	writeCert(t, dir, "client", ca, caKey, 3)
+
+	serverConfig, err := SetupTLSConfig(TLSConfig{
+		CertFile:       filepath.Join(dir, "server.pem"),
+		KeyFile:        filepath.Join(dir, "server-key.pem"),
+		CAFile:         filepath.Join(dir, "ca.pem"),
+		Server:         true,
+		ReloadInterval: time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	clientConfig, err := SetupTLSConfig(TLSConfig{
+		CertFile:       filepath.Join(dir, "client.pem"),
+		KeyFile:        filepath.Join(dir, "client-key.pem"),
+		CAFile:         filepath.Join(dir, "ca.pem"),
+		ServerAddress:  "127.0.0.1",
+		ReloadInterval: time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	serial, err := handshake(serverConfig, clientConfig)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), serial)
+	require.Contains(t, CertificateExpiries(), filepath.Join(dir, "server.pem"))
+
+	// Expiry is recorded when files which aren't reloaded are loaded too
+	writeCert(t, dir, "static", ca, caKey, 6)
+	_, err = SetupTLSConfig(TLSConfig{
+		CertFile: filepath.Join(dir, "static.pem"),
+		KeyFile:  filepath.Join(dir, "static-key.pem"),
+	})
+	require.NoError(t, err)
+	require.Contains(t, CertificateExpiries(), filepath.Join(dir, "static.pem"))
+
+	// Rotated server certificate is used by new connections
+	writeCert(t, dir, "server", ca, caKey, 4)
+	time.Sleep(10 * time.Millisecond)
+
+	serial, err = handshake(serverConfig, clientConfig)
+	require.NoError(t, err)
+	require.Equal(t, int64(4), serial)
+
+	// Client doesn't trust the server once the CA bundle is replaced
+	other, _ := newCert(t, nil, nil, 5, "other ca", time.Hour)
+	writeCA(t, dir, "ca.pem", other)
+	time.Sleep(10 * time.Millisecond)
+
+	_, err = handshake(serverConfig, clientConfig)
+	require.Error(t, err)
+}
+
+func TestRevocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The bundle has two CAs, which issue certificates with the same serial numbers
+	ca, caKey := newCert(t, nil, nil, 1, "ca", time.Hour)
+	second, secondKey := newCert(t, nil, nil, 1, "second ca", time.Hour)
+	writeCA(t, dir, "ca.pem", ca, second)
+
+	writeCert(t, dir, "server", ca, caKey, 2)
+	writeCert(t, dir, "client", ca, caKey, 3)
+	writeCert(t, dir, "other-client", ca, caKey, 4)
+	writeCert(t, dir, "second-client", second, secondKey, 3)
+
+	crlFile := filepath.Join(dir, "crl.pem")
+	writeCRL(t, crlFile, ca, caKey)
+	denylistFile := filepath.Join(dir, "denylist")
+	require.NoError(t, ioutil.WriteFile(denylistFile, []byte("# compromised clients\n"), 0644))
+
+	serverConfig, err := SetupTLSConfig(TLSConfig{
+		CertFile:       filepath.Join(dir, "server.pem"),
+		KeyFile:        filepath.Join(dir, "server-key.pem"),
+		CAFile:         filepath.Join(dir, "ca.pem"),
+		Server:         true,
+		ReloadInterval: time.Millisecond,
+		CRLFile:        crlFile,
+		DenylistFile:   denylistFile,
+	})
+	require.NoError(t, err)
+
+	clientConfig := func(name string) *tls.Config {
+		c, err := SetupTLSConfig(TLSConfig{
+			CertFile:      filepath.Join(dir, name+".pem"),
+			KeyFile:       filepath.Join(dir, name+"-key.pem"),
+			CAFile:        filepath.Join(dir, "ca.pem"),
+			ServerAddress: "127.0.0.1",
+		})
+		require.NoError(t, err)
+
+		return c
+	}
+
+	_, err = handshake(serverConfig, clientConfig("client"))
+	require.NoError(t, err)
+
+	// Revoke the client by CRL
+	writeCRL(t, crlFile, ca, caKey, 3)
+	time.Sleep(10 * time.Millisecond)
+
+	_, err = handshake(serverConfig, clientConfig("client"))
+	require.Error(t, err)
+
+	_, err = handshake(serverConfig, clientConfig("other-client"))
+	require.NoError(t, err)
+
+	// The same serial number of another issuer isn't revoked
+	_, err = handshake(serverConfig, clientConfig("second-client"))
+	require.NoError(t, err)
+
+	// Revoke the other client by denylist
+	require.NoError(t, ioutil.WriteFile(denylistFile, []byte("0x4 CN=ca\n0x4 CN=second ca\n"), 0644))
+	touch(t, denylistFile)
+	time.Sleep(10 * time.Millisecond)
+
+	_, err = handshake(serverConfig, clientConfig("other-client"))
+	require.Error(t, err)
+
+	_, err = handshake(serverConfig, clientConfig("second-client"))
+	require.NoError(t, err)
+
+	// CRL which isn't signed by its issuer in the bundle is rejected
+	other, otherKey := newCert(t, nil, nil, 5, "other ca", time.Hour)
+	writeCRL(t, crlFile, other, otherKey)
+	_, err = SetupTLSConfig(TLSConfig{CAFile: filepath.Join(dir, "ca.pem"), Server: true, CRLFile: crlFile})
+	require.Error(t, err)
+
+	// A CA of the same name, which isn't in the bundle
+	impostor, impostorKey := newCert(t, nil, nil, 6, "ca", time.Hour)
+	writeCRL(t, crlFile, impostor, impostorKey)
+	_, err = SetupTLSConfig(TLSConfig{CAFile: filepath.Join(dir, "ca.pem"), Server: true, CRLFile: crlFile})
+	require.Error(t, err)
+
+	// Denylist entries name their issuer
+	writeCRL(t, crlFile, ca, caKey)
+	require.NoError(t, ioutil.WriteFile(denylistFile, []byte("0x4\n"), 0644))
+	_, err = SetupTLSConfig(TLSConfig{CAFile: filepath.Join(dir, "ca.pem"), Server: true, DenylistFile: denylistFile})
+	require.Error(t, err)
+}
+
+func writeCRL(t *testing.T, file string, ca *x509.Certificate, caKey *ecdsa.PrivateKey, serials ...int64) {
+	t.Helper()
+
+	var revoked []pkix.RevokedCertificate
+	for _, serial := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now(),
+		})
+	}
+
+	touches++
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(int64(touches)),
+		ThisUpdate:          time.Now(),
+		NextUpdate:          time.Now().Add(time.Hour),
+		RevokedCertificates: revoked,
+	}, ca, caKey)
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644))
+	touch(t, file)
+}
+
+// Handshake over a loopback connection and return the serial number of the server's certificate.
+// The client reads a byte from the server, since it may finish its handshake before the server rejects it.
+func handshake(serverConfig, clientConfig *tls.Config) (int64, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		server := tls.Server(conn, serverConfig)
+		if err := server.Handshake(); err == nil {
+			server.Write([]byte{1})
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	client := tls.Client(conn, clientConfig)
+	if err := client.Handshake(); err != nil {
+		return 0, err
+	}
+	if _, err := client.Read(make([]byte, 1)); err != nil {
+		return 0, err
+	}
+
+	return client.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), nil
+}
+
+func newCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, serial int64, cn string, ttl time.Duration) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(ttl),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert, key
+}
+
+func writeCA(t *testing.T, dir, name string, cas ...*x509.Certificate) {
+	t.Helper()
+
+	var b []byte
+	for _, ca := range cas {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})...)
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), b, 0644))
+	touch(t, filepath.Join(dir, name))
+}
+
+func writeCert(t *testing.T, dir, name string, ca *x509.Certificate, caKey *ecdsa.PrivateKey, serial int64) {
+	t.Helper()
+
+	cert, key := newCert(t, ca, caKey, serial, name, time.Hour)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	touch(t, certFile)
+	touch(t, keyFile)
+}
+
+var touches int
+
+// Move the modification time forward, so that rewrites are noticed on coarse file systems
+func touch(t *testing.T, file string) {
+	t.Helper()
+
+	touches++
+	next := time.Now().Add(time.Duration(touches) * time.Second)
+	require.NoError(t, os.Chtimes(file, next, next))
+}
@@ -0,0 +1,270 @@
+// Package audit records authorization decisions in an internal topic, so that they can be queried later.
+package audit
+
+import (
+	"errors"
+	"fmt"
+	stdlog "log"
+	"sync"
+	"time"
+
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/internal/log"
+	"google.golang.org/protobuf/proto"
+)
+
+// Internal topic which holds the audit events of the server
+const AuditTopic = "__audit"
+
+// Default number of events returned by a query
+const defaultLimit = 100
+
+// Returned by Record while too many events are waiting to be appended, the event is dropped
+var ErrBufferFull = errors.New("audit buffer is full, event is dropped")
+
+type Config struct {
+	// Recorded events are appended in a batch every interval, 100ms if it is zero
+	FlushInterval time.Duration
+	// Events are dropped while this many are waiting to be appended, 10000 if it is zero
+	MaxPending int
+	// Segments whose events are all older than it are removed, events are kept if it is zero
+	Retention time.Duration
+}
+
+// Auditor appends audit events to the internal topic in batches, so that authorizing a request
+// doesn't wait for the disk.
+type Auditor struct {
+	config Config
+	log    *log.Log
+
+	mu      sync.Mutex
+	pending []*api.AuditEvent
+	// Batches are appended one at a time, so that events stay in the order they were recorded
+	flushMu sync.Mutex
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+func NewAuditor(topics *log.TopicManager) (*Auditor, error) {
+	return NewAuditorWithConfig(topics, Config{})
+}
+
+func NewAuditorWithConfig(topics *log.TopicManager, c Config) (*Auditor, error) {
+	if c.FlushInterval == 0 {
+		c.FlushInterval = 100 * time.Millisecond
+	}
+
+	if c.MaxPending == 0 {
+		c.MaxPending = 10000
+	}
+
+	tc := log.Config{}
+	tc.Topic.Partitions = 1
+
+	topic, err := topics.OpenTopicWithConfig(AuditTopic, tc)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Auditor{
+		config: c,
+		log:    topic.Partitions[0],
+		done:   make(chan struct{}),
+	}
+
+	a.wg.Add(1)
+	go a.run()
+
+	return a, nil
+}
+
+// Queue the event to be appended with the next batch
+func (a *Auditor) Record(event *api.AuditEvent) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.pending) >= a.config.MaxPending {
+		return ErrBufferFull
+	}
+	a.pending = append(a.pending, event)
+
+	return nil
+}
+
+// Append the queued events, and remove the segments past the retention
+func (a *Auditor) Flush() error {
+	a.flushMu.Lock()
+	defer a.flushMu.Unlock()
+
+	a.mu.Lock()
+	batch := a.pending
+	a.pending = nil
+	a.mu.Unlock()
+
+	for i, event := range batch {
+		value, err := proto.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		if _, err = a.log.Append(&api.Record{Value: value}); err != nil {
+			return fmt.Errorf("dropped %d audit events: %w", len(batch)-i, err)
+		}
+	}
+
+	if a.config.Retention > 0 {
+		return a.expire(time.Now().Add(-a.config.Retention).UnixNano())
+	}
+
+	return nil
+}
+
+// Remove the segments before the first event at or after the time.
+// Caller must hold the flush lock.
+func (a *Auditor) expire(before int64) error {
+	lowest, err := a.log.LowestOffset()
+	if err != nil {
+		return err
+	}
+
+	off := lowest
+	for ; ; off++ {
+		event, err := a.read(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if event.Time >= before {
+			break
+		}
+	}
+
+	if off == lowest {
+		return nil
+	}
+
+	// Only whole segments are removed, so some expired events may be kept until their segment is full
+	return a.log.Truncate(off - 1)
+}
+
+// Append queued events every interval, and the remaining ones once closed
+func (a *Auditor) run() {
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(a.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			a.flush()
+			return
+		case <-ticker.C:
+			a.flush()
+		}
+	}
+}
+
+// Flush in the background, where failures can only be logged
+func (a *Auditor) flush() {
+	if err := a.Flush(); err != nil {
+		stdlog.Printf("[ERROR] proglog: failed to append audit events: %v", err)
+	}
+}
+
+// Append the queued events and stop appending
+func (a *Auditor) Close() error {
+	a.closeOnce.Do(func() {
+		close(a.done)
+	})
+	a.wg.Wait()
+
+	return nil
+}
+
+// Return the latest events which match the filters, in the order they were recorded.
+// Events are recorded in time order, so the log is read backwards from the end or the before offset,
+// until the limit or the events before the since time.
+func (a *Auditor) Events(req *api.ListAuditEventsRequest) (*api.ListAuditEventsResponse, error) {
+	// Queued events are listed too, the recorded ones are listed even if they can't be appended
+	a.flush()
+
+	limit := int(req.Limit)
+	if limit == 0 {
+		limit = defaultLimit
+	}
+
+	lowest, err := a.log.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	off := a.log.EndOffset()
+	if req.BeforeOffset != 0 && req.BeforeOffset < off {
+		off = req.BeforeOffset
+	}
+
+	res := &api.ListAuditEventsResponse{}
+	for off > lowest && len(res.Events) < limit {
+		off--
+
+		event, err := a.read(off)
+		if err != nil {
+			return nil, err
+		}
+
+		if event.Time < req.Since {
+			off = lowest
+			break
+		}
+
+		if match(req, event) {
+			res.Events = append(res.Events, event)
+		}
+	}
+
+	if off > lowest {
+		res.NextOffset = off
+	}
+
+	// Listed in the order they were recorded
+	for i, j := 0, len(res.Events)-1; i < j; i, j = i+1, j-1 {
+		res.Events[i], res.Events[j] = res.Events[j], res.Events[i]
+	}
+
+	return res, nil
+}
+
+func (a *Auditor) read(off uint64) (*api.AuditEvent, error) {
+	record, err := a.log.Read(off)
+	if err != nil {
+		return nil, err
+	}
+
+	event := &api.AuditEvent{}
+	if err = proto.Unmarshal(record.Value, event); err != nil {
+		return nil, err
+	}
+
+	return event, nil
+}
+
+func match(req *api.ListAuditEventsRequest, event *api.AuditEvent) bool {
+	switch {
+	case req.Subject != "" && req.Subject != event.Subject:
+		return false
+	case req.Object != "" && req.Object != event.Object:
+		return false
+	case req.Action != "" && req.Action != event.Action:
+		return false
+	case req.DeniedOnly && event.Allowed:
+		return false
+	}
+
+	return true
+}
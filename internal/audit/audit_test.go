@@ -0,0 +1,134 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/internal/log"
+)
+
+func TestAuditor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	topics, err := log.NewTopicManager(dir, log.Config{})
+	require.NoError(t, err)
+
+	auditor, err := NewAuditor(topics)
+	require.NoError(t, err)
+
+	events := []*api.AuditEvent{
+		{Subject: "root", Object: "topic:orders", Action: "produce", Allowed: true, Time: 1},
+		{Subject: "nobody", Object: "topic:orders", Action: "consume", Allowed: false, Time: 2},
+		{Subject: "root", Object: "topic:orders", Action: "consume", Allowed: true, Time: 3},
+		{Subject: "nobody", Object: "cluster", Action: "admin", Allowed: false, Time: 4},
+	}
+	for _, event := range events {
+		require.NoError(t, auditor.Record(event))
+	}
+
+	cases := map[string]struct {
+		req  *api.ListAuditEventsRequest
+		want []int64
+	}{
+		"all":     {&api.ListAuditEventsRequest{}, []int64{1, 2, 3, 4}},
+		"subject": {&api.ListAuditEventsRequest{Subject: "root"}, []int64{1, 3}},
+		"object":  {&api.ListAuditEventsRequest{Object: "topic:orders", Action: "consume"}, []int64{2, 3}},
+		"denied":  {&api.ListAuditEventsRequest{DeniedOnly: true}, []int64{2, 4}},
+		"since":   {&api.ListAuditEventsRequest{Since: 3}, []int64{3, 4}},
+		"limit":   {&api.ListAuditEventsRequest{Limit: 2}, []int64{3, 4}},
+	}
+
+	for scenario, c := range cases {
+		t.Run(scenario, func(t *testing.T) {
+			got, err := auditor.Events(c.req)
+			require.NoError(t, err)
+			require.Equal(t, c.want, times(got.Events))
+		})
+	}
+
+	// Older events are listed from the next offset
+	page, err := auditor.Events(&api.ListAuditEventsRequest{Limit: 3})
+	require.NoError(t, err)
+	require.Equal(t, []int64{2, 3, 4}, times(page.Events))
+
+	page, err = auditor.Events(&api.ListAuditEventsRequest{Limit: 3, BeforeOffset: page.NextOffset})
+	require.NoError(t, err)
+	require.Equal(t, []int64{1}, times(page.Events))
+	require.Equal(t, uint64(0), page.NextOffset)
+
+	// Queued events are appended before the topics are closed, and kept across restarts
+	require.NoError(t, auditor.Record(&api.AuditEvent{Subject: "root", Time: 5}))
+	require.NoError(t, auditor.Close())
+	require.NoError(t, topics.Close())
+
+	topics, err = log.NewTopicManager(dir, log.Config{})
+	require.NoError(t, err)
+	defer topics.Close()
+
+	auditor, err = NewAuditor(topics)
+	require.NoError(t, err)
+	defer auditor.Close()
+
+	got, err := auditor.Events(&api.ListAuditEventsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []int64{1, 2, 3, 4, 5}, times(got.Events))
+}
+
+func TestAuditorLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 256
+	topics, err := log.NewTopicManager(dir, c)
+	require.NoError(t, err)
+	defer topics.Close()
+
+	auditor, err := NewAuditorWithConfig(topics, Config{
+		FlushInterval: time.Hour,
+		MaxPending:    20,
+		Retention:     time.Hour,
+	})
+	require.NoError(t, err)
+	defer auditor.Close()
+
+	// Events are dropped while the buffer is full
+	old := time.Now().Add(-2 * time.Hour).UnixNano()
+	for i := 0; i < 20; i++ {
+		require.NoError(t, auditor.Record(&api.AuditEvent{Subject: "root", Object: "topic:orders", Time: old}))
+	}
+	require.Equal(t, ErrBufferFull, auditor.Record(&api.AuditEvent{}))
+
+	require.NoError(t, auditor.Flush())
+	require.NoError(t, auditor.Record(&api.AuditEvent{Subject: "root", Time: time.Now().UnixNano()}))
+
+	// Segments of expired events are removed
+	require.NoError(t, auditor.Flush())
+
+	l, err := topics.Topic(AuditTopic)
+	require.NoError(t, err)
+	lowest, err := l.Partitions[0].LowestOffset()
+	require.NoError(t, err)
+	require.NotEqual(t, uint64(0), lowest)
+
+	got, err := auditor.Events(&api.ListAuditEventsRequest{Limit: 100})
+	require.NoError(t, err)
+	require.True(t, len(got.Events) < 21)
+	require.Equal(t, "root", got.Events[len(got.Events)-1].Subject)
+}
+
+func times(events []*api.AuditEvent) []int64 {
+	var got []int64
+	for _, event := range events {
+		got = append(got, event.Time)
+	}
+
+	return got
+}
@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/casbin/casbin/model"
+	"github.com/casbin/casbin/persist"
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/internal/log"
+	"google.golang.org/protobuf/proto"
+)
+
+// Internal topic which records every policy added or removed
+const PoliciesTopic = "__policies"
+
+var _ persist.Adapter = (*Adapter)(nil)
+
+// Adapter loads Casbin policies from the internal policies topic, which is written through the leader.
+// Authorizers which watch reload the policies whenever records are added to the topic.
+type Adapter struct {
+	log *log.Log
+}
+
+func NewAdapter(topics *log.TopicManager) (*Adapter, error) {
+	c := log.Config{}
+	c.Topic.Partitions = 1
+
+	topic, err := topics.OpenTopicWithConfig(PoliciesTopic, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Adapter{log: topic.Partitions[0]}, nil
+}
+
+// Add the policies of the file if the topic is empty, so that there are admins to manage policies.
+// Nothing is added if any line of the file is invalid.
+func (a *Adapter) Seed(file string) error {
+	lowest, err := a.log.LowestOffset()
+	if err != nil {
+		return err
+	}
+	if a.log.EndOffset() > lowest {
+		return nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var policies []*api.Policy
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		tokens := strings.Split(line, ",")
+		for i := range tokens {
+			tokens[i] = strings.TrimSpace(tokens[i])
+		}
+
+		policy := &api.Policy{Ptype: tokens[0], Rule: tokens[1:]}
+		if want := ruleFields[policy.Ptype]; want == 0 || len(policy.Rule) != want {
+			return fmt.Errorf("%s:%d: invalid policy %q", file, n, line)
+		}
+		policies = append(policies, policy)
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	for _, policy := range policies {
+		if err = a.append(policy, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Offset of the next change of the policies
+func (a *Adapter) EndOffset() uint64 {
+	return a.log.EndOffset()
+}
+
+// Replay the changes, and load the policies which aren't removed in the order they were added
+func (a *Adapter) LoadPolicy(model model.Model) error {
+	var lines []string
+	live := make(map[string]bool)
+
+	lowest, err := a.log.LowestOffset()
+	if err != nil {
+		return err
+	}
+
+	for off := lowest; ; off++ {
+		record, err := a.log.Read(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		change := &api.PolicyChange{}
+		if err = proto.Unmarshal(record.Value, change); err != nil {
+			return err
+		}
+
+		line := policyLine(change.Policy)
+		if change.Removed {
+			delete(live, line)
+		} else if !live[line] {
+			live[line] = true
+			lines = append(lines, line)
+		}
+	}
+
+	for _, line := range lines {
+		// Lines removed and added again are loaded once
+		if live[line] {
+			persist.LoadPolicyLine(line, model)
+			delete(live, line)
+		}
+	}
+
+	return nil
+}
+
+// Policies are only changed one at a time
+func (a *Adapter) SavePolicy(model model.Model) error {
+	return errors.New("not implemented")
+}
+
+func (a *Adapter) AddPolicy(sec string, ptype string, rule []string) error {
+	return a.append(&api.Policy{Ptype: ptype, Rule: rule}, false)
+}
+
+func (a *Adapter) RemovePolicy(sec string, ptype string, rule []string) error {
+	return a.append(&api.Policy{Ptype: ptype, Rule: rule}, true)
+}
+
+func (a *Adapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	return errors.New("not implemented")
+}
+
+func (a *Adapter) append(policy *api.Policy, removed bool) error {
+	value, err := proto.Marshal(&api.PolicyChange{Policy: policy, Removed: removed})
+	if err != nil {
+		return err
+	}
+
+	_, err = a.log.Append(&api.Record{Value: value})
+
+	return err
+}
+
+// Policy in the format of the policy file
+func policyLine(policy *api.Policy) string {
+	return strings.Join(append([]string{policy.Ptype}, policy.Rule...), ", ")
+}
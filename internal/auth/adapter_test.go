@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/config"
+	"github.com/wuxl-lang/proglog/internal/log"
+)
+
+func TestAdapter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "adapter-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	topics, err := log.NewTopicManager(dir, log.Config{})
+	require.NoError(t, err)
+
+	adapter, err := NewAdapter(topics)
+	require.NoError(t, err)
+	require.NoError(t, adapter.Seed(config.ACLPolicyFile))
+
+	authorizer, err := NewWithAdapter(config.ACLModelFile, adapter)
+	require.NoError(t, err)
+	require.NoError(t, authorizer.Authorize("root", "topic:orders", "produce"))
+	require.Error(t, authorizer.Authorize("billing", "topic:orders", "consume"))
+
+	// Grant a role, and revoke it
+	role := &api.Policy{Ptype: "g", Rule: []string{"billing", "consumer"}}
+	require.NoError(t, authorizer.AddPolicy(role))
+	require.NoError(t, authorizer.Authorize("billing", "topic:orders", "consume"))
+
+	require.NoError(t, authorizer.RemovePolicy(role))
+	require.Error(t, authorizer.Authorize("billing", "topic:orders", "consume"))
+
+	direct := &api.Policy{Ptype: "p", Rule: []string{"billing", "topic:invoices", "produce"}}
+	require.NoError(t, authorizer.AddPolicy(direct))
+
+	// Policies are loaded from the log after restart, and seeding doesn't add them again
+	require.NoError(t, topics.Close())
+
+	topics, err = log.NewTopicManager(dir, log.Config{})
+	require.NoError(t, err)
+
+	adapter, err = NewAdapter(topics)
+	require.NoError(t, err)
+	require.NoError(t, adapter.Seed(config.ACLPolicyFile))
+
+	authorizer, err = NewWithAdapter(config.ACLModelFile, adapter)
+	require.NoError(t, err)
+	require.NoError(t, authorizer.Authorize("billing", "topic:invoices", "produce"))
+	require.Error(t, authorizer.Authorize("billing", "topic:orders", "consume"))
+
+	lines := rules(authorizer.enforcer)
+	require.Contains(t, lines, "p, billing, topic:invoices, produce")
+	require.NotContains(t, lines, "g, billing, consumer")
+
+	seen := make(map[string]bool)
+	for _, line := range lines {
+		require.False(t, seen[line], "Policy %s is loaded once", line)
+		seen[line] = true
+	}
+
+	// Policies loaded from the file can't be changed
+	require.Error(t, New(config.ACLModelFile, config.ACLPolicyFile).AddPolicy(direct))
+}
+
+func TestAdapterSeedAndWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "adapter-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	topics, err := log.NewTopicManager(filepath.Join(dir, "topics"), log.Config{})
+	require.NoError(t, err)
+
+	adapter, err := NewAdapter(topics)
+	require.NoError(t, err)
+
+	// Nothing is seeded from a file with an invalid line
+	policyFile := filepath.Join(dir, "policy.csv")
+	require.NoError(t, ioutil.WriteFile(policyFile, []byte("p, root, *, *\np, billing, topic:orders\n"), 0644))
+	require.Error(t, adapter.Seed(policyFile))
+	require.Equal(t, uint64(0), adapter.EndOffset())
+
+	require.NoError(t, adapter.Seed(config.ACLPolicyFile))
+
+	authorizer, err := NewWithAdapter(config.ACLModelFile, adapter)
+	require.NoError(t, err)
+	defer authorizer.Close()
+	authorizer.Watch(10 * time.Millisecond)
+
+	// Policies added to the topic by others, like through the leader, are loaded
+	other, err := NewAdapter(topics)
+	require.NoError(t, err)
+	require.NoError(t, other.AddPolicy("p", "p", []string{"billing", "topic:orders", "consume"}))
+
+	require.Eventually(t, func() bool {
+		return authorizer.Authorize("billing", "topic:orders", "consume") == nil
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Credentials presented with a request over gRPC or HTTP
+type Credentials struct {
+	// TLS connection state with verified chains, nil if the connection isn't TLS
+	TLS *tls.ConnectionState
+	// Bearer token of the authorization header, empty if there isn't one
+	Token string
+}
+
+// Parse the bearer token of an authorization header
+func BearerToken(header string) string {
+	const prefix = "bearer "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return ""
+	}
+
+	return strings.TrimSpace(header[len(prefix):])
+}
+
+// Returned by an authenticator if the request has no credentials of its kind,
+// so that the next one in the chain is tried
+var ErrNoCredentials = errors.New("no credentials")
+
+// Authenticator returns the subject of the credentials
+type Authenticator interface {
+	Authenticate(Credentials) (string, error)
+}
+
+// CommonName authenticates the subject as the CN of the verified client certificate
+type CommonName struct{}
+
+func (CommonName) Authenticate(c Credentials) (string, error) {
+	if c.TLS == nil || len(c.TLS.VerifiedChains) == 0 {
+		return "", ErrNoCredentials
+	}
+
+	return c.TLS.VerifiedChains[0][0].Subject.CommonName, nil
+}
+
+// URISAN authenticates the subject as the URI SAN of the verified client certificate
+// which has the prefix, like SPIFFE IDs spiffe://trust-domain/workload
+type URISAN struct {
+	Prefix string
+}
+
+func (a URISAN) Authenticate(c Credentials) (string, error) {
+	if c.TLS == nil || len(c.TLS.VerifiedChains) == 0 {
+		return "", ErrNoCredentials
+	}
+
+	for _, uri := range c.TLS.VerifiedChains[0][0].URIs {
+		if id := uri.String(); strings.HasPrefix(id, a.Prefix) {
+			return id, nil
+		}
+	}
+
+	return "", status.Errorf(codes.Unauthenticated, "certificate has no URI SAN with prefix %q", a.Prefix)
+}
+
+// Chain tries the authenticators in order, and returns the subject of the first one with credentials.
+// Invalid credentials are rejected rather than tried by the next one.
+type Chain []Authenticator
+
+func (a Chain) Authenticate(c Credentials) (string, error) {
+	for _, authenticator := range a {
+		subject, err := authenticator.Authenticate(c)
+		if err == ErrNoCredentials {
+			continue
+		}
+
+		return subject, err
+	}
+
+	return "", ErrNoCredentials
+}
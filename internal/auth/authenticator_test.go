@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCertificateAuthenticators(t *testing.T) {
+	id, err := url.Parse("spiffe://proglog/billing")
+	require.NoError(t, err)
+
+	creds := Credentials{TLS: &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{
+			Subject: pkix.Name{CommonName: "billing"},
+			URIs:    []*url.URL{id},
+		}}},
+	}}
+
+	subject, err := CommonName{}.Authenticate(creds)
+	require.NoError(t, err)
+	require.Equal(t, "billing", subject)
+
+	subject, err = URISAN{Prefix: "spiffe://proglog/"}.Authenticate(creds)
+	require.NoError(t, err)
+	require.Equal(t, "spiffe://proglog/billing", subject)
+
+	_, err = URISAN{Prefix: "spiffe://other/"}.Authenticate(creds)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = CommonName{}.Authenticate(Credentials{})
+	require.Equal(t, ErrNoCredentials, err)
+}
+
+func TestJWT(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwt-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	secret := []byte("secret")
+	hmacKeyFile := filepath.Join(dir, "hmac.key")
+	require.NoError(t, ioutil.WriteFile(hmacKeyFile, append(secret, '\n'), 0600))
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.NoError(t, err)
+	rsaKeyFile := filepath.Join(dir, "rsa.pem")
+	require.NoError(t, ioutil.WriteFile(rsaKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+
+	jwt, err := NewJWT(JWTConfig{
+		HMACKeyFile:      hmacKeyFile,
+		RSAPublicKeyFile: rsaKeyFile,
+		Issuer:           "proglog",
+		Audience:         "log",
+	})
+	require.NoError(t, err)
+
+	valid := map[string]interface{}{
+		"sub": "billing",
+		"iss": "proglog",
+		"aud": []string{"log", "metrics"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	with := func(key string, value interface{}) map[string]interface{} {
+		claims := make(map[string]interface{})
+		for k, v := range valid {
+			claims[k] = v
+		}
+		claims[key] = value
+
+		return claims
+	}
+
+	cases := map[string]struct {
+		token   string
+		subject string
+	}{
+		"HS256":            {signHS256(t, secret, valid), "billing"},
+		"RS256":            {signRS256(t, rsaKey, valid), "billing"},
+		"wrong secret":     {signHS256(t, []byte("guess"), valid), ""},
+		"expired":          {signHS256(t, secret, with("exp", time.Now().Add(-time.Minute).Unix())), ""},
+		"not valid yet":    {signHS256(t, secret, with("nbf", time.Now().Add(time.Hour).Unix())), ""},
+		"other issuer":     {signHS256(t, secret, with("iss", "other")), ""},
+		"other audience":   {signHS256(t, secret, with("aud", "other")), ""},
+		"no subject":       {signHS256(t, secret, with("sub", "")), ""},
+		"unsigned":         {encode(t, map[string]string{"alg": "none"}) + "." + encode(t, valid) + ".", ""},
+		"malformed":        {"token", ""},
+		"single audience":  {signHS256(t, secret, with("aud", "log")), "billing"},
+		"tampered payload": {tamper(t, signHS256(t, secret, valid)), ""},
+	}
+
+	for scenario, c := range cases {
+		t.Run(scenario, func(t *testing.T) {
+			subject, err := jwt.Authenticate(Credentials{Token: c.token})
+			if c.subject == "" {
+				require.Equal(t, codes.Unauthenticated, status.Code(err))
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.subject, subject)
+		})
+	}
+
+	// Requests without token are tried by the next authenticator
+	chain := Chain{jwt, CommonName{}}
+	_, err = chain.Authenticate(Credentials{})
+	require.Equal(t, ErrNoCredentials, err)
+
+	subject, err := chain.Authenticate(Credentials{Token: BearerToken("Bearer " + signHS256(t, secret, valid))})
+	require.NoError(t, err)
+	require.Equal(t, "billing", subject)
+}
+
+func encode(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func signHS256(t *testing.T, secret []byte, claims interface{}) string {
+	signed := encode(t, map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + encode(t, claims)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, claims interface{}) string {
+	signed := encode(t, map[string]string{"alg": "RS256", "typ": "JWT"}) + "." + encode(t, claims)
+
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	require.NoError(t, err)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// Replace the claims and keep the signature
+func tamper(t *testing.T, token string) string {
+	parts := strings.Split(token, ".")
+	claims := map[string]interface{}{"sub": "root", "exp": time.Now().Add(time.Hour).Unix()}
+
+	return parts[0] + "." + encode(t, claims) + "." + parts[2]
+}
@@ -2,14 +2,36 @@ package auth
 
 import (
 	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/casbin/casbin"
+	api "github.com/wuxl-lang/proglog/api/v1"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 type Authorizer struct {
+	mu       sync.RWMutex
 	enforcer *casbin.Enforcer
+	// Reloads are serialized, so that an older load doesn't replace a newer one
+	reloadMu sync.Mutex
+
+	model  string
+	policy string
+	// Policies are loaded from the adapter instead of the policy file if it is set
+	adapter *Adapter
+
+	// Modification times of the model and policy which are loaded
+	modTimes [2]time.Time
+	// End offset of the adapter's policies which are loaded
+	end uint64
+
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 func New(model, poilcy string) *Authorizer {
@@ -17,12 +39,37 @@ func New(model, poilcy string) *Authorizer {
 
 	return &Authorizer{
 		enforcer: enforcer,
+		model:    model,
+		policy:   poilcy,
+		modTimes: modTimes(model, poilcy),
+		done:     make(chan struct{}),
+	}
+}
+
+// Load policies from the adapter, which can be changed with AddPolicy and RemovePolicy
+func NewWithAdapter(model string, adapter *Adapter) (*Authorizer, error) {
+	enforcer, err := casbin.NewEnforcerSafe(model, adapter)
+	if err != nil {
+		return nil, err
 	}
+
+	return &Authorizer{
+		enforcer: enforcer,
+		model:    model,
+		adapter:  adapter,
+		modTimes: modTimes(model, ""),
+		end:      adapter.EndOffset(),
+		done:     make(chan struct{}),
+	}, nil
 }
 
 // Implement Authorize interface
 func (a *Authorizer) Authorize(subject, object, action string) error {
-	if !a.enforcer.Enforce(subject, object, action) {
+	a.mu.RLock()
+	enforcer := a.enforcer
+	a.mu.RUnlock()
+
+	if !enforcer.Enforce(subject, object, action) {
 		msg := fmt.Sprintf(
 			"%s not permitted to %s to %s",
 			subject,
@@ -37,3 +84,198 @@ func (a *Authorizer) Authorize(subject, object, action string) error {
 
 	return nil
 }
+
+// Load the model and policy again and swap them in at once, and log the changed policies.
+// The loaded ones are kept if the files are invalid.
+func (a *Authorizer) Reload() error {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+
+	times := modTimes(a.model, a.policy)
+	end := a.endOffset()
+
+	var enforcer *casbin.Enforcer
+	var err error
+	if a.adapter != nil {
+		enforcer, err = casbin.NewEnforcerSafe(a.model, a.adapter)
+	} else {
+		enforcer, err = casbin.NewEnforcerSafe(a.model, a.policy)
+	}
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	old := a.enforcer
+	a.enforcer = enforcer
+	a.modTimes = times
+	a.end = end
+	a.mu.Unlock()
+
+	added, removed := diff(rules(old), rules(enforcer))
+	for _, rule := range added {
+		log.Printf("[INFO] proglog: added policy: %s", rule)
+	}
+	for _, rule := range removed {
+		log.Printf("[INFO] proglog: removed policy: %s", rule)
+	}
+
+	return nil
+}
+
+// Store the policy and load it.
+// Policies can only be changed if they are loaded from the adapter.
+func (a *Authorizer) AddPolicy(policy *api.Policy) error {
+	if err := a.checkPolicy(policy); err != nil {
+		return err
+	}
+
+	if err := a.adapter.AddPolicy(policy.Ptype[:1], policy.Ptype, policy.Rule); err != nil {
+		return err
+	}
+
+	return a.Reload()
+}
+
+func (a *Authorizer) RemovePolicy(policy *api.Policy) error {
+	if err := a.checkPolicy(policy); err != nil {
+		return err
+	}
+
+	if err := a.adapter.RemovePolicy(policy.Ptype[:1], policy.Ptype, policy.Rule); err != nil {
+		return err
+	}
+
+	return a.Reload()
+}
+
+// Loaded policies and role assignments
+func (a *Authorizer) Policies() []*api.Policy {
+	a.mu.RLock()
+	enforcer := a.enforcer
+	a.mu.RUnlock()
+
+	var policies []*api.Policy
+	for _, p := range enforcer.GetPolicy() {
+		policies = append(policies, &api.Policy{Ptype: "p", Rule: p})
+	}
+	for _, g := range enforcer.GetGroupingPolicy() {
+		policies = append(policies, &api.Policy{Ptype: "g", Rule: g})
+	}
+
+	return policies
+}
+
+// Policies have 3 fields, subject, object and action, and role assignments have 2, subject and role
+var ruleFields = map[string]int{"p": 3, "g": 2}
+
+func (a *Authorizer) checkPolicy(policy *api.Policy) error {
+	if a.adapter == nil {
+		return status.Error(codes.FailedPrecondition, "policies are managed in the policy file")
+	}
+
+	if policy == nil || ruleFields[policy.Ptype] == 0 || len(policy.Rule) != ruleFields[policy.Ptype] {
+		return status.Error(codes.InvalidArgument, "policy must be p, subject, object, action or g, subject, role")
+	}
+
+	for _, field := range policy.Rule {
+		if field == "" || strings.Contains(field, ",") {
+			return status.Errorf(codes.InvalidArgument, "invalid policy field %q", field)
+		}
+	}
+
+	return nil
+}
+
+// Reload whenever the model or policy file is modified, or policies are added to the adapter's topic,
+// checking every interval until closed
+func (a *Authorizer) Watch(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-a.done:
+				return
+			case <-ticker.C:
+				a.mu.RLock()
+				loaded, end := a.modTimes, a.end
+				a.mu.RUnlock()
+
+				if modTimes(a.model, a.policy) == loaded && a.endOffset() == end {
+					continue
+				}
+
+				if err := a.Reload(); err != nil {
+					log.Printf("[ERROR] proglog: failed to reload policies: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop watching the files
+func (a *Authorizer) Close() error {
+	a.closeOnce.Do(func() {
+		close(a.done)
+	})
+
+	return nil
+}
+
+// End offset of the adapter's policies, zero without adapter
+func (a *Authorizer) endOffset() uint64 {
+	if a.adapter == nil {
+		return 0
+	}
+
+	return a.adapter.EndOffset()
+}
+
+func modTimes(model, policy string) [2]time.Time {
+	var times [2]time.Time
+	for i, file := range []string{model, policy} {
+		if info, err := os.Stat(file); err == nil {
+			times[i] = info.ModTime()
+		}
+	}
+
+	return times
+}
+
+// Policies and role assignments of the enforcer, in the format of the policy file
+func rules(e *casbin.Enforcer) []string {
+	var rules []string
+	for _, p := range e.GetPolicy() {
+		rules = append(rules, policyLine(&api.Policy{Ptype: "p", Rule: p}))
+	}
+	for _, g := range e.GetGroupingPolicy() {
+		rules = append(rules, policyLine(&api.Policy{Ptype: "g", Rule: g}))
+	}
+
+	return rules
+}
+
+func diff(old, new []string) (added, removed []string) {
+	oldSet := make(map[string]bool)
+	for _, rule := range old {
+		oldSet[rule] = true
+	}
+
+	newSet := make(map[string]bool)
+	for _, rule := range new {
+		newSet[rule] = true
+		if !oldSet[rule] {
+			added = append(added, rule)
+		}
+	}
+
+	for _, rule := range old {
+		if !newSet[rule] {
+			removed = append(removed, rule)
+		}
+	}
+
+	return added, removed
+}
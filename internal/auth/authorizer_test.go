@@ -1,15 +1,83 @@
 package auth
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/wuxl-lang/proglog/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestAuthorizer(t *testing.T) {
 	authorizer := New(config.ACLModelFile, config.ACLPolicyFile)
 
-	err := authorizer.Authorize("nobody", "*", "produce")
-	require.Error(t, err)
+	cases := map[string]struct {
+		subject string
+		object  string
+		action  string
+		allowed bool
+	}{
+		"nobody can't produce":            {"nobody", "topic:orders", "produce", false},
+		"admin role can do anything":      {"root", "topic:orders", "delete_topic", true},
+		"admin role covers cluster":       {"root", "cluster", "list_topics", true},
+		"producer role produces to topic": {"writer", "topic:orders", "produce", true},
+		"producer role can't consume":     {"writer", "topic:orders", "consume", false},
+		"producer role registers":         {"writer", "cluster", "produce", true},
+		"consumer role joins group":       {"reader", "group:billing", "consume", true},
+		"prefix matches topic":            {"auditor", "topic:orders-eu", "consume", true},
+		"prefix doesn't match topic":      {"auditor", "topic:payments", "consume", false},
+		"prefix matches group":            {"auditor", "group:orders-audit", "consume", true},
+		"prefix doesn't match group":      {"auditor", "group:billing", "consume", false},
+	}
+
+	for scenario, c := range cases {
+		t.Run(scenario, func(t *testing.T) {
+			err := authorizer.Authorize(c.subject, c.object, c.action)
+			if c.allowed {
+				require.NoError(t, err)
+			} else {
+				require.Equal(t, codes.PermissionDenied, status.Code(err))
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authorizer-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	model, err := ioutil.ReadFile(config.ACLModelFile)
+	require.NoError(t, err)
+	modelFile := filepath.Join(dir, "model.conf")
+	require.NoError(t, ioutil.WriteFile(modelFile, model, 0644))
+
+	policyFile := filepath.Join(dir, "policy.csv")
+	require.NoError(t, ioutil.WriteFile(policyFile, []byte("p, root, *, *\n"), 0644))
+
+	authorizer := New(modelFile, policyFile)
+	defer authorizer.Close()
+	authorizer.Watch(10 * time.Millisecond)
+
+	require.Error(t, authorizer.Authorize("billing", "topic:orders", "consume"))
+
+	// Granting access to a new service takes effect without restart
+	policy := []byte("p, root, *, *\np, billing, topic:orders, consume\n")
+	require.NoError(t, ioutil.WriteFile(policyFile, policy, 0644))
+	// Make sure the modification time changes on coarse file systems
+	require.NoError(t, os.Chtimes(policyFile, time.Now(), time.Now().Add(time.Second)))
+
+	require.Eventually(t, func() bool {
+		return authorizer.Authorize("billing", "topic:orders", "consume") == nil
+	}, time.Second, 10*time.Millisecond)
+
+	// Invalid policies are rejected and the loaded ones are kept
+	require.NoError(t, ioutil.WriteFile(modelFile, []byte("[matchers]\n"), 0644))
+	require.Error(t, authorizer.Reload())
+	require.NoError(t, authorizer.Authorize("billing", "topic:orders", "consume"))
 }
@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type JWTConfig struct {
+	// Secret of HS256 tokens
+	HMACKeyFile string
+	// PEM public key or certificate of RS256 tokens
+	RSAPublicKeyFile string
+	// Tokens must be issued by the issuer and for the audience if they are set
+	Issuer   string
+	Audience string
+}
+
+// JWT authenticates the subject as the sub claim of a signed bearer token
+type JWT struct {
+	config  JWTConfig
+	hmacKey []byte
+	rsaKey  *rsa.PublicKey
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+}
+
+// Load the keys, at least one of them must be set
+func NewJWT(c JWTConfig) (*JWT, error) {
+	a := &JWT{config: c}
+
+	if c.HMACKeyFile != "" {
+		b, err := ioutil.ReadFile(c.HMACKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		a.hmacKey = bytes.TrimSpace(b)
+	}
+
+	if c.RSAPublicKeyFile != "" {
+		key, err := loadRSAPublicKey(c.RSAPublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		a.rsaKey = key
+	}
+
+	if a.hmacKey == nil && a.rsaKey == nil {
+		return nil, fmt.Errorf("no key to verify tokens")
+	}
+
+	return a, nil
+}
+
+func (a *JWT) Authenticate(c Credentials) (string, error) {
+	if c.Token == "" {
+		return "", ErrNoCredentials
+	}
+
+	claims, err := a.verify(c.Token)
+	if err != nil {
+		return "", status.Errorf(codes.Unauthenticated, "invalid token: %v", err)
+	}
+
+	return claims.Subject, nil
+}
+
+func (a *JWT) verify(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	header := &jwtHeader{}
+	if err := decodeSegment(parts[0], header); err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	switch {
+	case header.Alg == "HS256" && a.hmacKey != nil:
+		mac := hmac.New(sha256.New, a.hmacKey)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, fmt.Errorf("signature mismatch")
+		}
+	case header.Alg == "RS256" && a.rsaKey != nil:
+		hash := sha256.Sum256(signed)
+		if err = rsa.VerifyPKCS1v15(a.rsaKey, crypto.SHA256, hash[:], sig); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	claims := &jwtClaims{}
+	if err = decodeSegment(parts[1], claims); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	if claims.ExpiresAt == 0 || now >= claims.ExpiresAt {
+		return nil, fmt.Errorf("token is expired")
+	}
+	if now < claims.NotBefore {
+		return nil, fmt.Errorf("token isn't valid yet")
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("token has no subject")
+	}
+	if a.config.Issuer != "" && claims.Issuer != a.config.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if a.config.Audience != "" && !hasAudience(claims.Audience, a.config.Audience) {
+		return nil, fmt.Errorf("token isn't for audience %q", a.config.Audience)
+	}
+
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// The audience claim is either a string or a list of strings
+func hasAudience(raw json.RawMessage, audience string) bool {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return one == audience
+	}
+
+	var many []string
+	if json.Unmarshal(raw, &many) == nil {
+		for _, aud := range many {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func loadRSAPublicKey(file string) (*rsa.PublicKey, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("failed to parse public key: %q", file)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key isn't RSA: %q", file)
+	}
+
+	return rsaKey, nil
+}
@@ -0,0 +1,223 @@
+// Package certs issues the CA, server and client certificates used by proglog,
+// in the file layout of the config package.
+package certs
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const keyBits = 2048
+
+type Config struct {
+	// Directory to write files to, like $HOME/.proglog
+	Dir string
+	// DNS names and IP addresses of the server certificate, the first one is its CN
+	ServerHosts []string
+	// CNs of client certificates
+	Clients []string
+	// Validity of issued certificates, the CA is valid ten times as long
+	Expiry time.Duration
+}
+
+// Issue the server and client certificates.
+// The CA in the directory is reused if it exists, otherwise a new one is created.
+func Generate(c Config) error {
+	if c.Expiry == 0 {
+		c.Expiry = 8760 * time.Hour
+	}
+
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+
+	ca, err := LoadCA(c.Dir)
+	if os.IsNotExist(err) {
+		ca, err = NewCA(10 * c.Expiry)
+		if err == nil {
+			err = ca.write(c.Dir)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(c.ServerHosts) > 0 {
+		if err = ca.IssueServer(c.Dir, "server", c.ServerHosts, c.Expiry); err != nil {
+			return err
+		}
+	}
+
+	for _, cn := range c.Clients {
+		if err = ca.IssueClient(c.Dir, ClientFile(cn), cn, c.Expiry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Base name of the files of a client, like root-client for root, so that they match the config package
+func ClientFile(cn string) string {
+	if cn == "client" {
+		return cn
+	}
+
+	return cn + "-client"
+}
+
+type CA struct {
+	Cert *x509.Certificate
+	Key  *rsa.PrivateKey
+}
+
+func NewCA(expiry time.Duration) (*CA, error) {
+	key, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return nil, err
+	}
+
+	template, err := newTemplate("proglog CA", expiry)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CA{Cert: cert, Key: key}, nil
+}
+
+// Load ca.pem and ca-key.pem in the directory
+func LoadCA(dir string) (*CA, error) {
+	certPEM, err := ioutil.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, fmt.Errorf("failed to parse CA certificate in %q", dir)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("failed to parse CA key in %q", dir)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CA{Cert: cert, Key: key}, nil
+}
+
+// Issue a server certificate for the hosts into <name>.pem and <name>-key.pem
+func (ca *CA) IssueServer(dir, name string, hosts []string, expiry time.Duration) error {
+	template, err := newTemplate(hosts[0], expiry)
+	if err != nil {
+		return err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	return ca.issue(dir, name, template)
+}
+
+// Issue a client certificate with the CN into <name>.pem and <name>-key.pem
+func (ca *CA) IssueClient(dir, name, cn string, expiry time.Duration) error {
+	template, err := newTemplate(cn, expiry)
+	if err != nil {
+		return err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	return ca.issue(dir, name, template)
+}
+
+func (ca *CA) issue(dir, name string, template *x509.Certificate) error {
+	key, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, &key.PublicKey, ca.Key)
+	if err != nil {
+		return err
+	}
+
+	return writePair(dir, name, der, key)
+}
+
+func (ca *CA) write(dir string) error {
+	return writePair(dir, "ca", ca.Cert.Raw, ca.Key)
+}
+
+func newTemplate(cn string, expiry time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:         cn,
+			Organization:       []string{"proglog"},
+			OrganizationalUnit: []string{"Distributed Services"},
+		},
+		// Tolerate clock skew between machines
+		NotBefore: now.Add(-5 * time.Minute),
+		NotAfter:  now.Add(expiry),
+	}, nil
+}
+
+// Write the certificate and its key, the key is only readable by the owner
+func writePair(dir, name string, der []byte, key *rsa.PrivateKey) error {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0644); err != nil {
+		return err
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	return ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600)
+}
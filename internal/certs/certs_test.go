@@ -0,0 +1,73 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = Generate(Config{
+		Dir:         dir,
+		ServerHosts: []string{"127.0.0.1", "localhost"},
+		Clients:     []string{"client", "root"},
+		Expiry:      time.Hour,
+	})
+	require.NoError(t, err)
+
+	ca, err := LoadCA(dir)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+
+	server := loadPair(t, dir, "server")
+	require.Equal(t, "127.0.0.1", server.Subject.CommonName)
+	require.Equal(t, []string{"localhost"}, server.DNSNames)
+	require.True(t, server.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")))
+	_, err = server.Verify(x509.VerifyOptions{Roots: roots, DNSName: "localhost"})
+	require.NoError(t, err)
+
+	root := loadPair(t, dir, "root-client")
+	require.Equal(t, "root", root.Subject.CommonName)
+	_, err = root.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	require.NoError(t, err)
+
+	// Client certificates can't serve
+	_, err = root.Verify(x509.VerifyOptions{Roots: roots})
+	require.Error(t, err)
+
+	info, err := os.Stat(filepath.Join(dir, "root-client-key.pem"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Another client is issued by the same CA
+	err = Generate(Config{Dir: dir, Clients: []string{"nobody"}, Expiry: time.Hour})
+	require.NoError(t, err)
+
+	nobody := loadPair(t, dir, "nobody-client")
+	_, err = nobody.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	require.NoError(t, err)
+}
+
+func loadPair(t *testing.T, dir, name string) *x509.Certificate {
+	t.Helper()
+
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem"))
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	require.NoError(t, err)
+
+	return cert
+}
@@ -0,0 +1,356 @@
+package group
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/internal/log"
+	"github.com/wuxl-lang/proglog/internal/metrics"
+)
+
+// Internal topic which holds the committed offsets
+const OffsetsTopic = "__consumer_offsets"
+
+// Reported by the latest coordinator of every dir, until it is closed
+var groupLagGauge = metrics.Default.NewGaugeFuncSet(
+	"proglog_consumer_group_lag",
+	"Records of partitions after the committed offsets of consumer groups.",
+	"group", "topic", "partition",
+)
+
+type Config struct {
+	// A member is removed from its group if it doesn't heartbeat within the timeout
+	SessionTimeout time.Duration
+}
+
+// Coordinator tracks the members of consumer groups and assigns partitions among them.
+// Whenever members join, leave or time out, the group moves to a new generation with new assignments,
+// and the members learn them on their next heartbeat.
+type Coordinator struct {
+	mu sync.Mutex
+
+	Config  Config
+	topics  *log.TopicManager
+	offsets *offsets
+	groups  map[string]*group
+}
+
+type group struct {
+	generation uint64
+	members    map[string]*member
+}
+
+type member struct {
+	id            string
+	topics        []string
+	assignment    []*api.TopicPartition
+	lastHeartbeat time.Time
+}
+
+// Construct coordinator and rebuild committed offsets from the internal topic
+func NewCoordinator(topics *log.TopicManager, c Config) (*Coordinator, error) {
+	if c.SessionTimeout == 0 {
+		c.SessionTimeout = 10 * time.Second
+	}
+
+	tc := log.Config{}
+	tc.Topic.Partitions = 1
+	topic, err := topics.OpenTopicWithConfig(OffsetsTopic, tc)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets, err := newOffsets(topic.Partitions[0])
+	if err != nil {
+		return nil, err
+	}
+
+	coordinator := &Coordinator{
+		Config:  c,
+		topics:  topics,
+		offsets: offsets,
+		groups:  make(map[string]*group),
+	}
+
+	groupLagGauge.Set(topics.Dir, func(emit func(float64, ...string)) {
+		for _, lag := range coordinator.Lags("") {
+			emit(float64(lag.Lag), lag.Group, lag.Topic, strconv.FormatUint(uint64(lag.Partition), 10))
+		}
+	})
+
+	return coordinator, nil
+}
+
+// Transactions appends records of transactions, like the transaction coordinator
+type Transactions interface {
+	Append(id uint64, subject string, topic *log.Topic, record *api.Record) (uint32, uint64, error)
+}
+
+// Stop reporting the lag of committed offsets, so that the closed coordinator isn't referenced anymore
+func (c *Coordinator) Close() error {
+	groupLagGauge.Delete(c.topics.Dir)
+
+	return nil
+}
+
+func (c *Coordinator) CommitOffset(req *api.CommitOffsetRequest) (*api.CommitOffsetResponse, error) {
+	if err := c.checkMember(req); err != nil {
+		return nil, err
+	}
+
+	if err := c.offsets.Commit(committedOffset(req)); err != nil {
+		return nil, err
+	}
+
+	return &api.CommitOffsetResponse{}, nil
+}
+
+// Commit the offset in the subject's transaction. The commit is appended to the offsets topic as a record
+// of the transaction, and applied once the transaction's commit control record follows it, on restart too.
+func (c *Coordinator) CommitOffsetInTransaction(req *api.CommitOffsetRequest, subject string, transactions Transactions) (*api.CommitOffsetResponse, error) {
+	if err := c.checkMember(req); err != nil {
+		return nil, err
+	}
+
+	record, err := offsetRecord(committedOffset(req))
+	if err != nil {
+		return nil, err
+	}
+
+	topic, err := c.topics.Topic(OffsetsTopic)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, err = transactions.Append(req.TransactionId, subject, topic, record); err != nil {
+		return nil, err
+	}
+
+	return &api.CommitOffsetResponse{}, nil
+}
+
+// Consumers outside of a group commit without member
+func (c *Coordinator) checkMember(req *api.CommitOffsetRequest) error {
+	if req.MemberId == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.member(req.Group, req.MemberId, req.Generation)
+
+	return err
+}
+
+// Remove the committed offsets of the topic before it is deleted, so that its lag isn't read anymore
+func (c *Coordinator) DropTopic(topic string) error {
+	return c.offsets.DeleteTopic(topic)
+}
+
+func (c *Coordinator) FetchOffset(req *api.FetchOffsetRequest) (*api.FetchOffsetResponse, error) {
+	off, err := c.offsets.Fetch(req.Group, req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.FetchOffsetResponse{Offset: off}, nil
+}
+
+// Lag of each group's committed offset behind the end of the partition, of every topic if the topic is empty.
+// Commits of deleted topics and partitions are skipped.
+func (c *Coordinator) Lags(topic string) []*api.ConsumerLag {
+	var lags []*api.ConsumerLag
+	for _, commit := range c.offsets.All() {
+		if topic != "" && commit.Topic != topic {
+			continue
+		}
+
+		t, err := c.topics.Topic(commit.Topic)
+		if err != nil {
+			continue
+		}
+		l, err := t.Partition(commit.Partition)
+		if err != nil {
+			continue
+		}
+
+		lag := &api.ConsumerLag{
+			Group:     commit.Group,
+			Topic:     commit.Topic,
+			Partition: commit.Partition,
+			Offset:    commit.Offset,
+		}
+		if end := l.EndOffset(); end > commit.Offset {
+			lag.Lag = end - commit.Offset
+		}
+		lags = append(lags, lag)
+	}
+
+	return lags
+}
+
+// Add a member to the group, or update its topics, and rebalance the group
+func (c *Coordinator) JoinGroup(req *api.JoinGroupRequest) (*api.JoinGroupResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	g, ok := c.groups[req.Group]
+	if !ok {
+		g = &group{members: make(map[string]*member)}
+		c.groups[req.Group] = g
+	}
+	c.expire(g)
+
+	id := req.MemberId
+	if _, ok := g.members[id]; !ok {
+		// Unknown members join with a new ID
+		id = newMemberID()
+	}
+
+	g.members[id] = &member{
+		id:            id,
+		topics:        req.Topics,
+		lastHeartbeat: time.Now(),
+	}
+	c.rebalance(g)
+
+	return &api.JoinGroupResponse{
+		MemberId:   id,
+		Generation: g.generation,
+		Assignment: g.members[id].assignment,
+	}, nil
+}
+
+// Keep the member alive, and tell it the assignment if the group is rebalanced
+func (c *Coordinator) Heartbeat(req *api.HeartbeatRequest) (*api.HeartbeatResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m, err := c.member(req.Group, req.MemberId, 0)
+	if err != nil {
+		return nil, err
+	}
+	m.lastHeartbeat = time.Now()
+
+	g := c.groups[req.Group]
+
+	return &api.HeartbeatResponse{
+		Generation: g.generation,
+		Assignment: m.assignment,
+		Rebalance:  g.generation != req.Generation,
+	}, nil
+}
+
+// Remove the member and rebalance the group
+func (c *Coordinator) LeaveGroup(req *api.LeaveGroupRequest) (*api.LeaveGroupResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := c.member(req.Group, req.MemberId, 0); err != nil {
+		return nil, err
+	}
+
+	g := c.groups[req.Group]
+	delete(g.members, req.MemberId)
+	c.rebalance(g)
+
+	return &api.LeaveGroupResponse{}, nil
+}
+
+// Find a live member, and check its generation if it is set.
+// Caller must hold the lock.
+func (c *Coordinator) member(groupID, memberID string, generation uint64) (*member, error) {
+	g, ok := c.groups[groupID]
+	if !ok {
+		return nil, api.ErrUnknownMember{Group: groupID, MemberID: memberID}
+	}
+	c.expire(g)
+
+	m, ok := g.members[memberID]
+	if !ok {
+		return nil, api.ErrUnknownMember{Group: groupID, MemberID: memberID}
+	}
+
+	if generation != 0 && generation != g.generation {
+		return nil, api.ErrStaleGeneration{Group: groupID, Generation: g.generation}
+	}
+
+	return m, nil
+}
+
+// Remove members which missed heartbeats, and rebalance the group if any is removed.
+// Caller must hold the lock.
+func (c *Coordinator) expire(g *group) {
+	deadline := time.Now().Add(-c.Config.SessionTimeout)
+
+	expired := false
+	for id, m := range g.members {
+		if m.lastHeartbeat.Before(deadline) {
+			delete(g.members, id)
+			expired = true
+		}
+	}
+
+	if expired {
+		c.rebalance(g)
+	}
+}
+
+// Move the group to the next generation, and assign each partition of a topic
+// to the members subscribed to it in round robin.
+// Caller must hold the lock.
+func (c *Coordinator) rebalance(g *group) {
+	g.generation++
+
+	// Members are sorted, so that assignment is deterministic
+	var ids []string
+	subscribers := make(map[string][]*member)
+	for id, m := range g.members {
+		ids = append(ids, id)
+		m.assignment = nil
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		m := g.members[id]
+		for _, topic := range m.topics {
+			subscribers[topic] = append(subscribers[topic], m)
+		}
+	}
+
+	var topics []string
+	for topic := range subscribers {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	for _, topic := range topics {
+		members := subscribers[topic]
+		t, err := c.topics.Topic(topic)
+		if err != nil {
+			// Topic without partitions yet
+			continue
+		}
+
+		for p := range t.Partitions {
+			m := members[p%len(members)]
+			m.assignment = append(m.assignment, &api.TopicPartition{
+				Topic:     topic,
+				Partition: uint32(p),
+			})
+		}
+	}
+}
+
+func newMemberID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
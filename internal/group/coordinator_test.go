@@ -0,0 +1,184 @@
+package group
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/internal/log"
+	"github.com/wuxl-lang/proglog/internal/metrics"
+)
+
+func TestCoordinator(t *testing.T) {
+	cases := map[string]func(t *testing.T, c *Coordinator){
+		"join and leave":   testJoinLeave,
+		"session timeout":  testSessionTimeout,
+		"commit and fetch": testCommitFetch,
+		"lags":             testLags,
+	}
+
+	for scenario, fn := range cases {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "coordinator-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			topics, err := log.NewTopicManager(dir, log.Config{})
+			require.NoError(t, err)
+
+			// A topic with 4 partitions
+			tc := log.Config{}
+			tc.Topic.Partitions = 4
+			_, err = topics.CreateTopic("orders", tc)
+			require.NoError(t, err)
+
+			c, err := NewCoordinator(topics, Config{SessionTimeout: 50 * time.Millisecond})
+			require.NoError(t, err)
+			defer c.Close()
+
+			fn(t, c)
+		})
+	}
+}
+
+func testJoinLeave(t *testing.T, c *Coordinator) {
+	first, err := c.JoinGroup(&api.JoinGroupRequest{Group: "billing", Topics: []string{"orders"}})
+	require.NoError(t, err)
+	require.NotEmpty(t, first.MemberId)
+	require.Len(t, first.Assignment, 4, "The only member is assigned every partition")
+
+	second, err := c.JoinGroup(&api.JoinGroupRequest{Group: "billing", Topics: []string{"orders"}})
+	require.NoError(t, err)
+	require.Equal(t, first.Generation+1, second.Generation)
+	require.Len(t, second.Assignment, 2)
+
+	// The first member learns the rebalance on heartbeat
+	hb, err := c.Heartbeat(&api.HeartbeatRequest{
+		Group:      "billing",
+		MemberId:   first.MemberId,
+		Generation: first.Generation,
+	})
+	require.NoError(t, err)
+	require.True(t, hb.Rebalance)
+	require.Equal(t, second.Generation, hb.Generation)
+	require.Len(t, hb.Assignment, 2)
+
+	// Partitions are split between members
+	assigned := map[uint32]bool{}
+	for _, tp := range append(hb.Assignment, second.Assignment...) {
+		assigned[tp.Partition] = true
+	}
+	require.Len(t, assigned, 4)
+
+	// The second member leaves, the first member takes every partition
+	_, err = c.LeaveGroup(&api.LeaveGroupRequest{Group: "billing", MemberId: second.MemberId})
+	require.NoError(t, err)
+
+	hb, err = c.Heartbeat(&api.HeartbeatRequest{
+		Group:      "billing",
+		MemberId:   first.MemberId,
+		Generation: hb.Generation,
+	})
+	require.NoError(t, err)
+	require.True(t, hb.Rebalance)
+	require.Len(t, hb.Assignment, 4)
+
+	_, err = c.Heartbeat(&api.HeartbeatRequest{Group: "billing", MemberId: second.MemberId})
+	require.Equal(t, api.ErrUnknownMember{Group: "billing", MemberID: second.MemberId}, err)
+}
+
+func testSessionTimeout(t *testing.T, c *Coordinator) {
+	first, err := c.JoinGroup(&api.JoinGroupRequest{Group: "billing", Topics: []string{"orders"}})
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	// The first member missed heartbeats, so it is removed when the second member joins
+	second, err := c.JoinGroup(&api.JoinGroupRequest{Group: "billing", Topics: []string{"orders"}})
+	require.NoError(t, err)
+	require.Len(t, second.Assignment, 4)
+
+	_, err = c.Heartbeat(&api.HeartbeatRequest{Group: "billing", MemberId: first.MemberId})
+	require.Equal(t, api.ErrUnknownMember{Group: "billing", MemberID: first.MemberId}, err)
+}
+
+func testCommitFetch(t *testing.T, c *Coordinator) {
+	member, err := c.JoinGroup(&api.JoinGroupRequest{Group: "billing", Topics: []string{"orders"}})
+	require.NoError(t, err)
+
+	_, err = c.CommitOffset(&api.CommitOffsetRequest{
+		Group:      "billing",
+		Topic:      "orders",
+		Partition:  1,
+		Offset:     10,
+		MemberId:   member.MemberId,
+		Generation: member.Generation,
+	})
+	require.NoError(t, err)
+
+	res, err := c.FetchOffset(&api.FetchOffsetRequest{Group: "billing", Topic: "orders", Partition: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), res.Offset)
+
+	// Commit of a stale generation is rejected
+	_, err = c.JoinGroup(&api.JoinGroupRequest{Group: "billing", Topics: []string{"orders"}})
+	require.NoError(t, err)
+
+	_, err = c.CommitOffset(&api.CommitOffsetRequest{
+		Group:      "billing",
+		Topic:      "orders",
+		Partition:  1,
+		Offset:     20,
+		MemberId:   member.MemberId,
+		Generation: member.Generation,
+	})
+	require.Equal(t, api.ErrStaleGeneration{Group: "billing", Generation: member.Generation + 1}, err)
+
+	// Consumers outside of the group commit without member
+	_, err = c.CommitOffset(&api.CommitOffsetRequest{Group: "audit", Topic: "orders", Offset: 5})
+	require.NoError(t, err)
+
+	res, err = c.FetchOffset(&api.FetchOffsetRequest{Group: "audit", Topic: "orders"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), res.Offset)
+}
+
+func testLags(t *testing.T, c *Coordinator) {
+	orders, err := c.topics.Topic("orders")
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err = orders.Partitions[2].Append(&api.Record{Value: []byte("order")})
+		require.NoError(t, err)
+	}
+
+	_, err = c.CommitOffset(&api.CommitOffsetRequest{Group: "billing", Topic: "orders", Partition: 2, Offset: 1})
+	require.NoError(t, err)
+	_, err = c.CommitOffset(&api.CommitOffsetRequest{Group: "audit", Topic: "orders", Partition: 2, Offset: 3})
+	require.NoError(t, err)
+
+	// Commits of unknown topics are skipped
+	_, err = c.CommitOffset(&api.CommitOffsetRequest{Group: "billing", Topic: "payments", Offset: 1})
+	require.NoError(t, err)
+
+	require.Equal(t, []*api.ConsumerLag{
+		{Group: "audit", Topic: "orders", Partition: 2, Offset: 3, Lag: 0},
+		{Group: "billing", Topic: "orders", Partition: 2, Offset: 1, Lag: 2},
+	}, c.Lags(""))
+	require.Empty(t, c.Lags("payments"))
+
+	// Lags are exported until the coordinator is closed
+	lag := `proglog_consumer_group_lag{group="billing",topic="orders",partition="2"} 2`
+	var b strings.Builder
+	require.NoError(t, metrics.Default.WriteText(&b))
+	require.Contains(t, b.String(), lag)
+
+	require.NoError(t, c.Close())
+	b.Reset()
+	require.NoError(t, metrics.Default.WriteText(&b))
+	require.NotContains(t, b.String(), lag)
+}
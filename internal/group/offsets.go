@@ -0,0 +1,318 @@
+package group
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/internal/log"
+	"google.golang.org/protobuf/proto"
+)
+
+// Compact the offsets log once it has this many records per committed offset
+const compactRatio = 4
+
+// Offsets holds the committed offsets of consumer groups.
+// Each commit is appended to a compacted log, so that it survives restart and replicates with the data.
+// Commits of transactions are appended by the transaction coordinator, and the control records which end
+// the transactions follow them, so the commits are applied from the log, whenever it is read up to its end.
+type offsets struct {
+	mu sync.Mutex
+
+	log       *log.Log
+	committed map[offsetKey]*api.CommittedOffset
+	// Commits of open transactions by transaction ID, applied when the transaction commits
+	pending map[uint64][]*api.CommittedOffset
+	// Offset of the first commit of each open transaction, which compaction keeps
+	pendingFrom map[uint64]uint64
+	// Offset of the next record to apply
+	next uint64
+	// Records in the log, including the ones which are overwritten
+	records uint64
+}
+
+// Rebuild committed offsets from the log, the latest commit of each group, topic and partition wins
+func newOffsets(l *log.Log) (*offsets, error) {
+	o := &offsets{
+		log:         l,
+		committed:   make(map[offsetKey]*api.CommittedOffset),
+		pending:     make(map[uint64][]*api.CommittedOffset),
+		pendingFrom: make(map[uint64]uint64),
+	}
+
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	o.next = lowest
+
+	if err = o.apply(); err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// Append the committed offset to the log
+func (o *offsets) Commit(commit *api.CommittedOffset) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := o.append(commit); err != nil {
+		return err
+	}
+	if err := o.apply(); err != nil {
+		return err
+	}
+
+	if o.records >= compactRatio*uint64(len(o.committed)) {
+		return o.compact()
+	}
+
+	return nil
+}
+
+// Remove the committed offsets of every group for the topic, including the ones of open transactions
+func (o *offsets) DeleteTopic(topic string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := o.apply(); err != nil {
+		return err
+	}
+
+	keys := make(map[offsetKey]bool)
+	for key := range o.committed {
+		keys[key] = true
+	}
+	for _, commits := range o.pending {
+		for _, commit := range commits {
+			keys[keyOf(commit)] = true
+		}
+	}
+
+	for key := range keys {
+		if key.topic != topic {
+			continue
+		}
+
+		if _, err := o.log.Append(&api.Record{Key: []byte(key.String())}); err != nil {
+			return err
+		}
+	}
+
+	return o.apply()
+}
+
+// Committed offset of a partition for a group
+func (o *offsets) Fetch(group, topic string, partition uint32) (uint64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := o.apply(); err != nil {
+		return 0, err
+	}
+
+	commit, ok := o.committed[offsetKey{group: group, topic: topic, partition: partition}]
+	if !ok {
+		return 0, api.ErrOffsetNotCommitted{Group: group, Topic: topic, Partition: partition}
+	}
+
+	return commit.Offset, nil
+}
+
+// Committed offsets of every group, sorted by group, topic and partition
+func (o *offsets) All() []*api.CommittedOffset {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// If a record can't be read, the commits applied before it are returned, and it is read again next time
+	_ = o.apply()
+
+	all := make([]*api.CommittedOffset, 0, len(o.committed))
+	for _, commit := range o.committed {
+		all = append(all, commit)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		a, b := all[i], all[j]
+		if a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		return a.Partition < b.Partition
+	})
+
+	return all
+}
+
+// Apply the records appended since the last call, including the ones appended by the transaction coordinator.
+// Caller must hold the lock.
+func (o *offsets) apply() error {
+	for ; ; o.next++ {
+		record, err := o.log.Read(o.next)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err = o.applyRecord(o.next, record); err != nil {
+			return err
+		}
+		o.records++
+	}
+}
+
+// Caller must hold the lock
+func (o *offsets) applyRecord(off uint64, record *api.Record) error {
+	id := record.TransactionId
+
+	switch {
+	// Commits of a transaction are applied with the transaction
+	case record.Control == api.ControlType_COMMIT:
+		for _, commit := range o.pending[id] {
+			o.committed[keyOf(commit)] = commit
+		}
+		fallthrough
+	case record.Control == api.ControlType_ABORT:
+		delete(o.pending, id)
+		delete(o.pendingFrom, id)
+
+		return nil
+
+	// A record without value removes the commits of its key, like the commits of a deleted topic
+	case len(record.Value) == 0:
+		key, err := parseKey(string(record.Key))
+		if err != nil {
+			return err
+		}
+		delete(o.committed, key)
+
+		for id, commits := range o.pending {
+			kept := commits[:0]
+			for _, commit := range commits {
+				if keyOf(commit) != key {
+					kept = append(kept, commit)
+				}
+			}
+			o.pending[id] = kept
+		}
+
+		return nil
+	}
+
+	commit := &api.CommittedOffset{}
+	if err := proto.Unmarshal(record.Value, commit); err != nil {
+		return err
+	}
+
+	if id == 0 {
+		o.committed[keyOf(commit)] = commit
+
+		return nil
+	}
+
+	if _, ok := o.pendingFrom[id]; !ok {
+		o.pendingFrom[id] = off
+	}
+	o.pending[id] = append(o.pending[id], commit)
+
+	return nil
+}
+
+// Caller must hold the lock
+func (o *offsets) append(commit *api.CommittedOffset) error {
+	record, err := offsetRecord(commit)
+	if err != nil {
+		return err
+	}
+
+	_, err = o.log.Append(record)
+
+	return err
+}
+
+// Append the latest commit of each key again and remove the segments before them.
+// Records of open transactions are kept, since their commits are applied once the transactions end.
+// Caller must hold the lock.
+func (o *offsets) compact() error {
+	highest, err := o.log.HighestOffset()
+	if err != nil {
+		return err
+	}
+	if err = o.apply(); err != nil {
+		return err
+	}
+
+	lowest := highest + 1
+	for _, off := range o.pendingFrom {
+		if off < lowest {
+			lowest = off
+		}
+	}
+
+	o.records = 0
+	for _, commit := range o.committed {
+		if err = o.append(commit); err != nil {
+			return err
+		}
+	}
+	if err = o.apply(); err != nil {
+		return err
+	}
+
+	if lowest == 0 {
+		return nil
+	}
+
+	// Only whole segments are removed, the records left behind are overwritten on rebuild
+	return o.log.Truncate(lowest - 1)
+}
+
+// Record of the commit, keyed by its group, topic and partition
+func offsetRecord(commit *api.CommittedOffset) (*api.Record, error) {
+	value, err := proto.Marshal(commit)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.Record{Key: []byte(keyOf(commit).String()), Value: value}, nil
+}
+
+// Committed offsets are keyed by group, topic and partition
+type offsetKey struct {
+	group     string
+	topic     string
+	partition uint32
+}
+
+func committedOffset(req *api.CommitOffsetRequest) *api.CommittedOffset {
+	return &api.CommittedOffset{
+		Group:     req.Group,
+		Topic:     req.Topic,
+		Partition: req.Partition,
+		Offset:    req.Offset,
+	}
+}
+
+func keyOf(commit *api.CommittedOffset) offsetKey {
+	return offsetKey{group: commit.Group, topic: commit.Topic, partition: commit.Partition}
+}
+
+// Key of the commit's record, names are quoted so that names with slashes don't collide
+func (k offsetKey) String() string {
+	return fmt.Sprintf("%q/%q/%d", k.group, k.topic, k.partition)
+}
+
+func parseKey(s string) (offsetKey, error) {
+	var k offsetKey
+	if _, err := fmt.Sscanf(s, "%q/%q/%d", &k.group, &k.topic, &k.partition); err != nil {
+		return offsetKey{}, fmt.Errorf("invalid offset key %s: %w", s, err)
+	}
+
+	return k, nil
+}
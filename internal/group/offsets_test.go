@@ -0,0 +1,160 @@
+package group
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/internal/log"
+)
+
+func TestOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsets-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 64
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+
+	o, err := newOffsets(l)
+	require.NoError(t, err)
+
+	_, err = o.Fetch("billing", "orders", 0)
+	require.Equal(t, api.ErrOffsetNotCommitted{Group: "billing", Topic: "orders", Partition: 0}, err)
+
+	// Commit the same partitions many times, so that the log is compacted
+	for i := uint64(1); i <= 20; i++ {
+		for p := uint32(0); p < 2; p++ {
+			err = o.Commit(&api.CommittedOffset{
+				Group:     "billing",
+				Topic:     "orders",
+				Partition: p,
+				Offset:    i * uint64(p+1),
+			})
+			require.NoError(t, err)
+		}
+	}
+
+	off, err := o.Fetch("billing", "orders", 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(40), off)
+
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.NotEqual(t, uint64(0), lowest, "Overwritten commits are removed")
+
+	// Rebuild committed offsets from the log
+	require.NoError(t, l.Close())
+
+	l, err = log.NewLog(dir, c)
+	require.NoError(t, err)
+
+	o, err = newOffsets(l)
+	require.NoError(t, err)
+
+	off, err = o.Fetch("billing", "orders", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), off)
+
+	off, err = o.Fetch("billing", "orders", 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(40), off)
+
+	// Names with slashes don't collide
+	require.NoError(t, o.Commit(&api.CommittedOffset{Group: "a/b", Topic: "c", Offset: 1}))
+	require.NoError(t, o.Commit(&api.CommittedOffset{Group: "a", Topic: "b/c", Offset: 2}))
+
+	off, err = o.Fetch("a/b", "c", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	// Commits of a deleted topic stay removed after rebuild
+	require.NoError(t, o.DeleteTopic("orders"))
+	_, err = o.Fetch("billing", "orders", 1)
+	require.Equal(t, api.ErrOffsetNotCommitted{Group: "billing", Topic: "orders", Partition: 1}, err)
+
+	require.NoError(t, l.Close())
+	l, err = log.NewLog(dir, c)
+	require.NoError(t, err)
+	o, err = newOffsets(l)
+	require.NoError(t, err)
+
+	_, err = o.Fetch("billing", "orders", 0)
+	require.Equal(t, api.ErrOffsetNotCommitted{Group: "billing", Topic: "orders", Partition: 0}, err)
+	off, err = o.Fetch("a", "b/c", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+
+func TestTransactionalOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsets-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 64
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+
+	o, err := newOffsets(l)
+	require.NoError(t, err)
+
+	// Append a commit of the transaction, like the transaction coordinator
+	appendCommit := func(id, offset uint64) {
+		record, err := offsetRecord(&api.CommittedOffset{Group: "billing", Topic: "orders", Offset: offset})
+		require.NoError(t, err)
+		record.TransactionId = id
+		_, err = l.Append(record)
+		require.NoError(t, err)
+	}
+	appendControl := func(id uint64, control api.ControlType) {
+		_, err := l.Append(&api.Record{TransactionId: id, Control: control})
+		require.NoError(t, err)
+	}
+	fetch := func() uint64 {
+		off, err := o.Fetch("billing", "orders", 0)
+		require.NoError(t, err)
+		return off
+	}
+
+	require.NoError(t, o.Commit(&api.CommittedOffset{Group: "billing", Topic: "orders", Offset: 1}))
+
+	// The commit isn't applied before the transaction commits, and survives compaction until then
+	appendCommit(1, 10)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, o.Commit(&api.CommittedOffset{Group: "billing", Topic: "other", Offset: uint64(i)}))
+	}
+	require.Equal(t, uint64(1), fetch())
+
+	appendControl(1, api.ControlType_COMMIT)
+	require.Equal(t, uint64(10), fetch())
+
+	// Commits of aborted transactions are discarded
+	appendCommit(2, 20)
+	appendControl(2, api.ControlType_ABORT)
+	require.Equal(t, uint64(10), fetch())
+
+	// A transaction open on restart is committed by recovery after the rebuild
+	appendCommit(3, 30)
+	require.NoError(t, l.Close())
+
+	l, err = log.NewLog(dir, c)
+	require.NoError(t, err)
+	o, err = newOffsets(l)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), fetch())
+
+	appendControl(3, api.ControlType_COMMIT)
+	require.Equal(t, uint64(30), fetch())
+
+	require.NoError(t, l.Close())
+	l, err = log.NewLog(dir, c)
+	require.NoError(t, err)
+	o, err = newOffsets(l)
+	require.NoError(t, err)
+	require.Equal(t, uint64(30), fetch())
+}
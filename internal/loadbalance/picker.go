@@ -0,0 +1,80 @@
+package loadbalance
+
+import (
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+// Methods which only read, they are sent to followers with follower reads
+var readMethods = map[string]bool{
+	"/log.v1.Log/Consume":       true,
+	"/log.v1.Log/ConsumeStream": true,
+}
+
+// PickerBuilder builds a picker whenever the ready sub connections change
+type PickerBuilder struct {
+	// Spread reads across the followers, otherwise every call goes to the leader
+	FollowerReads bool
+}
+
+var _ base.PickerBuilder = (*PickerBuilder)(nil)
+
+// Split the ready sub connections into the leader and the followers
+func (b *PickerBuilder) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+	p := &Picker{followerReads: b.FollowerReads}
+
+	for sc, scInfo := range buildInfo.ReadySCs {
+		isLeader, _ := scInfo.Address.Attributes.Value(isLeaderKey).(bool)
+		if isLeader {
+			p.leader = sc
+
+			continue
+		}
+
+		p.followers = append(p.followers, sc)
+	}
+
+	return p
+}
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(Name, &PickerBuilder{}, base.Config{}))
+	balancer.Register(base.NewBalancerBuilder(followerReadsName, &PickerBuilder{FollowerReads: true}, base.Config{}))
+}
+
+// Picker sends calls to the leader, and spreads reads across the followers with follower reads
+type Picker struct {
+	leader        balancer.SubConn
+	followers     []balancer.SubConn
+	followerReads bool
+	current       uint64
+}
+
+var _ balancer.Picker = (*Picker)(nil)
+
+func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	var result balancer.PickResult
+
+	// Only the leader accepts writes; reads fall back to the leader if there is no follower
+	if p.followerReads && readMethods[info.FullMethodName] && len(p.followers) > 0 {
+		result.SubConn = p.nextFollower()
+	} else {
+		result.SubConn = p.leader
+	}
+
+	if result.SubConn == nil {
+		return result, balancer.ErrNoSubConnAvailable
+	}
+
+	return result, nil
+}
+
+// Round robin across the followers
+func (p *Picker) nextFollower() balancer.SubConn {
+	cur := atomic.AddUint64(&p.current, uint64(1))
+	idx := int(cur % uint64(len(p.followers)))
+
+	return p.followers[idx]
+}
@@ -0,0 +1,115 @@
+package loadbalance
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+func TestPickerNoSubConnAvailable(t *testing.T) {
+	picker := (&PickerBuilder{}).Build(base.PickerBuildInfo{})
+
+	for _, method := range []string{
+		"/log.v1.Log/Produce",
+		"/log.v1.Log/Consume",
+	} {
+		info := balancer.PickInfo{FullMethodName: method}
+		result, err := picker.Pick(info)
+		require.Equal(t, balancer.ErrNoSubConnAvailable, err)
+		require.Nil(t, result.SubConn)
+	}
+}
+
+func TestPickerProducesToLeader(t *testing.T) {
+	picker, subConns := setupTest(&PickerBuilder{})
+
+	for i := 0; i < 5; i++ {
+		info := balancer.PickInfo{FullMethodName: "/log.v1.Log/Produce"}
+		result, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, subConns[0], result.SubConn)
+	}
+}
+
+func TestPickerConsumesFromLeader(t *testing.T) {
+	picker, subConns := setupTest(&PickerBuilder{})
+
+	for _, method := range []string{
+		"/log.v1.Log/Consume",
+		"/log.v1.Log/ConsumeStream",
+	} {
+		result, err := picker.Pick(balancer.PickInfo{FullMethodName: method})
+		require.NoError(t, err)
+		require.Equal(t, subConns[0], result.SubConn, "Reads go to the leader without follower reads")
+	}
+}
+
+func TestPickerConsumesFromFollowers(t *testing.T) {
+	picker, subConns := setupTest(&PickerBuilder{FollowerReads: true})
+
+	picked := map[balancer.SubConn]int{}
+	for i := 0; i < 6; i++ {
+		info := balancer.PickInfo{FullMethodName: "/log.v1.Log/Consume"}
+		result, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.NotEqual(t, subConns[0], result.SubConn, "Leader should not serve reads")
+		picked[result.SubConn]++
+	}
+
+	// Round robin across followers
+	require.Equal(t, 3, picked[subConns[1]])
+	require.Equal(t, 3, picked[subConns[2]])
+
+	// Only reads go to followers, even if the method name looks like one
+	result, err := picker.Pick(balancer.PickInfo{FullMethodName: "/log.v1.Log/ConsumerGroups"})
+	require.NoError(t, err)
+	require.Equal(t, subConns[0], result.SubConn)
+}
+
+func TestPickerConsumesFromLeaderWithoutFollowers(t *testing.T) {
+	leader := &subConn{}
+	picker := (&PickerBuilder{FollowerReads: true}).Build(base.PickerBuildInfo{
+		ReadySCs: map[balancer.SubConn]base.SubConnInfo{
+			leader: {Address: resolver.Address{Attributes: attributes.New(isLeaderKey, true)}},
+		},
+	})
+
+	result, err := picker.Pick(balancer.PickInfo{FullMethodName: "/log.v1.Log/ConsumeStream"})
+	require.NoError(t, err)
+	require.Equal(t, leader, result.SubConn)
+}
+
+// The first sub connection is the leader
+func setupTest(builder *PickerBuilder) (balancer.Picker, []*subConn) {
+	var subConns []*subConn
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+
+	for i := 0; i < 3; i++ {
+		sc := &subConn{}
+		addr := resolver.Address{
+			Attributes: attributes.New(isLeaderKey, i == 0),
+		}
+		sc.UpdateAddresses([]resolver.Address{addr})
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+		subConns = append(subConns, sc)
+	}
+
+	return builder.Build(buildInfo), subConns
+}
+
+// A mock sub connection
+type subConn struct {
+	addrs []resolver.Address
+}
+
+func (s *subConn) UpdateAddresses(addrs []resolver.Address) {
+	s.addrs = addrs
+}
+
+func (s *subConn) Connect() {}
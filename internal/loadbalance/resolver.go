@@ -0,0 +1,171 @@
+package loadbalance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// Name of the resolver scheme and the balancer, so that clients dial "proglog:///addr"
+const Name = "proglog"
+
+// Name of the balancer which sends reads to followers
+const followerReadsName = Name + "_follower_reads"
+
+// Key of the address attribute which marks the leader
+const isLeaderKey = "is_leader"
+
+// How often the resolver refreshes the server list
+var RefreshInterval = 10 * time.Second
+
+// Builder builds a resolver for each target dialed with the proglog scheme.
+// Clients pass their own with grpc.WithResolvers to change the options.
+type Builder struct {
+	// Spread consumes across the followers. Followers don't replicate the leader's log, so reads from them only
+	// see the records written to them, and offsets of the leader may be out of range. Only set it when every
+	// server has the records, otherwise reads are consistent only on the leader.
+	FollowerReads bool
+}
+
+var _ resolver.Builder = (*Builder)(nil)
+
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	// Use the same credentials as the client to ask the server for the cluster
+	if opts.DialCreds == nil {
+		return nil, errors.New("proglog resolver requires transport credentials")
+	}
+
+	conn, err := grpc.Dial(target.Endpoint, grpc.WithTransportCredentials(opts.DialCreds))
+	if err != nil {
+		return nil, err
+	}
+
+	balancerName := Name
+	if b.FollowerReads {
+		balancerName = followerReadsName
+	}
+
+	r := &Resolver{
+		clientConn:   cc,
+		resolverConn: conn,
+		serviceConfig: cc.ParseServiceConfig(
+			fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, balancerName),
+		),
+		resolveNow: make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	go r.refresh()
+
+	return r, nil
+}
+
+func (b *Builder) Scheme() string {
+	return Name
+}
+
+func init() {
+	resolver.Register(&Builder{})
+}
+
+// Resolver discovers the servers of the cluster through the GetServers RPC
+type Resolver struct {
+	mu            sync.Mutex
+	clientConn    resolver.ClientConn
+	resolverConn  *grpc.ClientConn
+	serviceConfig *serviceconfig.ParseResult
+	resolveNow    chan struct{}
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+var _ resolver.Resolver = (*Resolver)(nil)
+
+// Ask for a resolve, which runs in the background so that gRPC isn't blocked by the RPC.
+// Requests made while one is pending are merged into it.
+func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
+	}
+}
+
+// Ask the server for the cluster and update the client connection's addresses.
+// The lock isn't held during the RPC, so that it doesn't block Close.
+func (r *Resolver) resolve() {
+	client := api.NewLogClient(r.resolverConn)
+	ctx, cancel := context.WithTimeout(context.Background(), RefreshInterval)
+	defer cancel()
+
+	res, err := client.GetServers(ctx, &api.GetServersRequest{})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// The client connection isn't updated once the resolver is closed
+	select {
+	case <-r.done:
+		return
+	default:
+	}
+
+	if err != nil {
+		log.Printf("[ERROR] proglog: failed to resolve servers: %v", err)
+		r.clientConn.ReportError(err)
+
+		return
+	}
+
+	var addrs []resolver.Address
+	for _, server := range res.Servers {
+		addrs = append(addrs, resolver.Address{
+			Addr:       server.RpcAddr,
+			Attributes: attributes.New(isLeaderKey, server.IsLeader),
+		})
+	}
+
+	r.clientConn.UpdateState(resolver.State{
+		Addresses:     addrs,
+		ServiceConfig: r.serviceConfig,
+	})
+}
+
+// Resolve when asked and periodically, so that leader changes and new servers are picked up.
+// Resolves run one at a time, so that an older server list never replaces a newer one.
+func (r *Resolver) refresh() {
+	ticker := time.NewTicker(RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-r.resolveNow:
+			r.resolve()
+		case <-ticker.C:
+			r.resolve()
+		}
+	}
+}
+
+func (r *Resolver) Close() {
+	r.closeOnce.Do(func() {
+		r.mu.Lock()
+		close(r.done)
+		r.mu.Unlock()
+
+		if err := r.resolverConn.Close(); err != nil {
+			log.Printf("[ERROR] proglog: failed to close conn: %v", err)
+		}
+	})
+}
@@ -0,0 +1,131 @@
+package loadbalance
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/config"
+	"github.com/wuxl-lang/proglog/internal/auth"
+	"github.com/wuxl-lang/proglog/internal/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+func TestResolver(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// Set up server with a fixed server list
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        true,
+	})
+	require.NoError(t, err)
+
+	srv, err := server.NewGRPCServer(&server.Config{
+		GetServerer: &getServers{},
+		Authorizer:  auth.New(config.ACLModelFile, config.ACLPolicyFile),
+	}, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+	require.NoError(t, err)
+
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	// Build resolver with client's credentials
+	clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        false,
+	})
+	require.NoError(t, err)
+
+	conn := &clientConn{}
+	opts := resolver.BuildOptions{
+		DialCreds: credentials.NewTLS(clientTLSConfig),
+	}
+	r, err := (&Builder{}).Build(
+		resolver.Target{Endpoint: l.Addr().String()},
+		conn,
+		opts,
+	)
+	require.NoError(t, err)
+	defer r.Close()
+
+	wantState := resolver.State{
+		Addresses: []resolver.Address{{
+			Addr:       "localhost:9001",
+			Attributes: attributes.New(isLeaderKey, true),
+		}, {
+			Addr:       "localhost:9002",
+			Attributes: attributes.New(isLeaderKey, false),
+		}},
+	}
+	resolved := func() bool { return reflect.DeepEqual(wantState, conn.State()) }
+	require.Eventually(t, resolved, time.Second, 10*time.Millisecond)
+
+	// Resolve again in the background, the state should be the same
+	conn.UpdateState(resolver.State{})
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	require.Eventually(t, resolved, time.Second, 10*time.Millisecond)
+
+	// The resolver doesn't fall back to an insecure connection
+	_, err = (&Builder{}).Build(resolver.Target{Endpoint: l.Addr().String()}, conn, resolver.BuildOptions{})
+	require.Error(t, err)
+}
+
+type getServers struct{}
+
+func (s *getServers) GetServers() ([]*api.Server, error) {
+	return []*api.Server{{
+		Id:       "leader",
+		RpcAddr:  "localhost:9001",
+		IsLeader: true,
+	}, {
+		Id:      "follower",
+		RpcAddr: "localhost:9002",
+	}}, nil
+}
+
+// A mock client connection which records the resolved state
+type clientConn struct {
+	resolver.ClientConn
+	mu    sync.Mutex
+	state resolver.State
+}
+
+func (c *clientConn) UpdateState(state resolver.State) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.state = state
+}
+
+func (c *clientConn) State() resolver.State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.state
+}
+
+func (c *clientConn) ReportError(err error) {}
+
+func (c *clientConn) NewAddress(addrs []resolver.Address) {}
+
+func (c *clientConn) NewServiceConfig(config string) {}
+
+func (c *clientConn) ParseServiceConfig(config string) *serviceconfig.ParseResult {
+	return nil
+}
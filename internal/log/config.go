@@ -5,5 +5,11 @@ type Config struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// Records larger than it once marshaled are rejected, so that a record always fits in a segment.
+		// Defaults to MaxStoreBytes.
+		MaxRecordBytes uint64
+	}
+	Topic struct {
+		Partitions uint32
 	}
 }
@@ -0,0 +1,87 @@
+package log
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+
+	api "github.com/wuxl-lang/proglog/api/v1"
+)
+
+// Free bytes the disk needs, so that appends resume once records fit again
+const diskFreeBytes = 64 << 10
+
+// Interval between probes of the free space while the disk is full
+var diskProbeInterval = time.Second
+
+// State of the disk shared by the logs of a topic manager. Once an append fails for lack of space,
+// appends fail fast until a probe finds free space again, so the logs are read-only meanwhile.
+type diskState struct {
+	dir string
+
+	mu        sync.Mutex
+	full      bool
+	lastProbe time.Time
+}
+
+func newDiskState(dir string) *diskState {
+	return &diskState{dir: dir}
+}
+
+func (d *diskState) Full() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.full
+}
+
+// Return disk full error while the disk is full, it is probed at most once per interval
+func (d *diskState) writable() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.full {
+		return nil
+	}
+	if time.Since(d.lastProbe) < diskProbeInterval {
+		return api.ErrDiskFull{}
+	}
+
+	d.lastProbe = time.Now()
+	if free, err := freeBytes(d.dir); err != nil || free < diskFreeBytes {
+		return api.ErrDiskFull{}
+	}
+	d.full = false
+
+	return nil
+}
+
+// Switch to read-only if the write failed for lack of space, and return the error to report
+func (d *diskState) check(err error) error {
+	if !isDiskFull(err) {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.full = true
+	d.lastProbe = time.Now()
+
+	return api.ErrDiskFull{}
+}
+
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+// Bytes available to the process on the disk of the dir, which are read without writing to it
+func freeBytes(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -1,16 +1,20 @@
 package log
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
+	stdlog "log"
 	"os"
 	"path"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/internal/trace"
 )
 
 // A log structure contains a list of segments.
@@ -23,6 +27,16 @@ type Log struct {
 
 	activeSegment *segment
 	segments      []*segment
+
+	// State of idempotent producers and transactions, rebuilt from the records on setup
+	producers    producers
+	transactions *transactions
+
+	// Shared by the logs of a topic manager
+	disk *diskState
+
+	// Segments are unmapped once the log is closed, so it can't be appended or read
+	closed bool
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
@@ -34,9 +48,14 @@ func NewLog(dir string, c Config) (*Log, error) {
 		c.Segment.MaxIndexBytes = 1024
 	}
 
+	if c.Segment.MaxRecordBytes == 0 {
+		c.Segment.MaxRecordBytes = c.Segment.MaxStoreBytes
+	}
+
 	l := &Log{
 		Dir:    dir,
 		Config: c,
+		disk:   newDiskState(dir),
 	}
 
 	return l, l.setup()
@@ -44,30 +63,97 @@ func NewLog(dir string, c Config) (*Log, error) {
 
 // Append record and return absolute offset
 func (l *Log) Append(record *api.Record) (uint64, error) {
+	return l.AppendContext(context.Background(), record)
+}
+
+// Append record as a span of the operation in the context
+func (l *Log) AppendContext(ctx context.Context, record *api.Record) (off uint64, err error) {
+	ctx, span := trace.StartChildSpan(ctx, "log.Append")
+	defer func() {
+		span.SetAttribute("offset", strconv.FormatUint(off, 10))
+		span.End(err)
+	}()
+
 	// Exclude lock
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	// Append record to active segment
-	off, err := l.activeSegment.Append(record)
-	if err != nil {
+	if l.closed {
+		return 0, api.ErrLogClosed{}
+	}
+
+	start := time.Now()
+
+	// Acknowledge duplicate of idempotent producer with its original offset
+	if record.ProducerId != 0 {
+		if off, dup, err := l.producers.lookup(record); dup {
+			return off, err
+		}
+	}
+
+	if err = l.disk.writable(); err != nil {
 		return 0, err
 	}
 
-	// If active segment is ful, new a segment from
+	// The active segment is still full if rolling it failed after the last append
 	if l.activeSegment.IsMax() {
-		err = l.newSegment(off + 1)
+		if err = l.roll(ctx); err != nil {
+			return 0, err
+		}
+	}
+
+	// Append record to active segment, a failed append leaves no partial record behind
+	off, err = l.activeSegment.AppendContext(ctx, record)
+	if err != nil {
+		return 0, l.disk.check(err)
+	}
+
+	if record.ProducerId != 0 {
+		l.producers.update(record, off)
+	}
+	l.transactions.update(record, off)
+	observeAppend(start, len(record.Value))
+
+	// If active segment is ful, new a segment from.
+	// The record is appended even if it fails, so it is rolled again by the next append.
+	if l.activeSegment.IsMax() {
+		l.roll(ctx)
+	}
+
+	return off, nil
+}
+
+// Start a new active segment at the end offset.
+// Caller must hold the lock.
+func (l *Log) roll(ctx context.Context) (err error) {
+	_, span := trace.StartChildSpan(ctx, "segment.Roll")
+	defer func() { span.End(err) }()
+
+	if err = l.disk.check(l.newSegment(l.activeSegment.nextOffset)); err != nil {
+		return err
 	}
 
-	return off, err
+	// The snapshot covers the segments before the new one, so that opening the log only reads the active one
+	l.snapshotState(l.activeSegment.baseOffset)
+
+	return nil
 }
 
 // Read record by absolute offset
 func (l *Log) Read(off uint64) (*api.Record, error) {
+	return l.ReadContext(context.Background(), off)
+}
+
+// Read record as a span of the operation in the context
+func (l *Log) ReadContext(ctx context.Context, off uint64) (*api.Record, error) {
 	// Read lock
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
+	if l.closed {
+		return nil, api.ErrLogClosed{}
+	}
+
 	// Find the segment contains the absolute offset
 	var s *segment
 	for _, segment := range l.segments {
@@ -81,19 +167,37 @@ func (l *Log) Read(off uint64) (*api.Record, error) {
 		return nil, api.ErrOffsetOutOfRange{Offset: off}
 	}
 
-	return s.Read(off)
+	// Consumers poll past the end of the log, so misses aren't traced
+	ctx, span := trace.StartChildSpan(ctx, "log.Read")
+	span.SetAttribute("offset", strconv.FormatUint(off, 10))
+
+	start := time.Now()
+	record, err := s.ReadContext(ctx, off)
+	if err == nil {
+		observeRead(start)
+	}
+	span.End(err)
+
+	return record, err
 }
 
-// Close all segments
+// Close all segments, closing again does nothing
 func (l *Log) Close() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	if l.closed {
+		return nil
+	}
+
+	l.snapshotState(l.activeSegment.nextOffset)
+
 	for _, segment := range l.segments {
 		if err := segment.Close(); err != nil {
 			return err
 		}
 	}
+	l.closed = true
 
 	return nil
 }
@@ -107,13 +211,55 @@ func (l *Log) Remove() error {
 	return os.RemoveAll(l.Dir)
 }
 
-// Removel the entire dir and reset log with initial offset
+// Removel the entire dir and reset log with initial offset.
+// If it fails, the log is closed with the offsets of the old segments, so that it returns errors
+// instead of using removed segments, until it is opened again.
 func (l *Log) Reset() error {
-	if err := l.Remove(); err != nil {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return api.ErrLogClosed{}
+	}
+
+	segments, activeSegment := l.segments, l.activeSegment
+	if err := l.reset(); err != nil {
+		l.segments, l.activeSegment = segments, activeSegment
+		l.closed = true
+
+		return err
+	}
+
+	return nil
+}
+
+// Caller must hold the lock
+func (l *Log) reset() error {
+	for _, segment := range l.segments {
+		if err := segment.Close(); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(l.Dir); err != nil {
+		return err
+	}
+
+	// The dir is created again, so that setup starts from an empty dir
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
 		return err
 	}
+	l.segments = nil
+	l.activeSegment = nil
 
-	return l.setup()
+	if err := l.setup(); err != nil {
+		for _, segment := range l.segments {
+			segment.Close()
+		}
+
+		return err
+	}
+
+	return nil
 }
 
 // Lowest absolute offset
@@ -137,14 +283,27 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return off - 1, nil
 }
 
-// Remove segment whose next offset -1 is less or equal than lowest
+// Offset of the next record to append
+func (l *Log) EndOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.segments[len(l.segments)-1].nextOffset
+}
+
+// Remove segment whose next offset -1 is less or equal than lowest.
+// The active segment is kept, so that the log can still be appended
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	if l.closed {
+		return api.ErrLogClosed{}
+	}
+
 	var segments []*segment
 	for _, segment := range l.segments {
-		if segment.nextOffset <= lowest+1 {
+		if segment != l.activeSegment && segment.nextOffset <= lowest+1 {
 			if err := segment.Remove(); err != nil {
 				return err
 			}
@@ -158,6 +317,52 @@ func (l *Log) Truncate(lowest uint64) error {
 	return nil
 }
 
+// Start a new active segment at the end offset, unless the active segment is empty.
+// Return the base offset of the active segment
+func (l *Log) Roll() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return 0, api.ErrLogClosed{}
+	}
+
+	if l.activeSegment.nextOffset == l.activeSegment.baseOffset {
+		return l.activeSegment.baseOffset, nil
+	}
+
+	if err := l.roll(context.Background()); err != nil {
+		return 0, err
+	}
+
+	return l.activeSegment.baseOffset, nil
+}
+
+type SegmentInfo struct {
+	BaseOffset uint64
+	NextOffset uint64
+	StoreBytes uint64
+	IndexBytes uint64
+}
+
+// Offsets and sizes of every segment, the last one is active
+func (l *Log) Segments() []SegmentInfo {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	segments := make([]SegmentInfo, len(l.segments))
+	for i, segment := range l.segments {
+		segments[i] = SegmentInfo{
+			BaseOffset: segment.baseOffset,
+			NextOffset: segment.nextOffset,
+			StoreBytes: segment.store.size,
+			IndexBytes: segment.index.size,
+		}
+	}
+
+	return segments
+}
+
 //Read the whole log
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
@@ -194,14 +399,22 @@ func (l *Log) setup() error {
 
 	// Store is organized as baseOffset.store
 	// Index is organized as baseoffset.index
+	// Other files in the dir don't belong to segments
 	var baseOffsets []uint64
 	for _, file := range files {
+		if file.IsDir() || path.Ext(file.Name()) != ".store" {
+			continue
+		}
+
 		offStr := strings.TrimSuffix(
 			file.Name(),
 			path.Ext(file.Name()),
 		)
 
-		off, _ := strconv.ParseUint(offStr, 10, 0)
+		off, err := strconv.ParseUint(offStr, 10, 0)
+		if err != nil {
+			continue
+		}
 		baseOffsets = append(baseOffsets, off)
 	}
 	sort.Slice(baseOffsets, func(i, j int) bool { // Sort existing baseOffsets
@@ -209,13 +422,10 @@ func (l *Log) setup() error {
 	})
 
 	// Re-construct segment for each baseOffset
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
+	for _, baseOffset := range baseOffsets {
+		if err = l.newSegment(baseOffset); err != nil {
 			return err
 		}
-
-		// baseOffset contains dup for index and store so it skip the dup
-		i++
 	}
 
 	// If no existing segment, new segment from initial offset
@@ -225,6 +435,36 @@ func (l *Log) setup() error {
 		}
 	}
 
+	return l.setupState()
+}
+
+// Rebuild state of idempotent producers and transactions from the snapshot and the records after it.
+// A record which can't be read is skipped, so that it doesn't keep the whole log from opening.
+func (l *Log) setupState() error {
+	l.producers = make(producers)
+	l.transactions = newTransactions()
+
+	start := l.loadState(l.segments[0].baseOffset, l.activeSegment.nextOffset)
+	for _, segment := range l.segments {
+		off := segment.baseOffset
+		if off < start {
+			off = start
+		}
+
+		for ; off < segment.nextOffset; off++ {
+			record, err := segment.Read(off)
+			if err != nil {
+				stdlog.Printf("[WARN] proglog: skipping record %d of log %s: %v", off, l.Dir, err)
+				continue
+			}
+
+			if record.ProducerId != 0 {
+				l.producers.update(record, off)
+			}
+			l.transactions.update(record, off)
+		}
+	}
+
 	return nil
 }
 
@@ -2,9 +2,14 @@ package log
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	api "github.com/wuxl-lang/proglog/api/v1"
@@ -17,10 +22,21 @@ var test_record = &api.Record{
 
 func TestLog(t *testing.T) {
 	cases := map[string]func(t *testing.T, log *Log){
-		"append and read":   testAppendRead,
-		"init existing log": testInitExisting,
-		"reader":            testReader,
-		"truncate":          testTruncate,
+		"append and read":     testAppendRead,
+		"init existing log":   testInitExisting,
+		"reader":              testReader,
+		"truncate":            testTruncate,
+		"truncate active":     testTruncateActive,
+		"reset":               testReset,
+		"failed reset":        testFailedReset,
+		"roll":                testRoll,
+		"max record bytes":    testMaxRecordBytes,
+		"disk full":           testDiskFull,
+		"idempotent producer": testIdempotentProducer,
+		"read committed":      testReadCommitted,
+		"state snapshot":      testStateSnapshot,
+		"corrupt record":      testCorruptRecord,
+		"stats":               testStats,
 	}
 
 	fmt.Printf("test\n")
@@ -40,6 +56,30 @@ func TestLog(t *testing.T) {
 	}
 }
 
+func testStats(t *testing.T, log *Log) {
+	stats := log.Stats()
+	require.Equal(t, Stats{Segments: 1}, stats)
+	require.Equal(t, uint64(0), log.EndOffset())
+
+	// The first record fills part of the store, the second one rolls a new segment
+	_, err := log.Append(test_record)
+	require.NoError(t, err)
+
+	stats = log.Stats()
+	require.Equal(t, 1, stats.Segments)
+	require.True(t, stats.Bytes > 0)
+	require.InDelta(t, float64(stats.Bytes)/32, stats.ActiveFill, 0.001)
+
+	_, err = log.Append(test_record)
+	require.NoError(t, err)
+
+	stats = log.Stats()
+	require.Equal(t, 2, stats.Segments)
+	require.Equal(t, float64(0), stats.ActiveFill)
+	require.Equal(t, uint64(2), stats.EndOffset)
+	require.Equal(t, uint64(2), log.EndOffset())
+}
+
 func testAppendRead(t *testing.T, log *Log) {
 	off, err := log.Append(test_record)
 	require.NoError(t, err)
@@ -109,3 +149,293 @@ func testTruncate(t *testing.T, log *Log) {
 	log.Truncate(1) // First segment is removed
 	require.Equal(t, 1, len(log.segments))
 }
+
+func testTruncateActive(t *testing.T, log *Log) {
+	off, err := log.Append(test_record)
+	require.NoError(t, err)
+
+	// The active segment is kept, so the log can still be appended
+	require.NoError(t, log.Truncate(off))
+	require.Equal(t, 1, len(log.segments))
+
+	off, err = log.Append(test_record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+func testReset(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(test_record)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, log.Reset())
+	require.Equal(t, uint64(0), log.EndOffset())
+	_, err := log.Read(0)
+	require.Error(t, err)
+
+	off, err := log.Append(test_record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+}
+
+func testFailedReset(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(test_record)
+		require.NoError(t, err)
+	}
+
+	// The new segment can't map an empty index
+	log.Config.Segment.MaxIndexBytes = 0
+	require.Error(t, log.Reset())
+
+	// The log is closed with the old offsets, instead of being left without segments
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lowest)
+	require.Equal(t, uint64(3), log.EndOffset())
+	require.Equal(t, uint64(3), log.Stats().EndOffset)
+
+	_, err = log.Append(test_record)
+	require.Equal(t, api.ErrLogClosed{}, err)
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrLogClosed{}, err)
+}
+
+func testRoll(t *testing.T, log *Log) {
+	// An empty active segment isn't rolled
+	base, err := log.Roll()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), base)
+	require.Equal(t, 1, len(log.Segments()))
+
+	_, err = log.Append(test_record)
+	require.NoError(t, err)
+
+	base, err = log.Roll()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), base)
+
+	segments := log.Segments()
+	require.Equal(t, 2, len(segments))
+	require.Equal(t, uint64(0), segments[0].BaseOffset)
+	require.Equal(t, uint64(1), segments[0].NextOffset)
+	require.True(t, segments[0].StoreBytes > 0)
+	require.Equal(t, SegmentInfo{BaseOffset: 1, NextOffset: 1}, segments[1])
+
+	off, err := log.Append(test_record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+func testMaxRecordBytes(t *testing.T, log *Log) {
+	// The maximum defaults to the store size, so a record always fits in a segment
+	require.Equal(t, uint64(32), log.Config.Segment.MaxRecordBytes)
+
+	_, err := log.Append(&api.Record{Value: make([]byte, 32)})
+	require.Equal(t, api.ErrRecordTooLarge{Size: 34, Max: 32}, err)
+	require.Equal(t, uint64(0), log.EndOffset())
+
+	off, err := log.Append(test_record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+}
+
+func testDiskFull(t *testing.T, log *Log) {
+	off, err := log.Append(test_record)
+	require.NoError(t, err)
+
+	interval := diskProbeInterval
+	diskProbeInterval = time.Hour
+	defer func() { diskProbeInterval = interval }()
+
+	// The log is read-only once an append fails for lack of space
+	err = log.disk.check(&os.PathError{Op: "write", Path: "0.store", Err: syscall.ENOSPC})
+	require.Equal(t, api.ErrDiskFull{}, err)
+
+	_, err = log.Append(test_record)
+	require.Equal(t, api.ErrDiskFull{}, err)
+
+	read, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, test_record.Value, read.Value)
+
+	// Appends resume once a probe finds space
+	diskProbeInterval = 0
+	off, err = log.Append(test_record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	require.False(t, log.disk.Full())
+}
+
+func testIdempotentProducer(t *testing.T, log *Log) {
+	for seq := uint64(1); seq <= 3; seq++ {
+		off, err := log.Append(&api.Record{Value: test_record.Value, ProducerId: 1, Sequence: seq})
+		require.NoError(t, err)
+		require.Equal(t, seq-1, off)
+	}
+
+	// Retry is acknowledged with the original offset
+	off, err := log.Append(&api.Record{Value: test_record.Value, ProducerId: 1, Sequence: 2})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	// Other producers and records without producer aren't affected
+	off, err = log.Append(&api.Record{Value: test_record.Value, ProducerId: 2, Sequence: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	off, err = log.Append(test_record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+
+	// Producer state is rebuilt from the log
+	require.NoError(t, log.Close())
+
+	l, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+
+	off, err = l.Append(&api.Record{Value: test_record.Value, ProducerId: 1, Sequence: 3})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	off, err = l.Append(&api.Record{Value: test_record.Value, ProducerId: 1, Sequence: 4})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+
+	// Duplicates older than the window are rejected
+	for seq := uint64(5); seq <= producerWindow+4; seq++ {
+		_, err = l.Append(&api.Record{Value: test_record.Value, ProducerId: 1, Sequence: seq})
+		require.NoError(t, err)
+	}
+
+	_, err = l.Append(&api.Record{Value: test_record.Value, ProducerId: 1, Sequence: 1})
+	require.Equal(t, api.ErrDuplicateSequence{ProducerID: 1, Sequence: 1}, err)
+}
+
+func testStateSnapshot(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: test_record.Value, ProducerId: 1, Sequence: 1})
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: test_record.Value, TransactionId: 1})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	// Records before the snapshot aren't read on open, so the state survives them being unreadable
+	corruptRecords(t, log.Dir)
+
+	l, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer l.Close()
+
+	off, err := l.Append(&api.Record{Value: test_record.Value, ProducerId: 1, Sequence: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	require.Equal(t, []uint64{1}, l.OpenTransactions())
+
+	// Records after the snapshot of the last roll are read
+	_, err = l.Append(&api.Record{Value: test_record.Value, TransactionId: 2})
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(path.Join(l.Dir, stateSnapshotFile)))
+	require.NoError(t, l.saveState(l.activeSegment.baseOffset))
+	require.NoError(t, l.Close())
+
+	l, err = NewLog(l.Dir, l.Config)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2}, l.OpenTransactions())
+}
+
+func testCorruptRecord(t *testing.T, log *Log) {
+	for seq := uint64(1); seq <= 3; seq++ {
+		_, err := log.Append(&api.Record{Value: test_record.Value, ProducerId: 1, Sequence: seq})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// Without a snapshot, a bad record is skipped instead of failing the open
+	require.NoError(t, os.Remove(path.Join(log.Dir, stateSnapshotFile)))
+	corruptRecords(t, log.Dir, "0.store")
+
+	l, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer l.Close()
+
+	off, err := l.Append(&api.Record{Value: test_record.Value, ProducerId: 1, Sequence: 3})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+
+// Overwrite the first record of the stores, of every store if no file is given
+func corruptRecords(t *testing.T, dir string, files ...string) {
+	t.Helper()
+
+	if len(files) == 0 {
+		matches, err := filepath.Glob(path.Join(dir, "*.store"))
+		require.NoError(t, err)
+		for _, match := range matches {
+			files = append(files, filepath.Base(match))
+		}
+	}
+
+	for _, file := range files {
+		f, err := os.OpenFile(path.Join(dir, file), os.O_RDWR, 0644)
+		require.NoError(t, err)
+
+		// The active segment may be empty
+		length := make([]byte, lenWidth)
+		if _, err = f.ReadAt(length, 0); err == io.EOF {
+			require.NoError(t, f.Close())
+			continue
+		}
+		require.NoError(t, err)
+
+		garbage := make([]byte, enc.Uint64(length))
+		for i := range garbage {
+			garbage[i] = 0xff
+		}
+		_, err = f.WriteAt(garbage, lenWidth)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+}
+
+func testReadCommitted(t *testing.T, log *Log) {
+	// Offset 0 and 2 belong to transaction 1, offset 1 to transaction 2
+	for _, id := range []uint64{1, 2, 1} {
+		_, err := log.Append(&api.Record{Value: test_record.Value, TransactionId: id})
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint64(0), log.LastStableOffset())
+	require.Equal(t, []uint64{1, 2}, log.OpenTransactions())
+
+	_, err := log.ReadCommitted(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+
+	// Committing transaction 1 is blocked by transaction 2 in between
+	_, err = log.Append(&api.Record{TransactionId: 1, Control: api.ControlType_COMMIT})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), log.LastStableOffset())
+
+	record, err := log.ReadCommitted(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), record.TransactionId)
+
+	_, err = log.Append(&api.Record{TransactionId: 2, Control: api.ControlType_ABORT})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), log.LastStableOffset())
+
+	_, err = log.ReadCommitted(1)
+	require.Equal(t, api.ErrRecordNotVisible{Offset: 1}, err)
+
+	// Transaction state is rebuilt from the log
+	_, err = log.Append(&api.Record{Value: test_record.Value, TransactionId: 3})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	l, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{3}, l.OpenTransactions())
+	require.Equal(t, uint64(5), l.LastStableOffset())
+
+	_, err = l.ReadCommitted(1)
+	require.Equal(t, api.ErrRecordNotVisible{Offset: 1}, err)
+}
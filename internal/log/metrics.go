@@ -0,0 +1,121 @@
+package log
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/wuxl-lang/proglog/internal/metrics"
+)
+
+var (
+	appendsTotal   = metrics.Default.NewCounter("proglog_log_appends_total", "Records appended to logs.")
+	appendedBytes  = metrics.Default.NewCounter("proglog_log_appended_bytes_total", "Bytes of records appended to logs.")
+	appendDuration = metrics.Default.NewHistogram("proglog_log_append_duration_seconds", "Latency of appending records.", nil)
+	readsTotal     = metrics.Default.NewCounter("proglog_log_reads_total", "Records read from logs.")
+	readDuration   = metrics.Default.NewHistogram("proglog_log_read_duration_seconds", "Latency of reading records.", nil)
+
+	// Reported by every open topic manager under its dir
+	segmentsGauge = metrics.Default.NewGaugeFuncSet("proglog_log_segments", "Segments of partitions.", "topic", "partition")
+	bytesGauge    = metrics.Default.NewGaugeFuncSet("proglog_log_bytes", "Bytes of partitions on disk.", "topic", "partition")
+	lowestGauge   = metrics.Default.NewGaugeFuncSet("proglog_log_lowest_offset", "Lowest offsets of partitions.", "topic", "partition")
+	endGauge      = metrics.Default.NewGaugeFuncSet("proglog_log_end_offset", "Offsets of the next records of partitions.", "topic", "partition")
+	fillGauge     = metrics.Default.NewGaugeFuncSet("proglog_log_active_segment_fill_ratio", "Fill level of active segments of partitions.", "topic", "partition")
+	diskFullGauge = metrics.Default.NewGaugeFuncSet("proglog_disk_full", "Whether appends fail for lack of space by dir.", "dir")
+	managerGauges = []*metrics.GaugeFuncSet{segmentsGauge, bytesGauge, lowestGauge, endGauge, fillGauge, diskFullGauge}
+)
+
+func observeAppend(start time.Time, size int) {
+	appendsTotal.Inc()
+	appendedBytes.Add(float64(size))
+	appendDuration.Observe(time.Since(start).Seconds())
+}
+
+func observeRead(start time.Time) {
+	readsTotal.Inc()
+	readDuration.Observe(time.Since(start).Seconds())
+}
+
+// Size of a log on disk
+type Stats struct {
+	Segments int
+	// Bytes of stores, indexes are preallocated so they aren't counted
+	Bytes uint64
+	// Ratio of the active segment to its max size, which rolls a new segment at 1
+	ActiveFill float64
+	// Offset of the first record, and of the next record to append
+	LowestOffset uint64
+	EndOffset    uint64
+}
+
+func (l *Log) Stats() Stats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	stats := Stats{
+		Segments:     len(l.segments),
+		LowestOffset: l.segments[0].baseOffset,
+		EndOffset:    l.activeSegment.nextOffset,
+	}
+	for _, segment := range l.segments {
+		stats.Bytes += segment.store.size
+	}
+
+	store := float64(l.activeSegment.store.size) / float64(l.activeSegment.config.Segment.MaxStoreBytes)
+	index := float64(l.activeSegment.index.size) / float64(l.activeSegment.config.Segment.MaxIndexBytes)
+	stats.ActiveFill = store
+	if index > store {
+		stats.ActiveFill = index
+	}
+
+	return stats
+}
+
+// Report the size of every partition of the topics on scrape, until the manager is closed
+func (m *TopicManager) registerMetrics() {
+	each := func(emit func(float64, ...string), value func(Stats) float64) {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		names := make([]string, 0, len(m.topics))
+		for name := range m.topics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			for p, l := range m.topics[name].Partitions {
+				emit(value(l.Stats()), name, strconv.Itoa(p))
+			}
+		}
+	}
+
+	segmentsGauge.Set(m.Dir, func(emit func(float64, ...string)) {
+		each(emit, func(s Stats) float64 { return float64(s.Segments) })
+	})
+	bytesGauge.Set(m.Dir, func(emit func(float64, ...string)) {
+		each(emit, func(s Stats) float64 { return float64(s.Bytes) })
+	})
+	lowestGauge.Set(m.Dir, func(emit func(float64, ...string)) {
+		each(emit, func(s Stats) float64 { return float64(s.LowestOffset) })
+	})
+	endGauge.Set(m.Dir, func(emit func(float64, ...string)) {
+		each(emit, func(s Stats) float64 { return float64(s.EndOffset) })
+	})
+	fillGauge.Set(m.Dir, func(emit func(float64, ...string)) {
+		each(emit, func(s Stats) float64 { return s.ActiveFill })
+	})
+	diskFullGauge.Set(m.Dir, func(emit func(float64, ...string)) {
+		full := 0.0
+		if m.DiskFull() {
+			full = 1
+		}
+		emit(full, m.Dir)
+	})
+}
+
+func (m *TopicManager) unregisterMetrics() {
+	for _, g := range managerGauges {
+		g.Delete(m.Dir)
+	}
+}
@@ -0,0 +1,76 @@
+package log
+
+import (
+	api "github.com/wuxl-lang/proglog/api/v1"
+)
+
+// Internal topic which records registered producers, so that their IDs are unique across restarts
+const ProducersTopic = "__producers"
+
+// Number of recent sequences remembered for each producer,
+// duplicates of older sequences are rejected since their offsets are unknown
+const producerWindow = 5
+
+// The recent sequences of a producer and the offsets where they were appended, in ascending order
+type producerState struct {
+	sequences []uint64
+	offsets   []uint64
+}
+
+// State of idempotent producers in a log, by producer ID
+type producers map[uint64]*producerState
+
+// Find the offset of a duplicate record.
+// A record is duplicate if its sequence isn't greater than the producer's last sequence.
+func (p producers) lookup(record *api.Record) (off uint64, dup bool, err error) {
+	s, ok := p[record.ProducerId]
+	if !ok || record.Sequence > s.sequences[len(s.sequences)-1] {
+		return 0, false, nil
+	}
+
+	for i, seq := range s.sequences {
+		if seq == record.Sequence {
+			return s.offsets[i], true, nil
+		}
+	}
+
+	return 0, true, api.ErrDuplicateSequence{
+		ProducerID: record.ProducerId,
+		Sequence:   record.Sequence,
+	}
+}
+
+// Remember the offset of the producer's record
+func (p producers) update(record *api.Record, off uint64) {
+	s, ok := p[record.ProducerId]
+	if !ok {
+		s = &producerState{}
+		p[record.ProducerId] = s
+	}
+
+	s.sequences = append(s.sequences, record.Sequence)
+	s.offsets = append(s.offsets, off)
+
+	if len(s.sequences) > producerWindow {
+		s.sequences = s.sequences[1:]
+		s.offsets = s.offsets[1:]
+	}
+}
+
+// Register a producer, its ID is the offset of its registration plus one, so that zero means no producer
+func (m *TopicManager) RegisterProducer() (uint64, error) {
+	c := Config{}
+	c.Topic.Partitions = 1
+
+	topic, err := m.OpenTopicWithConfig(ProducersTopic, c)
+	if err != nil {
+		return 0, err
+	}
+
+	off, err := topic.Partitions[0].Append(&api.Record{})
+	if err != nil {
+		return 0, err
+	}
+
+	return off + 1, nil
+}
@@ -1,11 +1,14 @@
 package log
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path"
+	"strconv"
 
 	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/internal/trace"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -64,6 +67,15 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 
 // Append a record into store and return absolute offset
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
+	return s.AppendContext(context.Background(), record)
+}
+
+// Append a record as a span of the operation in the context, which covers writing the store and the index
+func (s *segment) AppendContext(ctx context.Context, record *api.Record) (offset uint64, err error) {
+	_, span := trace.StartChildSpan(ctx, "segment.Append")
+	span.SetAttribute("base_offset", strconv.FormatUint(s.baseOffset, 10))
+	defer func() { span.End(err) }()
+
 	// Assign next absolute offset to record
 	cur := s.nextOffset
 	record.Offset = cur
@@ -73,6 +85,9 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	if err != nil {
 		return 0, err
 	}
+	if max := s.config.Segment.MaxRecordBytes; max > 0 && uint64(len(p)) > max {
+		return 0, api.ErrRecordTooLarge{Size: uint64(len(p)), Max: max}
+	}
 
 	// Append bytes into store
 	_, pos, err := s.store.Append(p)
@@ -80,9 +95,13 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 		return 0, err
 	}
 
-	// Write relative offset and position into index
+	// Write relative offset and position into index.
+	// If it fails, the record is removed from the store, so that the next entry points to the next record.
 	err = s.index.Write(uint32(cur-s.baseOffset), pos)
 	if err != nil {
+		if rerr := s.store.rollback(pos); rerr != nil {
+			return 0, fmt.Errorf("%w, and failed to roll back the store: %v", err, rerr)
+		}
 		return 0, err
 	}
 
@@ -94,6 +113,15 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 
 // Read record by aboslute offset
 func (s *segment) Read(off uint64) (*api.Record, error) {
+	return s.ReadContext(context.Background(), off)
+}
+
+// Read record as a span of the operation in the context
+func (s *segment) ReadContext(ctx context.Context, off uint64) (record *api.Record, err error) {
+	_, span := trace.StartChildSpan(ctx, "segment.Read")
+	span.SetAttribute("base_offset", strconv.FormatUint(s.baseOffset, 10))
+	defer func() { span.End(err) }()
+
 	// Read position by relative offset
 	_, pos, err := s.index.Read(int64(off - s.baseOffset))
 	if err != nil {
@@ -107,7 +135,7 @@ func (s *segment) Read(off uint64) (*api.Record, error) {
 	}
 
 	// New record
-	record := &api.Record{}
+	record = &api.Record{}
 	err = proto.Unmarshal(p, record)
 
 	return record, err
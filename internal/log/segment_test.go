@@ -39,8 +39,14 @@ func TestSegment(t *testing.T) {
 		require.Equal(t, want.Value, got.Value)
 	}
 
-	_, err = s.Append(want) // Store is appended but index is full
+	size := s.store.size
+	_, err = s.Append(want) // Index is full, so the store is rolled back
 	require.Equal(t, io.EOF, err)
+	require.Equal(t, size, s.store.size)
+
+	info, err := os.Stat(s.store.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(size), info.Size())
 
 	require.True(t, s.IsMax()) // Index is full
 
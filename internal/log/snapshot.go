@@ -0,0 +1,97 @@
+package log
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	stdlog "log"
+	"os"
+	"path"
+)
+
+// File of the log's dir which holds the latest state snapshot
+const stateSnapshotFile = "state.snapshot"
+
+// Snapshot of the state of idempotent producers and transactions,
+// so that opening a log only reads the records after it
+type stateSnapshot struct {
+	// The state covers the records before it
+	EndOffset uint64                      `json:"end_offset"`
+	Producers map[uint64]producerSnapshot `json:"producers"`
+	Open      map[uint64]uint64           `json:"open"`
+	Aborted   []uint64                    `json:"aborted"`
+}
+
+type producerSnapshot struct {
+	Sequences []uint64 `json:"sequences"`
+	Offsets   []uint64 `json:"offsets"`
+}
+
+// Write the state of the records before the end offset. It is written to a temporary file first,
+// so that a crash never leaves a partial snapshot behind.
+// Caller must hold the lock.
+func (l *Log) saveState(end uint64) error {
+	snapshot := stateSnapshot{
+		EndOffset: end,
+		Producers: make(map[uint64]producerSnapshot, len(l.producers)),
+		Open:      l.transactions.open,
+	}
+	for id, s := range l.producers {
+		snapshot.Producers[id] = producerSnapshot{Sequences: s.sequences, Offsets: s.offsets}
+	}
+	for id := range l.transactions.aborted {
+		snapshot.Aborted = append(snapshot.Aborted, id)
+	}
+
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	tmp := path.Join(l.Dir, stateSnapshotFile+".tmp")
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path.Join(l.Dir, stateSnapshotFile))
+}
+
+// Save the state, which only speeds up the next open, so a failure is logged
+// Caller must hold the lock.
+func (l *Log) snapshotState(end uint64) {
+	if err := l.saveState(end); err != nil {
+		stdlog.Printf("[WARN] proglog: failed to snapshot state of log %s: %v", l.Dir, err)
+	}
+}
+
+// Load the snapshot into the state, and return the offset to read records from.
+// A missing or invalid snapshot is ignored, so that the state is rebuilt from the lowest offset.
+// Caller must hold the lock.
+func (l *Log) loadState(lowest, end uint64) uint64 {
+	b, err := ioutil.ReadFile(path.Join(l.Dir, stateSnapshotFile))
+	if err != nil {
+		return lowest
+	}
+
+	var snapshot stateSnapshot
+	if err = json.Unmarshal(b, &snapshot); err != nil || snapshot.EndOffset > end {
+		stdlog.Printf("[WARN] proglog: ignoring state snapshot of log %s", l.Dir)
+		return lowest
+	}
+
+	for id, s := range snapshot.Producers {
+		l.producers[id] = &producerState{sequences: s.Sequences, offsets: s.Offsets}
+	}
+	for id, off := range snapshot.Open {
+		l.transactions.open[id] = off
+	}
+	for _, id := range snapshot.Aborted {
+		l.transactions.aborted[id] = true
+	}
+
+	if snapshot.EndOffset < lowest {
+		return lowest
+	}
+
+	return snapshot.EndOffset
+}
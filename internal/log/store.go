@@ -1,8 +1,8 @@
 package log
 
 import (
-	"bufio"
 	"encoding/binary"
+	"fmt"
 	"os"
 	"sync"
 )
@@ -16,10 +16,11 @@ const (
 )
 
 // The store struct is a simple wrapper around a file.
+// Every record is written to the file before it is acknowledged, and a failed write is rolled back,
+// so that the file only has whole records and a failure never takes acknowledged records with it.
 type store struct {
 	*os.File
 	mu   sync.Mutex
-	buf  *bufio.Writer
 	size uint64
 }
 
@@ -35,7 +36,6 @@ func newStore(f *os.File) (*store, error) {
 	return &store{
 		File: f,
 		size: size,
-		buf:  bufio.NewWriter(f),
 	}, nil
 }
 
@@ -46,34 +46,45 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	defer s.mu.Unlock()
 
 	pos = s.size
-	// Write the length of the record
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
+
+	// Write the length of the record, and then the content, in a single write
+	frame := make([]byte, lenWidth+len(p))
+	enc.PutUint64(frame, uint64(len(p)))
+	copy(frame[lenWidth:], p)
+
+	if _, err := s.File.Write(frame); err != nil {
+		// Truncate a partially written record, so that the next one is written in its place
+		if terr := s.File.Truncate(int64(pos)); terr != nil {
+			return 0, 0, fmt.Errorf("%w, and failed to roll back the write: %v", err, terr)
+		}
 		return 0, 0, err
 	}
 
-	// Write content
-	w, err := s.buf.Write(p)
-	if err != nil {
-		return 0, 0, err // ? Clean written the length of record ?
-	}
+	w := uint64(len(frame)) // total written byte
+	s.size += w
+
+	return w, pos, nil
+}
 
-	w += lenWidth // total written byte
-	s.size += uint64(w)
+// Remove the records from the position on, like a record which isn't indexed
+func (s *store) rollback(pos uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.File.Truncate(int64(pos)); err != nil {
+		return err
+	}
+	s.size = pos
 
-	return uint64(w), pos, nil
+	return nil
 }
 
 // Read the record with a given position.
-// ? Handle invalid position ?
+// A length beyond the end of the store is corrupt, so it isn't allocated.
 func (s *store) Read(pos uint64) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Flush the writer buffer
-	if err := s.buf.Flush(); err != nil {
-		return nil, err
-	}
-
 	// Read the length of the record
 	size := make([]byte, lenWidth)
 	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
@@ -81,7 +92,11 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 	}
 
 	// Read the content
-	b := make([]byte, enc.Uint64(size)) // Convert bytes to uint64
+	n := enc.Uint64(size) // Convert bytes to uint64
+	if n > s.size-pos-lenWidth {
+		return nil, fmt.Errorf("corrupt record at position %d: length %d exceeds the store size %d", pos, n, s.size)
+	}
+	b := make([]byte, n)
 	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
 		return nil, err
 	}
@@ -94,24 +109,12 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Flush the wirter buffer
-	if err := s.buf.Flush(); err != nil {
-		return 0, err
-	}
-
 	return s.File.ReadAt(p, off)
 }
 
-// Close persists any bufferred data before closing the file
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Flush the writter buffer
-	err := s.buf.Flush()
-	if err != nil {
-		return err
-	}
-
 	return s.File.Close()
 }
@@ -30,6 +30,61 @@ func TestStoreAppendRead(t *testing.T) {
 	testRead(t, s)
 }
 
+func TestStoreReadCorruptLength(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_corrupt_length_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+
+	// A length beyond the store isn't allocated
+	length := make([]byte, lenWidth)
+	enc.PutUint64(length, 1<<62)
+	_, err = f.WriteAt(length, 0)
+	require.NoError(t, err)
+
+	_, err = s.Read(0)
+	require.Error(t, err)
+}
+
+func TestStoreDiskFull(t *testing.T) {
+	// Writes to /dev/full fail for lack of space
+	f, err := os.OpenFile("/dev/full", os.O_RDWR, 0)
+	if err != nil {
+		t.Skip("/dev/full is not available")
+	}
+	defer f.Close()
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+
+	// A failed write isn't acknowledged, and the store doesn't grow
+	_, _, err = s.Append(write)
+	require.True(t, isDiskFull(err))
+	require.Equal(t, uint64(0), s.size)
+}
+
+func TestStoreRecordsWrittenOnAppend(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_written_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+
+	// An acknowledged record is in the file, so a later failure can't lose it
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+
+	fi, err := os.Stat(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(width), fi.Size())
+}
+
 func testAppend(t *testing.T, s *store) {
 	t.Helper()
 	for i := uint64(1); i < 4; i++ {
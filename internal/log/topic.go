@@ -0,0 +1,378 @@
+package log
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	api "github.com/wuxl-lang/proglog/api/v1"
+)
+
+// Per-topic config is persisted in the topic's dir, so that it is reloaded on restart
+const topicConfigFile = "topic.json"
+
+// Topic names are used as dir names
+var topicNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]*$`)
+
+// A topic is split into partitions, each partition has its own log under the topic's dir.
+// Records with the same key go to the same partition, so they are ordered.
+type Topic struct {
+	Name       string
+	Dir        string
+	Config     Config
+	Partitions []*Log
+
+	// Partition for the next record without key
+	next uint64
+}
+
+// Construct topic and load existing partitions from a dir, its logs share the state of the disk
+func newTopic(name, dir string, c Config, disk *diskState) (*Topic, error) {
+	if c.Topic.Partitions == 0 {
+		c.Topic.Partitions = 1
+	}
+
+	t := &Topic{
+		Name:   name,
+		Dir:    dir,
+		Config: c,
+	}
+
+	for p := uint32(0); p < c.Topic.Partitions; p++ {
+		partitionDir := path.Join(dir, strconv.FormatUint(uint64(p), 10))
+		if err := os.MkdirAll(partitionDir, 0755); err != nil {
+			return nil, err
+		}
+
+		l, err := NewLog(partitionDir, c)
+		if err != nil {
+			return nil, err
+		}
+		l.disk = disk
+		t.Partitions = append(t.Partitions, l)
+	}
+
+	return t, nil
+}
+
+// Append record to the partition of its key, or round robin if it has no key.
+// Records of idempotent producers without key are spread by their sequences.
+// Return the partition and the absolute offset in the partition
+func (t *Topic) Append(record *api.Record) (uint32, uint64, error) {
+	return t.AppendContext(context.Background(), record)
+}
+
+// Append record as a span of the operation in the context
+func (t *Topic) AppendContext(ctx context.Context, record *api.Record) (uint32, uint64, error) {
+	p := t.partitionFor(record)
+	record.Partition = p
+
+	off, err := t.Partitions[p].AppendContext(ctx, record)
+
+	return p, off, err
+}
+
+// Read record by partition and absolute offset
+func (t *Topic) Read(partition uint32, off uint64) (*api.Record, error) {
+	l, err := t.Partition(partition)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.Read(off)
+}
+
+// Get the log of a partition
+func (t *Topic) Partition(partition uint32) (*Log, error) {
+	if partition >= uint32(len(t.Partitions)) {
+		return nil, api.ErrPartitionNotFound{Topic: t.Name, Partition: partition}
+	}
+
+	return t.Partitions[partition], nil
+}
+
+// Close logs of all partitions
+func (t *Topic) Close() error {
+	for _, l := range t.Partitions {
+		if err := l.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close logs of all partitions and remove the topic's dir
+func (t *Topic) Remove() error {
+	if err := t.Close(); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(t.Dir)
+}
+
+func (t *Topic) partitionFor(record *api.Record) uint32 {
+	n := uint32(len(t.Partitions))
+
+	key := record.Key
+	if len(key) == 0 && record.ProducerId != 0 {
+		// Records of an idempotent producer stay in one partition, so that they keep their order and retries
+		// are deduplicated. Producer IDs are sequential, so producers are spread in round robin.
+		return uint32(record.ProducerId % uint64(n))
+	}
+
+	if len(key) == 0 {
+		return uint32((atomic.AddUint64(&t.next, 1) - 1) % uint64(n))
+	}
+
+	h := fnv.New32a()
+	h.Write(key)
+
+	return h.Sum32() % n
+}
+
+// A topic manager holds the topics, each topic is under its own subdirectory
+type TopicManager struct {
+	mu sync.RWMutex
+
+	Dir string
+	// Default config of topics which are lazily created
+	Config Config
+
+	topics map[string]*Topic
+	closed bool
+	disk   *diskState
+}
+
+// Construct topic manager and load existing topics from a dir
+func NewTopicManager(dir string, c Config) (*TopicManager, error) {
+	m := &TopicManager{
+		Dir:    dir,
+		Config: c,
+		topics: make(map[string]*Topic),
+		disk:   newDiskState(dir),
+	}
+	m.registerMetrics()
+
+	return m, m.setup()
+}
+
+// Get an existing topic
+func (m *TopicManager) Topic(name string) (*Topic, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	t, ok := m.topics[name]
+	if !ok {
+		return nil, api.ErrTopicNotFound{Topic: name}
+	}
+
+	return t, nil
+}
+
+// Get a topic, which is created with default config if it doesn't exist
+func (m *TopicManager) OpenTopic(name string) (*Topic, error) {
+	return m.OpenTopicWithConfig(name, m.Config)
+}
+
+// Get a topic, which is created with the config if it doesn't exist, unset fields fall back to the default config
+func (m *TopicManager) OpenTopicWithConfig(name string, c Config) (*Topic, error) {
+	if t, err := m.Topic(name); err == nil {
+		return t, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Created by others while waiting for the lock
+	if t, ok := m.topics[name]; ok {
+		return t, nil
+	}
+
+	return m.createTopic(name, c)
+}
+
+// Create a topic with its own config, unset fields fall back to the default config
+func (m *TopicManager) CreateTopic(name string, c Config) (*Topic, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.topics[name]; ok {
+		return nil, api.ErrTopicExists{Topic: name}
+	}
+
+	return m.createTopic(name, c)
+}
+
+// Remove the topic's partitions and its dir
+func (m *TopicManager) DeleteTopic(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.topics[name]
+	if !ok {
+		return api.ErrTopicNotFound{Topic: name}
+	}
+
+	if err := t.Remove(); err != nil {
+		return err
+	}
+	delete(m.topics, name)
+
+	return nil
+}
+
+// Sorted names of all topics
+func (m *TopicManager) Topics() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	names := make([]string, 0, len(m.topics))
+	for name := range m.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Close all topics
+func (m *TopicManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.unregisterMetrics()
+	for _, t := range m.topics {
+		if err := t.Close(); err != nil {
+			return err
+		}
+	}
+	m.closed = true
+
+	return nil
+}
+
+// Whether appends fail for lack of space, until space is freed
+func (m *TopicManager) DiskFull() bool {
+	return m.disk.Full()
+}
+
+// Check that the topics are open and the disk has room for appends, with statfs so that nothing is written
+func (m *TopicManager) Check() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return fmt.Errorf("topics are closed")
+	}
+
+	free, err := freeBytes(m.Dir)
+	if err != nil {
+		return err
+	}
+	if free < diskFreeBytes {
+		return api.ErrDiskFull{}
+	}
+
+	return nil
+}
+
+// Close all topics and remove the entire dir
+func (m *TopicManager) Remove() error {
+	if err := m.Close(); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(m.Dir)
+}
+
+// Create the topic's dir, persist its config and construct its partitions.
+// Caller must hold the lock.
+func (m *TopicManager) createTopic(name string, c Config) (*Topic, error) {
+	if !topicNamePattern.MatchString(name) {
+		return nil, api.ErrInvalidTopic{Topic: name}
+	}
+
+	if c.Segment.MaxStoreBytes == 0 {
+		c.Segment.MaxStoreBytes = m.Config.Segment.MaxStoreBytes
+	}
+
+	if c.Segment.MaxIndexBytes == 0 {
+		c.Segment.MaxIndexBytes = m.Config.Segment.MaxIndexBytes
+	}
+
+	if c.Topic.Partitions == 0 {
+		c.Topic.Partitions = m.Config.Topic.Partitions
+	}
+
+	if c.Topic.Partitions == 0 {
+		c.Topic.Partitions = 1
+	}
+
+	dir := path.Join(m.Dir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = ioutil.WriteFile(path.Join(dir, topicConfigFile), b, 0644); err != nil {
+		return nil, err
+	}
+
+	t, err := newTopic(name, dir, c, m.disk)
+	if err != nil {
+		return nil, err
+	}
+	m.topics[name] = t
+
+	return t, nil
+}
+
+// Load existing topics, each subdirectory is a topic
+func (m *TopicManager) setup() error {
+	if err := os.MkdirAll(m.Dir, 0755); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(m.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+
+		dir := path.Join(m.Dir, file.Name())
+
+		// Fall back to default config if the topic's config is missing
+		c := m.Config
+		if b, err := ioutil.ReadFile(path.Join(dir, topicConfigFile)); err == nil {
+			if err = json.Unmarshal(b, &c); err != nil {
+				return err
+			}
+		}
+
+		t, err := newTopic(file.Name(), dir, c, m.disk)
+		if err != nil {
+			return err
+		}
+		m.topics[file.Name()] = t
+	}
+
+	return nil
+}
@@ -0,0 +1,213 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/internal/metrics"
+)
+
+func TestTopicManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topic-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	m, err := NewTopicManager(dir, c)
+	require.NoError(t, err)
+	require.Empty(t, m.Topics())
+
+	// Topic doesn't exist until it is opened
+	_, err = m.Topic("orders")
+	require.Equal(t, api.ErrTopicNotFound{Topic: "orders"}, err)
+
+	orders, err := m.OpenTopic("orders")
+	require.NoError(t, err)
+	require.Equal(t, uint64(32), orders.Config.Segment.MaxStoreBytes, "Lazily created topic uses default config")
+	require.Len(t, orders.Partitions, 1)
+
+	// Topic has its own config
+	topicConfig := Config{}
+	topicConfig.Segment.MaxStoreBytes = 1024
+	payments, err := m.CreateTopic("payments", topicConfig)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1024), payments.Config.Segment.MaxStoreBytes)
+
+	_, err = m.CreateTopic("payments", topicConfig)
+	require.Equal(t, api.ErrTopicExists{Topic: "payments"}, err)
+
+	_, err = m.CreateTopic("../payments", topicConfig)
+	require.Equal(t, api.ErrInvalidTopic{Topic: "../payments"}, err)
+
+	// Topics have independent logs
+	for _, topic := range []*Topic{orders, payments, orders} {
+		_, _, err = topic.Append(test_record)
+		require.NoError(t, err)
+	}
+
+	off, err := orders.Partitions[0].HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	off, err = payments.Partitions[0].HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	require.Equal(t, []string{"orders", "payments"}, m.Topics())
+
+	// Open topics pass the health check, and closed ones fail it
+	require.NoError(t, m.Check())
+
+	// Reload existing topics with their own config
+	require.NoError(t, m.Close())
+	require.Error(t, m.Check())
+
+	m, err = NewTopicManager(dir, Config{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders", "payments"}, m.Topics())
+
+	payments, err = m.Topic("payments")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1024), payments.Config.Segment.MaxStoreBytes)
+
+	read, err := payments.Read(0, 0)
+	require.NoError(t, err)
+	require.Equal(t, test_record.Value, read.Value)
+
+	// Delete topic, holders of the deleted topic can't append or read it anymore
+	orders, err = m.Topic("orders")
+	require.NoError(t, err)
+	require.NoError(t, m.DeleteTopic("orders"))
+	require.Equal(t, []string{"payments"}, m.Topics())
+
+	_, _, err = orders.Append(test_record)
+	require.Equal(t, api.ErrLogClosed{}, err)
+	_, err = orders.Read(0, 0)
+	require.Equal(t, api.ErrLogClosed{}, err)
+
+	err = m.DeleteTopic("orders")
+	require.Equal(t, api.ErrTopicNotFound{Topic: "orders"}, err)
+}
+
+func TestTopicPartitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topic-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := NewTopicManager(dir, Config{})
+	require.NoError(t, err)
+
+	c := Config{}
+	c.Topic.Partitions = 3
+	topic, err := m.CreateTopic("orders", c)
+	require.NoError(t, err)
+	require.Len(t, topic.Partitions, 3)
+
+	// Records with the same key go to the same partition in order
+	keyed := &api.Record{Key: []byte("customer-1"), Value: []byte("keyed")}
+	partition, off, err := topic.Append(keyed)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	for i := uint64(1); i < 3; i++ {
+		p, off, err := topic.Append(&api.Record{Key: []byte("customer-1"), Value: []byte("keyed")})
+		require.NoError(t, err)
+		require.Equal(t, partition, p)
+		require.Equal(t, i, off)
+	}
+
+	read, err := topic.Read(partition, 0)
+	require.NoError(t, err)
+	require.Equal(t, partition, read.Partition)
+	require.Equal(t, keyed.Value, read.Value)
+
+	// Records without key are spread across partitions
+	seen := map[uint32]bool{}
+	for i := 0; i < 3; i++ {
+		p, _, err := topic.Append(&api.Record{Value: []byte("unkeyed")})
+		require.NoError(t, err)
+		seen[p] = true
+	}
+	require.Len(t, seen, 3)
+
+	// Retries of idempotent producer go to the same partition
+	idempotent := &api.Record{Value: []byte("idempotent"), ProducerId: 1, Sequence: 1}
+	partition, off, err = topic.Append(idempotent)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		p, retried, err := topic.Append(&api.Record{Value: []byte("idempotent"), ProducerId: 1, Sequence: 1})
+		require.NoError(t, err)
+		require.Equal(t, partition, p)
+		require.Equal(t, off, retried)
+	}
+
+	// Records of a producer stay in its partition in order, producers are spread across partitions
+	for seq := uint64(2); seq <= 4; seq++ {
+		p, _, err := topic.Append(&api.Record{Value: []byte("idempotent"), ProducerId: 1, Sequence: seq})
+		require.NoError(t, err)
+		require.Equal(t, partition, p)
+	}
+	other, _, err := topic.Append(&api.Record{Value: []byte("idempotent"), ProducerId: 2, Sequence: 1})
+	require.NoError(t, err)
+	require.NotEqual(t, partition, other)
+
+	_, err = topic.Read(3, 0)
+	require.Equal(t, api.ErrPartitionNotFound{Topic: "orders", Partition: 3}, err)
+
+	// Reload partitions
+	require.NoError(t, m.Close())
+
+	m, err = NewTopicManager(dir, Config{})
+	require.NoError(t, err)
+
+	topic, err = m.Topic("orders")
+	require.NoError(t, err)
+	require.Len(t, topic.Partitions, 3)
+
+	off, err = topic.Partitions[partition].HighestOffset()
+	require.NoError(t, err)
+	require.True(t, off >= 1)
+
+	// Producer IDs are unique across restarts
+	id, err := m.RegisterProducer()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), id)
+
+	require.NoError(t, m.Close())
+
+	m, err = NewTopicManager(dir, Config{})
+	require.NoError(t, err)
+
+	id, err = m.RegisterProducer()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), id)
+}
+
+func TestTopicManagerDiskFullMetric(t *testing.T) {
+	// Every manager reports whether its own disk is full
+	var dirs []string
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "topic-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		m, err := NewTopicManager(dir, Config{})
+		require.NoError(t, err)
+		defer m.Close()
+
+		dirs = append(dirs, dir)
+	}
+
+	var b strings.Builder
+	require.NoError(t, metrics.Default.WriteText(&b))
+	for _, dir := range dirs {
+		require.Contains(t, b.String(), fmt.Sprintf("proglog_disk_full{dir=%q} 0", dir))
+	}
+}
@@ -0,0 +1,96 @@
+package log
+
+import (
+	"sort"
+
+	api "github.com/wuxl-lang/proglog/api/v1"
+)
+
+// State of transactions which wrote to a log
+type transactions struct {
+	// First offset of each open transaction
+	open map[uint64]uint64
+	// Aborted transactions, whose records are hidden from read committed consumers
+	aborted map[uint64]bool
+}
+
+func newTransactions() *transactions {
+	return &transactions{
+		open:    make(map[uint64]uint64),
+		aborted: make(map[uint64]bool),
+	}
+}
+
+// Track transaction of the record, which is appended at the offset
+func (t *transactions) update(record *api.Record, off uint64) {
+	if record.TransactionId == 0 {
+		return
+	}
+
+	switch record.Control {
+	case api.ControlType_NONE:
+		if _, ok := t.open[record.TransactionId]; !ok {
+			t.open[record.TransactionId] = off
+		}
+	case api.ControlType_COMMIT:
+		delete(t.open, record.TransactionId)
+	case api.ControlType_ABORT:
+		delete(t.open, record.TransactionId)
+		t.aborted[record.TransactionId] = true
+	}
+}
+
+// Offset of the first record which may still belong to an open transaction.
+// Read committed consumers only read below it, so that they read in order.
+func (l *Log) LastStableOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	lso := l.segments[len(l.segments)-1].nextOffset
+	for _, off := range l.transactions.open {
+		if off < lso {
+			lso = off
+		}
+	}
+
+	return lso
+}
+
+// Read record for read committed consumer.
+// Records from the last stable offset are out of range until their transactions end,
+// records of aborted transactions aren't visible.
+func (l *Log) ReadCommitted(off uint64) (*api.Record, error) {
+	if off >= l.LastStableOffset() {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+
+	record, err := l.Read(off)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.transactions.aborted[record.TransactionId] {
+		return nil, api.ErrRecordNotVisible{Offset: off}
+	}
+
+	return record, nil
+}
+
+// Sorted IDs of transactions which wrote to the log and aren't ended
+func (l *Log) OpenTransactions() []uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	ids := make([]uint64, 0, len(l.transactions.open))
+	for id := range l.transactions.open {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	return ids
+}
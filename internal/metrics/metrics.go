@@ -0,0 +1,375 @@
+// Package metrics collects counters, gauges and histograms,
+// and exposes them in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry of the process, which is served on /metrics
+var Default = NewRegistry()
+
+// Buckets of latencies in seconds, from 100µs to 10s
+var DefaultBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5, 10}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// Return the metric registered with the name, or register the new one
+func (r *Registry) register(name string, m metric) metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing, ok := r.metrics[name]; ok {
+		return existing
+	}
+	r.metrics[name] = m
+
+	return m
+}
+
+// Write every metric in the Prometheus text format, sorted by name
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]metric, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+
+	return bw.Flush()
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WriteText(w)
+	})
+}
+
+// Series of a metric by label values
+type vec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	typ    string
+	labels []string
+	series map[string][]string
+}
+
+func newVec(name, help, typ string, labels []string) vec {
+	return vec{name: name, help: help, typ: typ, labels: labels, series: make(map[string][]string)}
+}
+
+// Key of the series, the caller must hold the lock
+func (v *vec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", v.name, len(v.labels), len(values)))
+	}
+
+	k := strings.Join(values, "\xff")
+	if _, ok := v.series[k]; !ok {
+		v.series[k] = append([]string(nil), values...)
+	}
+
+	return k
+}
+
+// Keys of every series in a stable order, the caller must hold the lock
+func (v *vec) keys() []string {
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (v *vec) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.typ)
+}
+
+// Counter only goes up, like the number of requests
+type Counter struct {
+	vec
+	values map[string]float64
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{vec: newVec(name, help, "counter", labels), values: make(map[string]float64)}
+
+	return r.register(name, c).(*Counter)
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[c.key(labelValues)] += v
+}
+
+// Value of the series, for tests
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.values[c.key(labelValues)]
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.header(w)
+	for _, k := range c.keys() {
+		writeSample(w, c.name, c.labels, c.series[k], "", "", c.values[k])
+	}
+}
+
+// Gauge goes up and down, like the bytes on disk
+type Gauge struct {
+	vec
+	values map[string]float64
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{vec: newVec(name, help, "gauge", labels), values: make(map[string]float64)}
+
+	return r.register(name, g).(*Gauge)
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.values[g.key(labelValues)] = v
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.header(w)
+	for _, k := range g.keys() {
+		writeSample(w, g.name, g.labels, g.series[k], "", "", g.values[k])
+	}
+}
+
+// GaugeFunc reports the samples emitted by a func on every scrape,
+// for values which are already tracked elsewhere. Values tracked by every instance of a type
+// are reported by a GaugeFuncSet instead.
+type GaugeFunc struct {
+	vec
+	fn func(emit func(v float64, labelValues ...string))
+}
+
+// Panics if the name is registered, the func of a metric isn't replaced
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, fn func(emit func(v float64, labelValues ...string))) {
+	g := &GaugeFunc{vec: newVec(name, help, "gauge", labels), fn: fn}
+	if r.register(name, g) != metric(g) {
+		panic(fmt.Sprintf("metrics: %s is already registered", name))
+	}
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.header(w)
+	g.fn(func(v float64, labelValues ...string) {
+		if len(labelValues) != len(g.labels) {
+			panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", g.name, len(g.labels), len(labelValues)))
+		}
+		writeSample(w, g.name, g.labels, labelValues, "", "", v)
+	})
+}
+
+// GaugeFuncSet reports the samples emitted by the funcs of every instance which tracks the values,
+// like every server of the process. A func replaces the previous one of the same key,
+// and a series emitted by several funcs is reported once.
+type GaugeFuncSet struct {
+	vec
+	fns map[string]func(emit func(v float64, labelValues ...string))
+}
+
+func (r *Registry) NewGaugeFuncSet(name, help string, labels ...string) *GaugeFuncSet {
+	g := &GaugeFuncSet{
+		vec: newVec(name, help, "gauge", labels),
+		fns: make(map[string]func(emit func(v float64, labelValues ...string))),
+	}
+
+	return r.register(name, g).(*GaugeFuncSet)
+}
+
+func (g *GaugeFuncSet) Set(key string, fn func(emit func(v float64, labelValues ...string))) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.fns[key] = fn
+}
+
+func (g *GaugeFuncSet) Delete(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.fns, key)
+}
+
+func (g *GaugeFuncSet) write(w io.Writer) {
+	// Funcs are called without the lock, so that they can't block Set
+	g.mu.Lock()
+	keys := make([]string, 0, len(g.fns))
+	for k := range g.fns {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fns := make([]func(emit func(v float64, labelValues ...string)), 0, len(keys))
+	for _, k := range keys {
+		fns = append(fns, g.fns[k])
+	}
+	g.mu.Unlock()
+
+	g.header(w)
+	seen := make(map[string]bool)
+	for _, fn := range fns {
+		fn(func(v float64, labelValues ...string) {
+			if len(labelValues) != len(g.labels) {
+				panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", g.name, len(g.labels), len(labelValues)))
+			}
+
+			k := strings.Join(labelValues, "\xff")
+			if seen[k] {
+				return
+			}
+			seen[k] = true
+			writeSample(w, g.name, g.labels, labelValues, "", "", v)
+		})
+	}
+}
+
+// Histogram counts observations in cumulative buckets, like latencies
+type Histogram struct {
+	vec
+	buckets []float64
+	counts  map[string][]uint64
+	sums    map[string]float64
+}
+
+// Buckets are DefaultBuckets if they aren't set
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+
+	h := &Histogram{
+		vec:     newVec(name, help, "histogram", labels),
+		buckets: buckets,
+		counts:  make(map[string][]uint64),
+		sums:    make(map[string]float64),
+	}
+
+	return r.register(name, h).(*Histogram)
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	k := h.key(labelValues)
+	counts, ok := h.counts[k]
+	if !ok {
+		// The last one counts every observation, i.e. +Inf
+		counts = make([]uint64, len(h.buckets)+1)
+		h.counts[k] = counts
+	}
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			counts[i]++
+		}
+	}
+	counts[len(h.buckets)]++
+	h.sums[k] += v
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.header(w)
+	for _, k := range h.keys() {
+		values, counts := h.series[k], h.counts[k]
+		for i, bound := range h.buckets {
+			writeSample(w, h.name+"_bucket", h.labels, values, "le", formatFloat(bound), float64(counts[i]))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, values, "le", "+Inf", float64(counts[len(h.buckets)]))
+		writeSample(w, h.name+"_sum", h.labels, values, "", "", h.sums[k])
+		writeSample(w, h.name+"_count", h.labels, values, "", "", float64(counts[len(h.buckets)]))
+	}
+}
+
+// Write a sample line with the labels, and the extra label of histogram buckets if it is set
+func writeSample(w io.Writer, name string, labels, values []string, extraLabel, extraValue string, v float64) {
+	io.WriteString(w, name)
+
+	if len(labels) > 0 || extraLabel != "" {
+		pairs := make([]string, 0, len(labels)+1)
+		for i, label := range labels {
+			pairs = append(pairs, label+"="+quoteLabel(values[i]))
+		}
+		if extraLabel != "" {
+			pairs = append(pairs, extraLabel+"="+quoteLabel(extraValue))
+		}
+		io.WriteString(w, "{"+strings.Join(pairs, ",")+"}")
+	}
+
+	io.WriteString(w, " "+formatFloat(v)+"\n")
+}
+
+// Escapes of label values in the text format, other characters are written as they are
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+
+	requests := r.NewCounter("requests_total", "Requests by method.", "method")
+	requests.Inc("produce")
+	requests.Inc("produce")
+	requests.Add(3, "consume")
+
+	// Registering the same name again returns the existing metric
+	require.Equal(t, requests, r.NewCounter("requests_total", "Requests by method.", "method"))
+	require.Equal(t, float64(2), requests.Value("produce"))
+
+	r.NewGauge("bytes", "Bytes on disk.").Set(1024)
+
+	latency := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(2)
+
+	r.NewGaugeFunc("segments", "Segments by topic.", []string{"topic"}, func(emit func(float64, ...string)) {
+		emit(2, "orders")
+	})
+
+	// A gauge func isn't replaced by another one of the same name
+	require.Panics(t, func() {
+		r.NewGaugeFunc("segments", "Segments by topic.", []string{"topic"}, func(emit func(float64, ...string)) {
+			emit(3, "orders")
+		})
+	})
+
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteText(&buf))
+	require.Equal(t, `# HELP bytes Bytes on disk.
+# TYPE bytes gauge
+bytes 1024
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 2.55
+latency_seconds_count 3
+# HELP requests_total Requests by method.
+# TYPE requests_total counter
+requests_total{method="consume"} 3
+requests_total{method="produce"} 2
+# HELP segments Segments by topic.
+# TYPE segments gauge
+segments{topic="orders"} 2
+`, buf.String())
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, buf.String(), rec.Body.String())
+}
+
+func TestGaugeFuncSet(t *testing.T) {
+	r := NewRegistry()
+
+	lag := r.NewGaugeFuncSet("lag", "Lag by group.", "group")
+	require.Equal(t, lag, r.NewGaugeFuncSet("lag", "Lag by group.", "group"))
+
+	lag.Set("a", func(emit func(float64, ...string)) {
+		emit(1, "orders")
+	})
+	lag.Set("b", func(emit func(float64, ...string)) {
+		emit(2, "orders")
+		emit(3, "payments")
+	})
+
+	// The func of a key replaces the previous one
+	lag.Set("a", func(emit func(float64, ...string)) {
+		emit(4, "orders")
+	})
+
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteText(&buf))
+	require.Equal(t, `# HELP lag Lag by group.
+# TYPE lag gauge
+lag{group="orders"} 4
+lag{group="payments"} 3
+`, buf.String())
+
+	lag.Delete("a")
+
+	buf.Reset()
+	require.NoError(t, r.WriteText(&buf))
+	require.Equal(t, `# HELP lag Lag by group.
+# TYPE lag gauge
+lag{group="orders"} 2
+lag{group="payments"} 3
+`, buf.String())
+}
+
+func TestLabelEscaping(t *testing.T) {
+	for value, want := range map[string]string{
+		`plain`:         `"plain"`,
+		`back\slash`:    `"back\\slash"`,
+		`"quoted"`:      `"\"quoted\""`,
+		"new\nline":     `"new\nline"`,
+		"café\ttab\x01": "\"café\ttab\x01\"",
+	} {
+		require.Equal(t, want, quoteLabel(value))
+	}
+}
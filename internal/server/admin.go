@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/internal/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var _ api.AdminServer = (*adminServer)(nil)
+
+// Admin operations on the log of this server, authorized like the RPCs of the log service
+type adminServer struct {
+	api.UnimplementedAdminServer
+	*grpcServer
+}
+
+// Describe offsets, segments and sizes of every partition of a topic
+func (s *adminServer) DescribeLog(ctx context.Context, req *api.DescribeLogRequest) (*api.DescribeLogResponse, error) {
+	if err := s.authorize(
+		ctx,
+		topicObject(req.Topic),
+		describeLogAction,
+	); err != nil {
+		return nil, err
+	}
+
+	topic, err := s.Topics.Topic(topicName(req.Topic))
+	if err != nil {
+		return nil, err
+	}
+
+	// Partitions have the config of the topic with the defaults of logs
+	c := topic.Partitions[0].Config
+	res := &api.DescribeLogResponse{
+		Topic: topic.Name,
+		Config: &api.TopicConfig{
+			MaxStoreBytes:  c.Segment.MaxStoreBytes,
+			MaxIndexBytes:  c.Segment.MaxIndexBytes,
+			Partitions:     uint32(len(topic.Partitions)),
+			MaxRecordBytes: c.Segment.MaxRecordBytes,
+		},
+	}
+	for p, l := range topic.Partitions {
+		stats := l.Stats()
+		partition := &api.PartitionDescription{
+			Partition:    uint32(p),
+			LowestOffset: stats.LowestOffset,
+			EndOffset:    stats.EndOffset,
+			Bytes:        stats.Bytes,
+		}
+		if partition.HighestOffset, err = l.HighestOffset(); err != nil {
+			return nil, err
+		}
+		for _, segment := range l.Segments() {
+			partition.Segments = append(partition.Segments, &api.SegmentInfo{
+				BaseOffset: segment.BaseOffset,
+				NextOffset: segment.NextOffset,
+				StoreBytes: segment.StoreBytes,
+				IndexBytes: segment.IndexBytes,
+			})
+		}
+		res.Partitions = append(res.Partitions, partition)
+	}
+
+	return res, nil
+}
+
+// Remove the segments of a partition whose records are all at or below the offset
+func (s *adminServer) Truncate(ctx context.Context, req *api.TruncateRequest) (*api.TruncateResponse, error) {
+	if err := s.authorize(
+		ctx,
+		topicObject(req.Topic),
+		truncateAction,
+	); err != nil {
+		return nil, err
+	}
+
+	l, err := s.writablePartition(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = l.Truncate(req.Offset); err != nil {
+		return nil, err
+	}
+
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.TruncateResponse{LowestOffset: lowest}, nil
+}
+
+// Remove every record of a partition
+func (s *adminServer) Reset(ctx context.Context, req *api.ResetRequest) (*api.ResetResponse, error) {
+	if err := s.authorize(
+		ctx,
+		topicObject(req.Topic),
+		resetAction,
+	); err != nil {
+		return nil, err
+	}
+
+	l, err := s.writablePartition(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = l.Reset(); err != nil {
+		return nil, err
+	}
+
+	return &api.ResetResponse{}, nil
+}
+
+// Start a new active segment of a partition
+func (s *adminServer) RollSegment(ctx context.Context, req *api.RollSegmentRequest) (*api.RollSegmentResponse, error) {
+	if err := s.authorize(
+		ctx,
+		topicObject(req.Topic),
+		rollSegmentAction,
+	); err != nil {
+		return nil, err
+	}
+
+	l, err := s.writablePartition(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := l.Roll()
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.RollSegmentResponse{BaseOffset: base}, nil
+}
+
+// Partition of a topic which admins may remove records of.
+// Records of internal topics are state of the server, which would be out of sync with them.
+func (s *adminServer) writablePartition(name string, partition uint32) (*log.Log, error) {
+	if isInternalTopic(name) {
+		return nil, status.Errorf(codes.InvalidArgument, "internal topic %s is read-only", name)
+	}
+
+	topic, err := s.Topics.Topic(topicName(name))
+	if err != nil {
+		return nil, err
+	}
+
+	return topic.Partition(partition)
+}
+
+// Switch the mode of this server, like to read-only before disk maintenance
+func (s *adminServer) SetMode(ctx context.Context, req *api.SetModeRequest) (*api.SetModeResponse, error) {
+	if err := s.authorize(
+		ctx,
+		clusterObject,
+		adminAction,
+	); err != nil {
+		return nil, err
+	}
+
+	if _, ok := api.NodeMode_name[int32(req.Mode)]; !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown mode %d", req.Mode)
+	}
+
+	return &api.SetModeResponse{Previous: s.Mode.set(req.Mode)}, nil
+}
+
+// Return the mode of this server and its open streams, so that admins know when it is drained
+func (s *adminServer) GetMode(ctx context.Context, req *api.GetModeRequest) (*api.GetModeResponse, error) {
+	if err := s.authorize(
+		ctx,
+		clusterObject,
+		adminAction,
+	); err != nil {
+		return nil, err
+	}
+
+	return &api.GetModeResponse{
+		Mode:          s.Mode.get(),
+		ActiveStreams: uint32(s.Mode.activeStreams()),
+	}, nil
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/config"
+	"github.com/wuxl-lang/proglog/internal/group"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAdmin(t *testing.T) {
+	ctx := context.Background()
+	cluster := setupCluster(t)
+
+	dial := func(crtPath, keyPath string) *grpc.ClientConn {
+		_, opts := newClientOpts(t, crtPath, keyPath)
+		conn, err := grpc.Dial(cluster.addr("leader"), opts...)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		return conn
+	}
+	rootConn := dial(config.RootClientCertFile, config.RootClientKeyFile)
+	client, admin := api.NewLogClient(rootConn), api.NewAdminClient(rootConn)
+	nobody := api.NewAdminClient(dial(config.NobodyClientCertFile, config.NobodyClientKeyFile))
+
+	produce := func() {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: test_record})
+		require.NoError(t, err)
+	}
+
+	// Every record is in its own segment
+	produce()
+	for i := 0; i < 2; i++ {
+		roll, err := admin.RollSegment(ctx, &api.RollSegmentRequest{})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i+1), roll.BaseOffset)
+		produce()
+	}
+
+	describe, err := admin.DescribeLog(ctx, &api.DescribeLogRequest{})
+	require.NoError(t, err)
+	require.Equal(t, defaultTopic, describe.Topic)
+	require.Equal(t, uint32(1), describe.Config.Partitions)
+	require.Len(t, describe.Partitions, 1)
+
+	partition := describe.Partitions[0]
+	require.Equal(t, uint64(0), partition.LowestOffset)
+	require.Equal(t, uint64(2), partition.HighestOffset)
+	require.Equal(t, uint64(3), partition.EndOffset)
+	require.Len(t, partition.Segments, 3)
+	var bytes uint64
+	for _, segment := range partition.Segments {
+		bytes += segment.StoreBytes
+	}
+	require.Equal(t, bytes, partition.Bytes)
+
+	truncate, err := admin.Truncate(ctx, &api.TruncateRequest{Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), truncate.LowestOffset)
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+
+	_, err = admin.Reset(ctx, &api.ResetRequest{})
+	require.NoError(t, err)
+
+	describe, err = admin.DescribeLog(ctx, &api.DescribeLogRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), describe.Partitions[0].EndOffset)
+	require.Len(t, describe.Partitions[0].Segments, 1)
+
+	// The partition is appended again from its initial offset
+	res, err := client.Produce(ctx, &api.ProduceRequest{Record: test_record})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+
+	_, err = admin.Reset(ctx, &api.ResetRequest{Topic: group.OffsetsTopic})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = admin.Truncate(ctx, &api.TruncateRequest{Partition: 1})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = nobody.DescribeLog(ctx, &api.DescribeLogRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobody.Reset(ctx, &api.ResetRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Authorize the subject of the request, and record the decision if it is audited
+func (s *grpcServer) authorize(ctx context.Context, object, action string) error {
+	err := s.Authorizer.Authorize(subject(ctx), object, action)
+
+	var peerAddr string
+	if p, ok := peer.FromContext(ctx); ok {
+		peerAddr = p.Addr.String()
+	}
+	recordDecision(s.Auditor, subject(ctx), object, action, peerAddr, err)
+
+	return err
+}
+
+// Count denials and record the decision, failing to record doesn't fail the request
+func recordDecision(auditor Auditor, subject, object, action, peerAddr string, err error) {
+	if err != nil {
+		deniedTotal.Inc(action)
+	}
+
+	if auditor == nil {
+		return
+	}
+
+	event := &api.AuditEvent{
+		Subject:  subject,
+		Object:   object,
+		Action:   action,
+		Allowed:  err == nil,
+		PeerAddr: peerAddr,
+		Time:     time.Now().UnixNano(),
+	}
+	if rerr := auditor.Record(event); rerr != nil {
+		log.Printf("[ERROR] proglog: failed to record audit event: %v", rerr)
+	}
+}
+
+// Return the authorization decisions recorded by this server.
+// Callers are authorized first, so that only admins learn whether audit is enabled.
+func (s *grpcServer) ListAuditEvents(ctx context.Context, req *api.ListAuditEventsRequest) (*api.ListAuditEventsResponse, error) {
+	if err := s.authorize(
+		ctx,
+		clusterObject,
+		adminAction,
+	); err != nil {
+		return nil, err
+	}
+
+	if s.Auditor == nil {
+		return nil, status.Error(codes.Unimplemented, "audit is not enabled")
+	}
+
+	return s.Auditor.Events(req)
+}
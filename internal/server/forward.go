@@ -0,0 +1,286 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/internal/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Metadata key which marks a request forwarded by a follower, so that it isn't forwarded again
+const forwardedKey = "proglog-forwarded"
+
+// Metadata key of the subject which sent a forwarded request to the follower
+const originSubjectKey = "proglog-origin-subject"
+
+// Forwarder sends produce requests to the leader over an internal authenticated connection.
+// The leader authorizes the forwarding server's identity, so it must be permitted to produce,
+// and to forward on the cluster so that the leader doesn't forward the requests again.
+type Forwarder struct {
+	mu    sync.Mutex
+	opts  []grpc.DialOption
+	conns map[string]*grpc.ClientConn
+}
+
+// The dial options should carry the server's own credentials
+func NewForwarder(opts ...grpc.DialOption) *Forwarder {
+	return &Forwarder{
+		opts:  opts,
+		conns: make(map[string]*grpc.ClientConn),
+	}
+}
+
+// Forward produce request to the leader and return the leader's response
+func (f *Forwarder) Produce(ctx context.Context, addr string, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	ctx, client, err := f.client(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Produce(ctx, req)
+}
+
+// Forward producer registration to the leader
+func (f *Forwarder) RegisterProducer(ctx context.Context, addr string, req *api.RegisterProducerRequest) (*api.RegisterProducerResponse, error) {
+	ctx, client, err := f.client(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.RegisterProducer(ctx, req)
+}
+
+func (f *Forwarder) BeginTransaction(ctx context.Context, addr string, req *api.BeginTransactionRequest) (*api.BeginTransactionResponse, error) {
+	ctx, client, err := f.client(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.BeginTransaction(ctx, req)
+}
+
+func (f *Forwarder) CommitTransaction(ctx context.Context, addr string, req *api.CommitTransactionRequest) (*api.CommitTransactionResponse, error) {
+	ctx, client, err := f.client(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.CommitTransaction(ctx, req)
+}
+
+func (f *Forwarder) AbortTransaction(ctx context.Context, addr string, req *api.AbortTransactionRequest) (*api.AbortTransactionResponse, error) {
+	ctx, client, err := f.client(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.AbortTransaction(ctx, req)
+}
+
+func (f *Forwarder) CommitOffset(ctx context.Context, addr string, req *api.CommitOffsetRequest) (*api.CommitOffsetResponse, error) {
+	ctx, client, err := f.client(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.CommitOffset(ctx, req)
+}
+
+func (f *Forwarder) FetchOffset(ctx context.Context, addr string, req *api.FetchOffsetRequest) (*api.FetchOffsetResponse, error) {
+	ctx, client, err := f.client(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.FetchOffset(ctx, req)
+}
+
+func (f *Forwarder) JoinGroup(ctx context.Context, addr string, req *api.JoinGroupRequest) (*api.JoinGroupResponse, error) {
+	ctx, client, err := f.client(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.JoinGroup(ctx, req)
+}
+
+func (f *Forwarder) Heartbeat(ctx context.Context, addr string, req *api.HeartbeatRequest) (*api.HeartbeatResponse, error) {
+	ctx, client, err := f.client(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Heartbeat(ctx, req)
+}
+
+func (f *Forwarder) LeaveGroup(ctx context.Context, addr string, req *api.LeaveGroupRequest) (*api.LeaveGroupResponse, error) {
+	ctx, client, err := f.client(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.LeaveGroup(ctx, req)
+}
+
+func (f *Forwarder) CreateTopic(ctx context.Context, addr string, req *api.CreateTopicRequest) (*api.CreateTopicResponse, error) {
+	ctx, client, err := f.client(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.CreateTopic(ctx, req)
+}
+
+func (f *Forwarder) DeleteTopic(ctx context.Context, addr string, req *api.DeleteTopicRequest) (*api.DeleteTopicResponse, error) {
+	ctx, client, err := f.client(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.DeleteTopic(ctx, req)
+}
+
+func (f *Forwarder) AddPolicy(ctx context.Context, addr string, req *api.AddPolicyRequest) (*api.AddPolicyResponse, error) {
+	ctx, client, err := f.client(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.AddPolicy(ctx, req)
+}
+
+func (f *Forwarder) RemovePolicy(ctx context.Context, addr string, req *api.RemovePolicyRequest) (*api.RemovePolicyResponse, error) {
+	ctx, client, err := f.client(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.RemovePolicy(ctx, req)
+}
+
+// Client to the leader, with context which marks the request as forwarded
+func (f *Forwarder) client(ctx context.Context, addr string) (context.Context, api.LogClient, error) {
+	conn, err := f.conn(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx = metadata.AppendToOutgoingContext(ctx, forwardedKey, "true")
+	if sub, ok := ctx.Value(subjectContextKey{}).(string); ok {
+		ctx = metadata.AppendToOutgoingContext(ctx, originSubjectKey, sub)
+	}
+	// The leader's span of the request is a child of this server's span
+	ctx = trace.Inject(ctx)
+
+	return ctx, api.NewLogClient(conn), nil
+}
+
+// Reuse the connection to the same leader
+func (f *Forwarder) conn(addr string) (*grpc.ClientConn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if conn, ok := f.conns[addr]; ok {
+		return conn, nil
+	}
+
+	conn, err := grpc.Dial(addr, f.opts...)
+	if err != nil {
+		return nil, err
+	}
+	f.conns[addr] = conn
+
+	return conn, nil
+}
+
+// Close all connections to leaders
+func (f *Forwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var err error
+	for addr, conn := range f.conns {
+		if cerr := conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(f.conns, addr)
+	}
+
+	return err
+}
+
+// Find the leader in the server list and whether this server is the leader.
+// A server without server list is standalone and always the leader.
+func findLeader(getServerer GetServerer, id string) (leader *api.Server, isLocal bool, err error) {
+	if getServerer == nil {
+		return nil, true, nil
+	}
+
+	servers, err := getServerer.GetServers()
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, server := range servers {
+		if server.IsLeader {
+			return server, server.Id == id, nil
+		}
+	}
+
+	return nil, false, nil
+}
+
+// Return the leader to forward a write to, or nil if this server is the leader.
+// Return not leader error if the write can't be forwarded.
+func (s *grpcServer) remoteLeader(ctx context.Context) (*api.Server, error) {
+	leader, isLocal, err := findLeader(s.GetServerer, s.ServerID)
+	if err != nil {
+		return nil, err
+	}
+	if isLocal {
+		return nil, nil
+	}
+
+	if leader == nil {
+		return nil, api.ErrNotLeader{}
+	}
+
+	if s.Forwarder == nil || s.isForwarded(ctx) {
+		return nil, api.ErrNotLeader{LeaderAddr: leader.RpcAddr}
+	}
+
+	return leader, nil
+}
+
+// Whether the request has been forwarded by a follower. Clients can set the metadata too,
+// so it is only trusted from subjects permitted to forward, which are the cluster's servers.
+func (s *grpcServer) isForwarded(ctx context.Context) bool {
+	if !hasForwardedMetadata(ctx) {
+		return false
+	}
+
+	return s.Authorizer.Authorize(subject(ctx), clusterObject, forwardAction) == nil
+}
+
+// Subject which sent the request. A forwarded request is sent by a follower, on behalf of the subject
+// which the follower authenticated, like the owner of a transaction.
+func (s *grpcServer) originSubject(ctx context.Context) string {
+	if s.isForwarded(ctx) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if values := md.Get(originSubjectKey); len(values) > 0 {
+			return values[0]
+		}
+	}
+
+	return subject(ctx)
+}
+
+// Whether the request is marked as forwarded, which isn't authenticated
+func hasForwardedMetadata(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+
+	return ok && len(md.Get(forwardedKey)) > 0
+}
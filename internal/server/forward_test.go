@@ -0,0 +1,350 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/config"
+	auth "github.com/wuxl-lang/proglog/internal/auth"
+	"github.com/wuxl-lang/proglog/internal/group"
+	"github.com/wuxl-lang/proglog/internal/log"
+	"github.com/wuxl-lang/proglog/internal/trace"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestForwardToLeader(t *testing.T) {
+	cluster := setupCluster(t)
+
+	_, forwarderOpts := newClientOpts(t, config.RootClientCertFile, config.RootClientKeyFile)
+	forwarder := NewForwarder(forwarderOpts...)
+	defer forwarder.Close()
+
+	follower, followerTopics := newClusterServer(t, cluster, "follower", forwarder)
+	leaderConn, leaderClient, _ := newClient(t, cluster.addr("leader"), config.RootClientCertFile, config.RootClientKeyFile)
+	defer leaderConn.Close()
+	followerConn, followerClient, _ := newClient(t, follower, config.RootClientCertFile, config.RootClientKeyFile)
+	defer followerConn.Close()
+
+	recorder := &spanRecorder{}
+	trace.SetExporter(recorder)
+	defer trace.SetExporter(nil)
+
+	ctx := context.Background()
+
+	// Follower forwards the record to the leader
+	produce, err := followerClient.Produce(ctx, &api.ProduceRequest{Record: test_record})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
+
+	// The leader's span of the forwarded request is a child of the follower's span
+	var followerSpan, leaderSpan *trace.SpanData
+	for _, span := range recorder.spans {
+		if span.Name != "/log.v1.Log/Produce" {
+			continue
+		}
+		if span.Attributes["forwarded"] == "true" {
+			leaderSpan = span
+		} else {
+			followerSpan = span
+		}
+	}
+	require.NotNil(t, followerSpan)
+	require.NotNil(t, leaderSpan)
+	require.Equal(t, followerSpan.TraceID, leaderSpan.TraceID)
+	require.Equal(t, followerSpan.SpanID, leaderSpan.ParentID)
+
+	consume, err := leaderClient.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, test_record.Value, consume.Record.Value)
+
+	// Groups are coordinated by the leader, so their offsets are committed to it
+	join, err := followerClient.JoinGroup(ctx, &api.JoinGroupRequest{Group: "billing", Topics: []string{"default"}})
+	require.NoError(t, err)
+	_, err = followerClient.Heartbeat(ctx, &api.HeartbeatRequest{
+		Group:      "billing",
+		MemberId:   join.MemberId,
+		Generation: join.Generation,
+	})
+	require.NoError(t, err)
+	_, err = followerClient.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "billing", Topic: "default", Offset: 1})
+	require.NoError(t, err)
+
+	fetch, err := leaderClient.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "billing", Topic: "default"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), fetch.Offset)
+
+	// Topics are created and deleted on the leader
+	_, err = followerClient.CreateTopic(ctx, &api.CreateTopicRequest{Topic: "payments"})
+	require.NoError(t, err)
+	list, err := leaderClient.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Contains(t, list.Topics, "payments")
+
+	_, err = followerClient.DeleteTopic(ctx, &api.DeleteTopicRequest{Topic: "payments"})
+	require.NoError(t, err)
+	list, err = leaderClient.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.NotContains(t, list.Topics, "payments")
+
+	_, err = followerTopics.Topic("default")
+	require.Error(t, err, "Follower doesn't write the record locally")
+	_, err = followerTopics.Topic("payments")
+	require.Error(t, err, "Follower doesn't create the topic locally")
+}
+
+func TestNotLeader(t *testing.T) {
+	cluster := setupCluster(t)
+
+	follower, _ := newClusterServer(t, cluster, "follower", nil)
+	conn, client, _ := newClient(t, follower, config.RootClientCertFile, config.RootClientKeyFile)
+	defer conn.Close()
+
+	produce, err := client.Produce(context.Background(), &api.ProduceRequest{Record: test_record})
+	require.Nil(t, produce)
+
+	st := status.Convert(err)
+	require.Equal(t, codes.FailedPrecondition, st.Code())
+	require.Len(t, st.Details(), 1)
+
+	info := st.Details()[0].(*errdetails.ErrorInfo)
+	require.Equal(t, cluster.addr("leader"), info.Metadata["leader_addr"])
+}
+
+func TestHTTPNotLeader(t *testing.T) {
+	cluster := &testCluster{addrs: make(map[string]string)}
+	_, leaderTopics := newClusterServer(t, cluster, "leader", nil)
+
+	body, err := json.Marshal(ProduceRequest{Record: Record{Value: []byte("hello")}})
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "forward-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "hmac.key"), testSecret, 0600))
+	jwt, err := auth.NewJWT(auth.JWTConfig{HMACKeyFile: filepath.Join(dir, "hmac.key")})
+	require.NoError(t, err)
+
+	_, forwarderOpts := newClientOpts(t, config.RootClientCertFile, config.RootClientKeyFile)
+	forwarder := NewForwarder(forwarderOpts...)
+	defer forwarder.Close()
+
+	produce := func(srv *http.Server) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+signToken(t, testSecret, "root"))
+
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, req)
+
+		return w
+	}
+
+	cases := map[string]*HTTPConfig{
+		// Without forwarder, the client is told where the leader is
+		"no forwarder": {},
+		// Unauthenticated requests aren't written as the server's subject
+		"no authenticator": {Forwarder: forwarder, Topics: leaderTopics},
+		// Records written to the leader's topics couldn't be read back from the server's own log
+		"no topics": {
+			Forwarder:     forwarder,
+			Authenticator: jwt,
+			Authorizer:    auth.New(config.ACLModelFile, config.ACLPolicyFile),
+		},
+	}
+
+	for scenario, c := range cases {
+		t.Run(scenario, func(t *testing.T) {
+			c.GetServerer = cluster
+			c.ServerID = "follower"
+
+			w := produce(NewHttpServerWithConfig(":0", c))
+			require.Equal(t, http.StatusMisdirectedRequest, w.Code)
+
+			var notLeader NotLeaderResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&notLeader))
+			require.Equal(t, cluster.addr("leader"), notLeader.LeaderAddr)
+		})
+	}
+
+	// With forwarder, the record is written to the leader's topics and read back from them
+	followerTopics, err := log.NewTopicManager(filepath.Join(dir, "follower"), log.Config{})
+	require.NoError(t, err)
+	defer followerTopics.Close()
+
+	follower := NewHttpServerWithConfig(":0", &HTTPConfig{
+		GetServerer:   cluster,
+		ServerID:      "follower",
+		Topics:        followerTopics,
+		Forwarder:     forwarder,
+		Authenticator: jwt,
+		Authorizer:    auth.New(config.ACLModelFile, config.ACLPolicyFile),
+	})
+
+	w := produce(follower)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var res ProduceResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+	require.Equal(t, uint64(0), res.Offset)
+
+	leader := NewHttpServerWithConfig(":0", &HTTPConfig{
+		GetServerer: cluster,
+		ServerID:    "leader",
+		Topics:      leaderTopics,
+	})
+
+	w = httptest.NewRecorder()
+	consume := mustMarshal(t, ConsumeRequest{Offset: res.Offset, Partition: res.Partition})
+	leader.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", bytes.NewReader(consume)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var record ConsumeResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&record))
+	require.Equal(t, []byte("hello"), record.Record.Value)
+}
+
+func TestForwardedMetadata(t *testing.T) {
+	srv := &grpcServer{Config: &Config{
+		Authorizer: auth.New(config.ACLModelFile, config.ACLPolicyFile),
+	}}
+
+	forwarded := metadata.NewIncomingContext(context.Background(), metadata.Pairs(forwardedKey, "true"))
+	cases := map[string]struct {
+		ctx  context.Context
+		want bool
+	}{
+		"server":      {context.WithValue(forwarded, subjectContextKey{}, "root"), true},
+		"client":      {context.WithValue(forwarded, subjectContextKey{}, "nobody"), false},
+		"no metadata": {context.WithValue(context.Background(), subjectContextKey{}, "root"), false},
+	}
+
+	for scenario, c := range cases {
+		t.Run(scenario, func(t *testing.T) {
+			require.Equal(t, c.want, srv.isForwarded(c.ctx))
+		})
+	}
+}
+
+// A fixed cluster, whose leader is started by setupCluster
+type testCluster struct {
+	mu    sync.Mutex
+	addrs map[string]string
+}
+
+func (c *testCluster) addr(id string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.addrs[id]
+}
+
+func (c *testCluster) join(id, addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.addrs[id] = addr
+}
+
+func (c *testCluster) GetServers() ([]*api.Server, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var servers []*api.Server
+	for id, addr := range c.addrs {
+		servers = append(servers, &api.Server{
+			Id:       id,
+			RpcAddr:  addr,
+			IsLeader: id == "leader",
+		})
+	}
+
+	return servers, nil
+}
+
+func setupCluster(t *testing.T) *testCluster {
+	t.Helper()
+
+	cluster := &testCluster{addrs: make(map[string]string)}
+	newClusterServer(t, cluster, "leader", nil)
+
+	return cluster
+}
+
+// Start a server which joins the cluster
+func newClusterServer(t *testing.T, cluster *testCluster, id string, forwarder *Forwarder) (string, *log.TopicManager) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	cluster.join(id, l.Addr().String())
+
+	dir, err := ioutil.TempDir("", "forward-test")
+	require.NoError(t, err)
+
+	topics, err := log.NewTopicManager(dir, log.Config{})
+	require.NoError(t, err)
+
+	groups, err := group.NewCoordinator(topics, group.Config{})
+	require.NoError(t, err)
+
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: l.Addr().String(),
+		Server:        true,
+	})
+	require.NoError(t, err)
+
+	server, err := NewGRPCServer(&Config{
+		Topics:      topics,
+		Groups:      groups,
+		Authorizer:  auth.New(config.ACLModelFile, config.ACLPolicyFile),
+		GetServerer: cluster,
+		ServerID:    id,
+		Forwarder:   forwarder,
+	}, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+	require.NoError(t, err)
+
+	go server.Serve(l)
+	t.Cleanup(func() {
+		server.Stop()
+		UnregisterMetrics(id)
+		groups.Close()
+		topics.Remove()
+	})
+
+	return l.Addr().String(), topics
+}
+
+func newClientOpts(t *testing.T, crtPath, keyPath string) (credentials.TransportCredentials, []grpc.DialOption) {
+	t.Helper()
+
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: crtPath,
+		KeyFile:  keyPath,
+		CAFile:   config.CAFile,
+		Server:   false,
+	})
+	require.NoError(t, err)
+
+	tlsCreds := credentials.NewTLS(tlsConfig)
+
+	return tlsCreds, []grpc.DialOption{grpc.WithTransportCredentials(tlsCreds)}
+}
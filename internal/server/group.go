@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Groups are coordinated by the leader, which holds their members and committed offsets,
+// so followers forward the group RPCs to it.
+// Members of consumer groups must be permitted to consume in the group, and from its topics
+func (s *grpcServer) authorizeGroup(ctx context.Context, group string, topics ...string) error {
+	if s.Groups == nil {
+		return status.Error(codes.Unimplemented, "consumer groups are not available")
+	}
+
+	if err := s.authorize(
+		ctx,
+		groupObject(group),
+		consumeAction,
+	); err != nil {
+		return err
+	}
+
+	for _, topic := range topics {
+		if err := s.authorize(
+			ctx,
+			topicObject(topic),
+			consumeAction,
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *grpcServer) CommitOffset(ctx context.Context, req *api.CommitOffsetRequest) (*api.CommitOffsetResponse, error) {
+	if err := s.authorizeGroup(ctx, req.Group, req.Topic); err != nil {
+		return nil, err
+	}
+
+	// Only the leader can write
+	leader, err := s.remoteLeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if leader != nil {
+		return s.Forwarder.CommitOffset(ctx, leader.RpcAddr, req)
+	}
+
+	// Offsets consumed in a transaction are committed with the transaction
+	if req.TransactionId != 0 {
+		if s.Transactions == nil {
+			return nil, status.Error(codes.Unimplemented, "transactions are not available")
+		}
+
+		return s.Groups.CommitOffsetInTransaction(req, s.originSubject(ctx), s.Transactions)
+	}
+
+	return s.Groups.CommitOffset(req)
+}
+
+func (s *grpcServer) FetchOffset(ctx context.Context, req *api.FetchOffsetRequest) (*api.FetchOffsetResponse, error) {
+	if err := s.authorizeGroup(ctx, req.Group, req.Topic); err != nil {
+		return nil, err
+	}
+
+	leader, err := s.remoteLeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if leader != nil {
+		return s.Forwarder.FetchOffset(ctx, leader.RpcAddr, req)
+	}
+
+	return s.Groups.FetchOffset(req)
+}
+
+func (s *grpcServer) JoinGroup(ctx context.Context, req *api.JoinGroupRequest) (*api.JoinGroupResponse, error) {
+	if err := s.authorizeGroup(ctx, req.Group, req.Topics...); err != nil {
+		return nil, err
+	}
+
+	leader, err := s.remoteLeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if leader != nil {
+		return s.Forwarder.JoinGroup(ctx, leader.RpcAddr, req)
+	}
+
+	if err = s.Mode.allowLocalWrite(); err != nil {
+		return nil, err
+	}
+
+	return s.Groups.JoinGroup(req)
+}
+
+func (s *grpcServer) Heartbeat(ctx context.Context, req *api.HeartbeatRequest) (*api.HeartbeatResponse, error) {
+	if err := s.authorizeGroup(ctx, req.Group); err != nil {
+		return nil, err
+	}
+
+	leader, err := s.remoteLeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if leader != nil {
+		return s.Forwarder.Heartbeat(ctx, leader.RpcAddr, req)
+	}
+
+	if err = s.Mode.allowLocalWrite(); err != nil {
+		return nil, err
+	}
+
+	return s.Groups.Heartbeat(req)
+}
+
+func (s *grpcServer) LeaveGroup(ctx context.Context, req *api.LeaveGroupRequest) (*api.LeaveGroupResponse, error) {
+	if err := s.authorizeGroup(ctx, req.Group); err != nil {
+		return nil, err
+	}
+
+	leader, err := s.remoteLeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if leader != nil {
+		return s.Forwarder.LeaveGroup(ctx, leader.RpcAddr, req)
+	}
+
+	if err = s.Mode.allowLocalWrite(); err != nil {
+		return nil, err
+	}
+
+	return s.Groups.LeaveGroup(req)
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// Names of services in health checks, the empty name is the whole server.
+// Produce is not serving while the log is read-only, like when the disk is full.
+const (
+	logServiceName     = "log.v1.Log"
+	produceServiceName = "log.v1.Log.Produce"
+)
+
+// Interval of checking the status of watched services
+var healthWatchInterval = time.Second
+
+// healthServer checks the status on each request rather than caching it,
+// so probes see a closed log or a full disk right away
+type healthServer struct {
+	*Config
+}
+
+func (s *healthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if !knownService(req.Service) {
+		return nil, status.Errorf(codes.NotFound, "unknown service %q", req.Service)
+	}
+
+	return &healthpb.HealthCheckResponse{Status: s.status(req.Service)}, nil
+}
+
+func knownService(service string) bool {
+	return service == "" || service == logServiceName || service == produceServiceName
+}
+
+// Send the status, and then each change of it until the client cancels
+func (s *healthServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	if !knownService(req.Service) {
+		return stream.Send(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVICE_UNKNOWN})
+	}
+
+	ticker := time.NewTicker(healthWatchInterval)
+	defer ticker.Stop()
+
+	last := healthpb.HealthCheckResponse_UNKNOWN
+	for {
+		if current := s.status(req.Service); current != last {
+			if err := stream.Send(&healthpb.HealthCheckResponse{Status: current}); err != nil {
+				return err
+			}
+			last = current
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Serving if the log is open, its disk has free space, the cluster has a leader, and the server isn't draining or
+// in maintenance. Produce is also not serving while the server or its disk is read-only.
+func (s *healthServer) status(service string) healthpb.HealthCheckResponse_ServingStatus {
+	if err := s.Topics.Check(); err != nil {
+		return healthpb.HealthCheckResponse_NOT_SERVING
+	}
+
+	switch s.Mode.get() {
+	case api.NodeMode_DRAIN, api.NodeMode_MAINTENANCE:
+		return healthpb.HealthCheckResponse_NOT_SERVING
+	case api.NodeMode_READ_ONLY:
+		if service == produceServiceName {
+			return healthpb.HealthCheckResponse_NOT_SERVING
+		}
+	}
+
+	if service == produceServiceName && s.Topics.DiskFull() {
+		return healthpb.HealthCheckResponse_NOT_SERVING
+	}
+
+	if s.GetServerer != nil {
+		leader, _, err := findLeader(s.GetServerer, s.ServerID)
+		if err != nil || leader == nil {
+			return healthpb.HealthCheckResponse_NOT_SERVING
+		}
+	}
+
+	return healthpb.HealthCheckResponse_SERVING
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/config"
+	"github.com/wuxl-lang/proglog/internal/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+)
+
+func TestHealth(t *testing.T) {
+	interval := healthWatchInterval
+	healthWatchInterval = 10 * time.Millisecond
+	defer func() { healthWatchInterval = interval }()
+
+	cluster := &testCluster{addrs: make(map[string]string)}
+	addr, topics := newClusterServer(t, cluster, "follower", nil)
+
+	_, opts := newClientOpts(t, config.RootClientCertFile, config.RootClientKeyFile)
+	conn, err := grpc.Dial(addr, opts...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	client := healthpb.NewHealthClient(conn)
+	ctx := context.Background()
+
+	// Not serving until the cluster has a leader
+	res, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, res.Status)
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watch, err := client.Watch(watchCtx, &healthpb.HealthCheckRequest{Service: logServiceName})
+	require.NoError(t, err)
+
+	update, err := watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, update.Status)
+
+	cluster.join("leader", "127.0.0.1:0")
+
+	update, err = watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, update.Status)
+
+	res, err = client.Check(ctx, &healthpb.HealthCheckRequest{Service: logServiceName})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// Closed log isn't serving
+	require.NoError(t, topics.Close())
+
+	update, err = watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, update.Status)
+}
+
+// Topics whose disk is full
+type fullDiskTopics struct {
+	*log.TopicManager
+}
+
+func (fullDiskTopics) DiskFull() bool {
+	return true
+}
+
+func TestHealthDiskFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	topics, err := log.NewTopicManager(dir, log.Config{})
+	require.NoError(t, err)
+	defer topics.Close()
+
+	srv := &healthServer{Config: &Config{Topics: fullDiskTopics{topics}}}
+	ctx := context.Background()
+
+	// Records can still be consumed, but not produced
+	res, err := srv.Check(ctx, &healthpb.HealthCheckRequest{Service: logServiceName})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+
+	res, err = srv.Check(ctx, &healthpb.HealthCheckRequest{Service: produceServiceName})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, res.Status)
+
+	require.Equal(t, codes.ResourceExhausted, status.Code(api.ErrDiskFull{}))
+}
+
+func TestReflection(t *testing.T) {
+	cluster := setupCluster(t)
+
+	_, opts := newClientOpts(t, config.RootClientCertFile, config.RootClientKeyFile)
+	conn, err := grpc.Dial(cluster.addr("leader"), opts...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(context.Background())
+	require.NoError(t, err)
+
+	require.NoError(t, stream.Send(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_ListServices{},
+	}))
+	res, err := stream.Recv()
+	require.NoError(t, err)
+
+	var services []string
+	for _, service := range res.GetListServicesResponse().Service {
+		services = append(services, service.Name)
+	}
+	require.Contains(t, services, logServiceName)
+	require.Contains(t, services, "grpc.health.v1.Health")
+}
@@ -1,19 +1,32 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 
 	"github.com/gorilla/mux"
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/internal/auth"
+	"github.com/wuxl-lang/proglog/internal/metrics"
 )
 
 func NewHttpServer(addr string) *http.Server {
-	httpsrv := newHTTPServer()
+	return NewHttpServerWithConfig(addr, &HTTPConfig{})
+}
+
+// The HTTP server only writes on the leader when it is part of a cluster
+func NewHttpServerWithConfig(addr string, config *HTTPConfig) *http.Server {
+	httpsrv := newHTTPServer(config)
 	r := mux.NewRouter()
 
 	// register handle
-	r.HandleFunc("/", httpsrv.handleProduce).Methods("POST")
-	r.HandleFunc("/", httpsrv.handleConsume).Methods("GET")
+	r.HandleFunc("/", httpsrv.authenticate(produceAction, httpsrv.checkMode("/log.v1.Log/Produce", httpsrv.handleProduce))).Methods("POST")
+	r.HandleFunc("/", httpsrv.authenticate(consumeAction, httpsrv.checkMode("/log.v1.Log/Consume", httpsrv.handleConsume))).Methods("GET")
+	r.Handle("/metrics", metrics.Default.Handler()).Methods("GET")
+	if config.RequestLog != nil {
+		r.Use(config.RequestLog.middleware)
+	}
 
 	// Set up HTTP Sever
 	return &http.Server{
@@ -22,14 +35,41 @@ func NewHttpServer(addr string) *http.Server {
 	}
 }
 
+type HTTPConfig struct {
+	GetServerer GetServerer
+	// ID of this server in the server list
+	ServerID string
+	// Records are produced to and consumed from the default topic, the log of the gRPC server, if it is set.
+	// Otherwise the server has its own log in memory.
+	Topics TopicManager
+	// Forward produce requests to the leader if it is set, otherwise reject them with the leader address.
+	// The leader writes forwarded records as this server's subject, so they are only forwarded with Topics,
+	// Authenticator and Authorizer set.
+	Forwarder *Forwarder
+	// Requests are authenticated by the client's cert or bearer token if it is set
+	Authenticator Authenticator
+	// Authenticated subjects must be permitted to produce or consume the default topic if it is set
+	Authorizer Authorizer
+	// Authorization decisions are recorded if it is set
+	Auditor Auditor
+	// Requests are logged if it is set
+	RequestLog *RequestLogger
+	// Produced values larger than it are rejected if it is set
+	MaxRecordBytes uint64
+	// Mode of the gRPC server, requests are rejected like its RPCs if it is set
+	Mode *NodeMode
+}
+
 // A server holds Log
 type httpServer struct {
+	*HTTPConfig
 	Log *Log
 }
 
-func newHTTPServer() *httpServer {
+func newHTTPServer(config *HTTPConfig) *httpServer {
 	return &httpServer{
-		Log: NewLog(),
+		HTTPConfig: config,
+		Log:        NewLog(),
 	}
 }
 
@@ -38,18 +78,76 @@ type ProduceRequest struct {
 }
 
 type ProduceResponse struct {
-	Offset uint64 `json:"offset"`
+	Offset    uint64 `json:"offset"`
+	Partition uint32 `json:"partition"`
+}
+
+type NotLeaderResponse struct {
+	Error      string `json:"error"`
+	LeaderAddr string `json:"leader_addr"`
 }
 
 type ConsumeRequest struct {
-	Offset uint64 `json:"offset"`
+	Offset    uint64 `json:"offset"`
+	Partition uint32 `json:"partition"`
 }
 
 type ConsumeResponse struct {
 	Record Record `json:"record"`
 }
 
+// Authenticate and authorize the request before handling it
+func (s *httpServer) authenticate(action string, next http.HandlerFunc) http.HandlerFunc {
+	if s.Authenticator == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		subject, err := s.Authenticator.Authenticate(auth.Credentials{
+			TLS:   r.TLS,
+			Token: auth.BearerToken(r.Header.Get("Authorization")),
+		})
+		setEntrySubject(r.Context(), subject)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+
+			return
+		}
+
+		if s.Authorizer != nil {
+			err = s.Authorizer.Authorize(subject, topicObject(defaultTopic), action)
+			recordDecision(s.Auditor, subject, topicObject(defaultTopic), action, r.RemoteAddr, err)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+// Reject the request while the mode rejects the RPC of the method, like produce while read-only
+func (s *httpServer) checkMode(method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.Mode.allow(method, false); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+
+			return
+		}
+
+		next(w, r)
+	}
+}
+
 func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
+	// Values are base64 in JSON, so the body is bounded by a third more than the value
+	if s.MaxRecordBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(s.MaxRecordBytes)*4/3+maxMessageOverhead)
+	}
+
 	// Unmarshal request
 	var req ProduceRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
@@ -59,14 +157,37 @@ func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if size := uint64(len(req.Record.Value)); s.MaxRecordBytes > 0 && size > s.MaxRecordBytes {
+		http.Error(w, api.ErrRecordTooLarge{Size: size, Max: s.MaxRecordBytes}.Error(), http.StatusRequestEntityTooLarge)
+
+		return
+	}
+
+	// Only the leader can write
+	leader, isLocal, err := findLeader(s.GetServerer, s.ServerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+	if !isLocal {
+		s.handleNotLeader(w, r, leader, req)
+
+		return
+	}
+
 	// Append record
-	offset, err := s.Log.Append(req.Record)
+	partition, offset, err := s.append(r.Context(), req.Record)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
 	}
 
+	setEntryOffset(r.Context(), offset)
+
 	// Marshal response
-	var res = ProduceResponse{Offset: offset}
+	var res = ProduceResponse{Offset: offset, Partition: partition}
 	err = json.NewEncoder(w).Encode(res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -75,6 +196,40 @@ func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Forward the record to the leader, or tell the client where the leader is
+func (s *httpServer) handleNotLeader(w http.ResponseWriter, r *http.Request, leader *api.Server, req ProduceRequest) {
+	if leader != nil && s.canForward() {
+		res, err := s.Forwarder.Produce(r.Context(), leader.RpcAddr, &api.ProduceRequest{
+			Record: &api.Record{Value: req.Record.Value},
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+
+			return
+		}
+
+		setEntryOffset(r.Context(), res.Offset)
+		err = json.NewEncoder(w).Encode(ProduceResponse{Offset: res.Offset, Partition: res.Partition})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	// Misdirected if the leader is known, otherwise the cluster is unavailable for writes
+	res := NotLeaderResponse{Error: "not leader"}
+	code := http.StatusServiceUnavailable
+	if leader != nil {
+		res.LeaderAddr = leader.RpcAddr
+		code = http.StatusMisdirectedRequest
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(res)
+}
+
 func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
 	// Unmarshal request
 	var req ConsumeRequest
@@ -85,8 +240,10 @@ func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	setEntryOffset(r.Context(), req.Offset)
+
 	// Read record in Log
-	record, err := s.Log.Read(req.Offset)
+	record, err := s.read(r.Context(), req.Partition, req.Offset)
 	if err == ErrOffsetNotFound { // It should be bad request
 		http.Error(w, err.Error(), http.StatusBadRequest)
 
@@ -107,3 +264,64 @@ func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// Forwarded records are written to the leader's topics, which are only read back with Topics set.
+// The leader authorizes them as this server, so they must be authorized here first.
+func (s *httpServer) canForward() bool {
+	return s.Forwarder != nil && s.Topics != nil && s.Authenticator != nil && s.Authorizer != nil
+}
+
+// Append the record to the default topic if it is set, otherwise to the server's own log
+func (s *httpServer) append(ctx context.Context, record Record) (uint32, uint64, error) {
+	if s.Topics == nil {
+		offset, err := s.Log.Append(record)
+		return 0, offset, err
+	}
+
+	topic, err := s.Topics.OpenTopic(defaultTopic)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return topic.AppendContext(ctx, &api.Record{Value: record.Value})
+}
+
+// Read the record from the default topic if it is set, otherwise from the server's own log.
+// Return ErrOffsetNotFound if there is no record to consume at the offset.
+func (s *httpServer) read(ctx context.Context, partition uint32, offset uint64) (Record, error) {
+	if s.Topics == nil {
+		if partition != 0 {
+			return Record{}, ErrOffsetNotFound
+		}
+
+		return s.Log.Read(offset)
+	}
+
+	topic, err := s.Topics.Topic(defaultTopic)
+	if _, ok := err.(api.ErrTopicNotFound); ok {
+		return Record{}, ErrOffsetNotFound
+	}
+	if err != nil {
+		return Record{}, err
+	}
+
+	l, err := topic.Partition(partition)
+	if err != nil {
+		return Record{}, ErrOffsetNotFound
+	}
+
+	record, err := l.ReadContext(ctx, offset)
+	if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+		return Record{}, ErrOffsetNotFound
+	}
+	if err != nil {
+		return Record{}, err
+	}
+
+	// Control records mark the end of transactions, they aren't consumed
+	if record.Control != api.ControlType_NONE {
+		return Record{}, ErrOffsetNotFound
+	}
+
+	return Record{Value: record.Value, Offset: record.Offset}, nil
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/config"
+	"github.com/wuxl-lang/proglog/internal/auth"
+)
+
+func TestHTTPMaxRecordBytes(t *testing.T) {
+	srv := NewHttpServerWithConfig(":0", &HTTPConfig{MaxRecordBytes: 16})
+
+	cases := map[string]struct {
+		body []byte
+		code int
+	}{
+		"small value": {mustMarshal(t, ProduceRequest{Record: Record{Value: []byte("hello")}}), http.StatusOK},
+		"large value": {mustMarshal(t, ProduceRequest{Record: Record{Value: make([]byte, 17)}}), http.StatusRequestEntityTooLarge},
+		// The body is rejected while it is read, before the value is checked
+		"oversized body": {mustMarshal(t, ProduceRequest{Record: Record{Value: make([]byte, 128<<10)}}), http.StatusBadRequest},
+	}
+
+	for scenario, c := range cases {
+		t.Run(scenario, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(c.body)))
+			require.Equal(t, c.code, w.Code)
+		})
+	}
+}
+
+func TestHTTPNodeMode(t *testing.T) {
+	mode := NewNodeMode()
+	srv := NewHttpServerWithConfig(":0", &HTTPConfig{Mode: mode})
+
+	serve := func(method string, body interface{}) int {
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, httptest.NewRequest(method, "/", bytes.NewReader(mustMarshal(t, body))))
+		return w.Code
+	}
+	produce := ProduceRequest{Record: Record{Value: []byte("hello")}}
+	require.Equal(t, http.StatusOK, serve(http.MethodPost, produce))
+
+	cases := map[api.NodeMode]struct {
+		produce int
+		consume int
+	}{
+		api.NodeMode_NORMAL:      {http.StatusOK, http.StatusOK},
+		api.NodeMode_READ_ONLY:   {http.StatusServiceUnavailable, http.StatusOK},
+		api.NodeMode_DRAIN:       {http.StatusOK, http.StatusOK},
+		api.NodeMode_MAINTENANCE: {http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+	}
+
+	for m, c := range cases {
+		t.Run(m.String(), func(t *testing.T) {
+			mode.set(m)
+			defer mode.set(api.NodeMode_NORMAL)
+
+			require.Equal(t, c.produce, serve(http.MethodPost, produce))
+			require.Equal(t, c.consume, serve(http.MethodGet, ConsumeRequest{Offset: 0}))
+		})
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+
+	return b
+}
+
+func TestHTTPAuthenticate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "hmac.key"), testSecret, 0600))
+	jwt, err := auth.NewJWT(auth.JWTConfig{HMACKeyFile: filepath.Join(dir, "hmac.key")})
+	require.NoError(t, err)
+
+	srv := NewHttpServerWithConfig(":0", &HTTPConfig{
+		Authenticator: auth.Chain{jwt, auth.CommonName{}},
+		Authorizer:    auth.New(config.ACLModelFile, config.ACLPolicyFile),
+	})
+
+	body, err := json.Marshal(ProduceRequest{Record: Record{Value: []byte("hello")}})
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		token string
+		code  int
+	}{
+		"permitted subject": {signToken(t, testSecret, "root"), http.StatusOK},
+		"forbidden subject": {signToken(t, testSecret, "nobody"), http.StatusForbidden},
+		"invalid token":     {signToken(t, []byte("guess"), "root"), http.StatusUnauthorized},
+		"no credentials":    {"", http.StatusUnauthorized},
+	}
+
+	for scenario, c := range cases {
+		t.Run(scenario, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+			if c.token != "" {
+				req.Header.Set("Authorization", "Bearer "+c.token)
+			}
+
+			w := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(w, req)
+			require.Equal(t, c.code, w.Code)
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/wuxl-lang/proglog/config"
+	"github.com/wuxl-lang/proglog/internal/metrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	rpcsTotal   = metrics.Default.NewCounter("proglog_grpc_requests_total", "RPCs by method and status code.", "method", "code")
+	rpcDuration = metrics.Default.NewHistogram("proglog_grpc_request_duration_seconds", "Latency of RPCs by method.", nil, "method")
+	deniedTotal = metrics.Default.NewCounter("proglog_auth_denials_total", "Requests denied by the authorizer by action.", "action")
+)
+
+func init() {
+	metrics.Default.NewGaugeFunc(
+		"proglog_certificate_expiry_timestamp_seconds",
+		"Expiry of loaded certificates by file.",
+		[]string{"file"},
+		func(emit func(float64, ...string)) {
+			for file, expiry := range config.CertificateExpiries() {
+				emit(float64(expiry.Unix()), file)
+			}
+		},
+	)
+}
+
+// Count RPCs and observe their latencies, streams are observed when they end
+func metricsUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	res, err := handler(ctx, req)
+	observeRPC(info.FullMethod, start, err)
+
+	return res, err
+}
+
+func metricsStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	observeRPC(info.FullMethod, start, err)
+
+	return err
+}
+
+func observeRPC(method string, start time.Time, err error) {
+	rpcsTotal.Inc(method, status.Code(err).String())
+	rpcDuration.Observe(time.Since(start).Seconds(), method)
+}
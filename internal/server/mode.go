@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/internal/metrics"
+	"google.golang.org/grpc"
+)
+
+// Methods which write, they are rejected while the server is read-only.
+// Group membership calls are rejected by their handlers instead, only when the server is the leader,
+// so that a read-only follower still forwards the heartbeats of its clients.
+var writeMethods = map[string]bool{
+	"/log.v1.Log/Produce":           true,
+	"/log.v1.Log/ProduceStream":     true,
+	"/log.v1.Log/CreateTopic":       true,
+	"/log.v1.Log/DeleteTopic":       true,
+	"/log.v1.Log/RegisterProducer":  true,
+	"/log.v1.Log/BeginTransaction":  true,
+	"/log.v1.Log/CommitTransaction": true,
+	"/log.v1.Log/AbortTransaction":  true,
+	"/log.v1.Log/CommitOffset":      true,
+	"/log.v1.Log/AddPolicy":         true,
+	"/log.v1.Log/RemovePolicy":      true,
+}
+
+// Admin, health and reflection calls are accepted in every mode
+func isModeExempt(method string) bool {
+	return strings.HasPrefix(method, "/log.v1.Admin/") ||
+		strings.HasPrefix(method, "/grpc.health.v1.Health/") ||
+		strings.HasPrefix(method, "/grpc.reflection.")
+}
+
+// Reported by the latest server of every ID, until its metrics are unregistered
+var nodeModeGauge = metrics.Default.NewGaugeFuncSet("proglog_node_mode", "Current mode of the server.", "mode")
+
+// Mode of the server, and its open streams so that maintenance closes them.
+// It is shared by the gRPC and HTTP servers of a node, so that both reject the same requests.
+type NodeMode struct {
+	mu      sync.Mutex
+	mode    api.NodeMode
+	next    uint64
+	streams map[uint64]context.CancelFunc
+}
+
+func NewNodeMode() *NodeMode {
+	return &NodeMode{streams: make(map[uint64]context.CancelFunc)}
+}
+
+// Report the mode as the mode of the server
+func (m *NodeMode) registerMetrics(serverID string) {
+	nodeModeGauge.Set(serverID, func(emit func(float64, ...string)) {
+		current := m.get()
+		for mode := api.NodeMode_NORMAL; mode <= api.NodeMode_MAINTENANCE; mode++ {
+			value := 0.0
+			if mode == current {
+				value = 1
+			}
+			emit(value, mode.String())
+		}
+	})
+}
+
+// Mode of the server, normal if it is nil
+func (m *NodeMode) get() api.NodeMode {
+	if m == nil {
+		return api.NodeMode_NORMAL
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.mode
+}
+
+// Set the mode and return the previous one. Entering maintenance closes the open streams.
+func (m *NodeMode) set(mode api.NodeMode) api.NodeMode {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	previous := m.mode
+	m.mode = mode
+	if mode == api.NodeMode_MAINTENANCE {
+		for _, cancel := range m.streams {
+			cancel()
+		}
+	}
+
+	return previous
+}
+
+func (m *NodeMode) activeStreams() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.streams)
+}
+
+// Return the error to reject the call with, new streams aren't accepted while draining
+func (m *NodeMode) allow(method string, newStream bool) error {
+	if isModeExempt(method) {
+		return nil
+	}
+
+	switch mode := m.get(); {
+	case mode == api.NodeMode_MAINTENANCE,
+		mode == api.NodeMode_DRAIN && newStream,
+		mode == api.NodeMode_READ_ONLY && writeMethods[method]:
+		return api.ErrNodeMode{Mode: mode}
+	}
+
+	return nil
+}
+
+// Return the error to reject a write which the server handles itself, instead of forwarding it
+func (m *NodeMode) allowLocalWrite() error {
+	if mode := m.get(); mode == api.NodeMode_READ_ONLY {
+		return api.ErrNodeMode{Mode: mode}
+	}
+
+	return nil
+}
+
+// Track the stream until the returned func is called, its context is canceled by maintenance
+func (m *NodeMode) track(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := m.next
+	m.next++
+	m.streams[id] = cancel
+
+	return ctx, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		delete(m.streams, id)
+		cancel()
+	}
+}
+
+func (m *NodeMode) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := m.allow(info.FullMethod, false); err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (m *NodeMode) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := m.allow(info.FullMethod, true); err != nil {
+		return err
+	}
+	if isModeExempt(info.FullMethod) {
+		return handler(srv, ss)
+	}
+
+	ctx, done := m.track(ss.Context())
+	defer done()
+
+	return handler(srv, &modeStream{ServerStream: ss, ctx: ctx, mode: m, method: info.FullMethod})
+}
+
+// Received messages of open streams are checked against the current mode, like produced records while read-only.
+// Sent messages aren't, so that the ack of a record which is appended always goes out.
+type modeStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	mode   *NodeMode
+	method string
+}
+
+func (s *modeStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *modeStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	return s.mode.allow(s.method, false)
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestNodeMode(t *testing.T) {
+	ctx := context.Background()
+	cluster := setupCluster(t)
+
+	dial := func(crtPath, keyPath string) *grpc.ClientConn {
+		_, opts := newClientOpts(t, crtPath, keyPath)
+		conn, err := grpc.Dial(cluster.addr("leader"), opts...)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		return conn
+	}
+	rootConn := dial(config.RootClientCertFile, config.RootClientKeyFile)
+	client, admin := api.NewLogClient(rootConn), api.NewAdminClient(rootConn)
+	health := healthpb.NewHealthClient(rootConn)
+	nobody := api.NewAdminClient(dial(config.NobodyClientCertFile, config.NobodyClientKeyFile))
+
+	setMode := func(mode api.NodeMode) {
+		_, err := admin.SetMode(ctx, &api.SetModeRequest{Mode: mode})
+		require.NoError(t, err)
+	}
+	healthStatus := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		res, err := health.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		require.NoError(t, err)
+		return res.Status
+	}
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: test_record})
+	require.NoError(t, err)
+
+	// Read-only rejects writes, records are still consumed
+	setMode(api.NodeMode_READ_ONLY)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: test_record})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = client.JoinGroup(ctx, &api.JoinGroupRequest{Group: "billing", Topics: []string{"default"}})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, healthStatus(logServiceName))
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, healthStatus(produceServiceName))
+
+	// Draining rejects new streams, open streams go on
+	setMode(api.NodeMode_NORMAL)
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.ConsumeStream(streamCtx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	setMode(api.NodeMode_DRAIN)
+	rejected, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = rejected.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: test_record})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Record.Offset)
+
+	mode, err := admin.GetMode(ctx, &api.GetModeRequest{})
+	require.NoError(t, err)
+	require.Equal(t, api.NodeMode_DRAIN, mode.Mode)
+	require.Equal(t, uint32(1), mode.ActiveStreams)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, healthStatus(""))
+
+	// Maintenance closes open streams and only accepts admin calls
+	previous, err := admin.SetMode(ctx, &api.SetModeRequest{Mode: api.NodeMode_MAINTENANCE})
+	require.NoError(t, err)
+	require.Equal(t, api.NodeMode_DRAIN, previous.Previous)
+
+	_, err = stream.Recv()
+	require.Error(t, err)
+	require.Eventually(t, func() bool {
+		mode, err := admin.GetMode(ctx, &api.GetModeRequest{})
+		require.NoError(t, err)
+		return mode.ActiveStreams == 0
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = admin.DescribeLog(ctx, &api.DescribeLogRequest{})
+	require.NoError(t, err)
+
+	setMode(api.NodeMode_NORMAL)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: test_record})
+	require.NoError(t, err)
+
+	_, err = admin.SetMode(ctx, &api.SetModeRequest{Mode: api.NodeMode(42)})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = nobody.SetMode(ctx, &api.SetModeRequest{Mode: api.NodeMode_MAINTENANCE})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// A read-only follower still forwards group membership to the leader
+	_, forwarderOpts := newClientOpts(t, config.RootClientCertFile, config.RootClientKeyFile)
+	forwarder := NewForwarder(forwarderOpts...)
+	defer forwarder.Close()
+
+	follower, _ := newClusterServer(t, cluster, "follower", forwarder)
+	followerConn, followerClient, _ := newClient(t, follower, config.RootClientCertFile, config.RootClientKeyFile)
+	defer followerConn.Close()
+
+	_, err = api.NewAdminClient(followerConn).SetMode(ctx, &api.SetModeRequest{Mode: api.NodeMode_READ_ONLY})
+	require.NoError(t, err)
+
+	join, err := followerClient.JoinGroup(ctx, &api.JoinGroupRequest{Group: "billing", Topics: []string{"default"}})
+	require.NoError(t, err)
+	_, err = followerClient.Heartbeat(ctx, &api.HeartbeatRequest{
+		Group:      "billing",
+		MemberId:   join.MemberId,
+		Generation: join.Generation,
+	})
+	require.NoError(t, err)
+	_, err = followerClient.Produce(ctx, &api.ProduceRequest{Record: test_record})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestModeStreamSendsAcks(t *testing.T) {
+	mode := NewNodeMode()
+	stream := &sendCounter{ctx: context.Background()}
+
+	err := mode.streamInterceptor(nil, stream, &grpc.StreamServerInfo{FullMethod: produceStreamMethod},
+		func(srv interface{}, ss grpc.ServerStream) error {
+			require.NoError(t, ss.RecvMsg(&api.ProduceRequest{}))
+
+			// The record is appended when the server turns read-only, its ack still goes out
+			mode.set(api.NodeMode_READ_ONLY)
+			require.NoError(t, ss.SendMsg(&api.ProduceResponse{}))
+
+			// The next record is rejected before it is appended
+			return ss.RecvMsg(&api.ProduceRequest{})
+		})
+	require.Equal(t, api.ErrNodeMode{Mode: api.NodeMode_READ_ONLY}, err)
+	require.Equal(t, 1, stream.sent)
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/internal/metrics"
+)
+
+// Current offsets of the partitions being streamed, so that the lag of streams is reported
+type streamOffsets struct {
+	mu      sync.Mutex
+	next    uint64
+	streams map[uint64]*streamOffset
+}
+
+type streamOffset struct {
+	subject   string
+	topic     string
+	partition uint32
+	// Offset of the next record to send, updated atomically
+	offset uint64
+}
+
+func newStreamOffsets() *streamOffsets {
+	return &streamOffsets{streams: make(map[uint64]*streamOffset)}
+}
+
+// Track the stream until the returned func is called
+func (s *streamOffsets) add(stream *streamOffset) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.next
+	s.next++
+	s.streams[id] = stream
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(s.streams, id)
+	}
+}
+
+// Streams of the topic, of every topic if it is empty, sorted by topic, partition and subject
+func (s *streamOffsets) list(topic string) []*streamOffset {
+	s.mu.Lock()
+	var streams []*streamOffset
+	for _, stream := range s.streams {
+		if topic == "" || stream.topic == topic {
+			streams = append(streams, stream)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(streams, func(i, j int) bool {
+		a, b := streams[i], streams[j]
+		if a.topic != b.topic {
+			return a.topic < b.topic
+		}
+		if a.partition != b.partition {
+			return a.partition < b.partition
+		}
+		return a.subject < b.subject
+	})
+
+	return streams
+}
+
+// Lag of each stream behind the end of its partition
+func (s *grpcServer) streamLags(topic string) []*api.ConsumerLag {
+	var lags []*api.ConsumerLag
+	for _, stream := range s.streams.list(topic) {
+		t, err := s.Topics.Topic(stream.topic)
+		if err != nil {
+			continue
+		}
+		l, err := t.Partition(stream.partition)
+		if err != nil {
+			continue
+		}
+
+		lag := &api.ConsumerLag{
+			Subject:   stream.subject,
+			Topic:     stream.topic,
+			Partition: stream.partition,
+			Offset:    atomic.LoadUint64(&stream.offset),
+		}
+		if end := l.EndOffset(); end > lag.Offset {
+			lag.Lag = end - lag.Offset
+		}
+		lags = append(lags, lag)
+	}
+
+	return lags
+}
+
+// Reported by the latest server of every ID, until its metrics are unregistered
+var streamLagGauge = metrics.Default.NewGaugeFuncSet(
+	"proglog_consumer_stream_lag",
+	"Records of partitions after the current offsets of streams by subject.",
+	"subject", "topic", "partition",
+)
+
+func (s *grpcServer) registerLagMetrics() {
+	streamLagGauge.Set(s.ServerID, func(emit func(float64, ...string)) {
+		for _, lag := range s.streamLags("") {
+			emit(float64(lag.Lag), lag.Subject, lag.Topic, strconv.FormatUint(uint64(lag.Partition), 10))
+		}
+	})
+}
+
+// Return the offsets of the topic's partitions, and the lag of its consumer groups and streams
+func (s *grpcServer) GetOffsets(ctx context.Context, req *api.GetOffsetsRequest) (*api.GetOffsetsResponse, error) {
+	if err := s.authorize(
+		ctx,
+		topicObject(req.Topic),
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+
+	name := topicName(req.Topic)
+	topic, err := s.Topics.Topic(name)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &api.GetOffsetsResponse{}
+	for p, l := range topic.Partitions {
+		offsets := &api.PartitionOffsets{Partition: uint32(p), EndOffset: l.EndOffset()}
+		if offsets.LowestOffset, err = l.LowestOffset(); err != nil {
+			return nil, err
+		}
+		if offsets.HighestOffset, err = l.HighestOffset(); err != nil {
+			return nil, err
+		}
+		res.Partitions = append(res.Partitions, offsets)
+	}
+
+	if s.Groups != nil {
+		res.Consumers = append(res.Consumers, s.Groups.Lags(name)...)
+	}
+	res.Consumers = append(res.Consumers, s.streamLags(name)...)
+
+	return res, nil
+}
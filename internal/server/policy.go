@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Only admins can manage policies
+func (s *grpcServer) authorizeAdmin(ctx context.Context) error {
+	if s.Policies == nil {
+		return status.Error(codes.Unimplemented, "policies are not managed by RPCs")
+	}
+
+	return s.authorize(
+		ctx,
+		clusterObject,
+		adminAction,
+	)
+}
+
+// Add a policy, which is stored in the internal policies topic through the leader
+func (s *grpcServer) AddPolicy(ctx context.Context, req *api.AddPolicyRequest) (*api.AddPolicyResponse, error) {
+	if err := s.authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	// Only the leader can write
+	leader, err := s.remoteLeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if leader != nil {
+		return s.Forwarder.AddPolicy(ctx, leader.RpcAddr, req)
+	}
+
+	if err = s.Policies.AddPolicy(req.Policy); err != nil {
+		return nil, err
+	}
+
+	return &api.AddPolicyResponse{}, nil
+}
+
+func (s *grpcServer) RemovePolicy(ctx context.Context, req *api.RemovePolicyRequest) (*api.RemovePolicyResponse, error) {
+	if err := s.authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	leader, err := s.remoteLeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if leader != nil {
+		return s.Forwarder.RemovePolicy(ctx, leader.RpcAddr, req)
+	}
+
+	if err = s.Policies.RemovePolicy(req.Policy); err != nil {
+		return nil, err
+	}
+
+	return &api.RemovePolicyResponse{}, nil
+}
+
+func (s *grpcServer) ListPolicies(ctx context.Context, req *api.ListPoliciesRequest) (*api.ListPoliciesResponse, error) {
+	if err := s.authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	return &api.ListPoliciesResponse{Policies: s.Policies.Policies()}, nil
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/internal/metrics"
+	"google.golang.org/grpc"
+)
+
+var quotaExceededTotal = metrics.Default.NewCounter(
+	"proglog_quota_exceeded_total", "Requests rejected or throttled by quotas by quota.", "quota",
+)
+
+// Names of quotas in errors and metrics
+const (
+	requestsQuota     = "requests"
+	produceBytesQuota = "produce_bytes"
+	consumeBytesQuota = "consume_bytes"
+)
+
+// Limits of a subject, a zero limit is unlimited
+type Quota struct {
+	ProduceBytesPerSecond float64
+	ConsumeBytesPerSecond float64
+	RequestsPerSecond     float64
+}
+
+type QuotaConfig struct {
+	// Quota of subjects which don't have their own
+	Default Quota
+	// Quotas by subject, like of servers which forward the produce requests of every client
+	Subjects map[string]Quota
+}
+
+// Quotas limit the rate of requests and bytes of each subject with token buckets.
+// Unary RPCs over a limit are rejected, streams are throttled.
+type Quotas struct {
+	config QuotaConfig
+	now    func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*subjectBuckets
+}
+
+func NewQuotas(c QuotaConfig) *Quotas {
+	return &Quotas{
+		config:  c,
+		now:     time.Now,
+		buckets: make(map[string]*subjectBuckets),
+	}
+}
+
+type subjectBuckets struct {
+	requests, produce, consume *bucket
+}
+
+// Token bucket which holds a second of tokens. Nil buckets are unlimited.
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, now time.Time) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &bucket{rate: rate, tokens: math.Max(rate, 1), last: now}
+}
+
+// Refill the bucket, and return how long to wait until it has a token, zero if it has one
+func (b *bucket) check(now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.tokens = math.Min(math.Max(b.rate, 1), b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	}
+
+	return 0
+}
+
+// Take n tokens of a checked bucket. The bucket may go into debt, so that a request larger than
+// a second of tokens passes and the following ones wait for it.
+func (b *bucket) take(n float64) {
+	if b != nil {
+		b.tokens -= n
+	}
+}
+
+// Bucket of the quota
+func (b *subjectBuckets) bucket(quota string) *bucket {
+	switch quota {
+	case requestsQuota:
+		return b.requests
+	case produceBytesQuota:
+		return b.produce
+	default:
+		return b.consume
+	}
+}
+
+// Tokens of a quota which a request takes
+type charge struct {
+	quota string
+	n     float64
+}
+
+func (q *Quotas) subject(subject string) *subjectBuckets {
+	b, ok := q.buckets[subject]
+	if !ok {
+		quota, ok := q.config.Subjects[subject]
+		if !ok {
+			quota = q.config.Default
+		}
+		now := q.now()
+		b = &subjectBuckets{
+			requests: newBucket(quota.RequestsPerSecond, now),
+			produce:  newBucket(quota.ProduceBytesPerSecond, now),
+			consume:  newBucket(quota.ConsumeBytesPerSecond, now),
+		}
+		q.buckets[subject] = b
+	}
+
+	return b
+}
+
+// Take the tokens of every charge from the subject's buckets, or none of them if any bucket is empty,
+// so that a request rejected by one quota isn't charged to the others.
+// Return the quota to wait for the longest, and how long until it has a token, zero if the tokens are taken.
+func (q *Quotas) take(subject string, charges ...charge) (string, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	b := q.subject(subject)
+	now := q.now()
+
+	var quota string
+	var wait time.Duration
+	for _, c := range charges {
+		if w := b.bucket(c.quota).check(now); w > wait {
+			quota, wait = c.quota, w
+		}
+	}
+	if wait > 0 {
+		return quota, wait
+	}
+
+	for _, c := range charges {
+		b.bucket(c.quota).take(c.n)
+	}
+
+	return "", 0
+}
+
+// Take tokens, or return the error to reject the request with
+func (q *Quotas) allow(subject string, charges ...charge) error {
+	if quota, wait := q.take(subject, charges...); wait > 0 {
+		quotaExceededTotal.Inc(quota)
+		return api.ErrQuotaExceeded{Subject: subject, Quota: quota, RetryAfter: wait}
+	}
+
+	return nil
+}
+
+// Wait until tokens are taken or the context is done
+func (q *Quotas) wait(ctx context.Context, subject string, charges ...charge) error {
+	for {
+		quota, wait := q.take(subject, charges...)
+		if wait == 0 {
+			return nil
+		}
+		quotaExceededTotal.Inc(quota)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+const (
+	produceMethod       = "/log.v1.Log/Produce"
+	produceStreamMethod = "/log.v1.Log/ProduceStream"
+	consumeMethod       = "/log.v1.Log/Consume"
+	consumeStreamMethod = "/log.v1.Log/ConsumeStream"
+)
+
+// Runs after authentication, so that the subject is in the context.
+// Consumed bytes are only known from the response, so they are charged after it.
+func (q *Quotas) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	sub := subject(ctx)
+	charges := []charge{{quota: requestsQuota, n: 1}}
+	switch info.FullMethod {
+	case produceMethod:
+		charges = append(charges, charge{quota: produceBytesQuota, n: float64(messageSize(req))})
+	case consumeMethod:
+		charges = append(charges, charge{quota: consumeBytesQuota})
+	}
+	if err := q.allow(sub, charges...); err != nil {
+		return nil, err
+	}
+
+	res, err := handler(ctx, req)
+	if info.FullMethod == consumeMethod && err == nil {
+		q.take(sub, charge{quota: consumeBytesQuota, n: float64(messageSize(res))})
+	}
+
+	return res, err
+}
+
+// Opening a stream is a request, its messages are throttled instead of rejected
+func (q *Quotas) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	sub := subject(ss.Context())
+	if err := q.allow(sub, charge{quota: requestsQuota, n: 1}); err != nil {
+		return err
+	}
+
+	return handler(srv, &quotaStream{ServerStream: ss, quotas: q, subject: sub, method: info.FullMethod})
+}
+
+type quotaStream struct {
+	grpc.ServerStream
+	quotas  *Quotas
+	subject string
+	method  string
+}
+
+// Each produced message is a request
+func (s *quotaStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if s.method != produceStreamMethod {
+		return nil
+	}
+
+	return s.quotas.wait(
+		s.Context(),
+		s.subject,
+		charge{quota: requestsQuota, n: 1},
+		charge{quota: produceBytesQuota, n: float64(messageSize(m))},
+	)
+}
+
+func (s *quotaStream) SendMsg(m interface{}) error {
+	if s.method == consumeStreamMethod {
+		if err := s.quotas.wait(s.Context(), s.subject, charge{quota: consumeBytesQuota, n: float64(messageSize(m))}); err != nil {
+			return err
+		}
+	}
+
+	return s.ServerStream.SendMsg(m)
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestQuotas(t *testing.T) {
+	now := time.Unix(0, 0)
+	quotas := NewQuotas(QuotaConfig{
+		Default: Quota{RequestsPerSecond: 2, ProduceBytesPerSecond: 100, ConsumeBytesPerSecond: 10},
+		Subjects: map[string]Quota{
+			"server": {},
+		},
+	})
+	quotas.now = func() time.Time { return now }
+
+	call := func(sub, method string, req, res interface{}) error {
+		ctx := context.WithValue(context.Background(), subjectContextKey{}, sub)
+		_, err := quotas.unaryInterceptor(ctx, req, &grpc.UnaryServerInfo{FullMethod: method},
+			func(context.Context, interface{}) (interface{}, error) { return res, nil })
+		return err
+	}
+	retryAfter := func(err error) time.Duration {
+		st := status.Convert(err)
+		require.Equal(t, codes.ResourceExhausted, st.Code())
+		require.Len(t, st.Details(), 1)
+		return st.Details()[0].(*errdetails.RetryInfo).RetryDelay.AsDuration()
+	}
+
+	// A request larger than a second of bytes passes, and the next one waits for the debt
+	produce := &api.ProduceRequest{Record: &api.Record{Value: make([]byte, 140)}}
+	require.NoError(t, call("client", produceMethod, produce, nil))
+	err := call("client", produceMethod, produce, nil)
+	require.Equal(t, api.ErrQuotaExceeded{Subject: "client", Quota: produceBytesQuota, RetryAfter: retryAfter(err)}, err)
+	require.True(t, retryAfter(err) > 400*time.Millisecond)
+
+	// The requests quota is exhausted by both calls
+	now = now.Add(2 * time.Second)
+	require.NoError(t, call("client", produceMethod, produce, nil))
+	require.NoError(t, call("client", "/log.v1.Log/ListTopics", nil, nil))
+	require.Equal(t, 500*time.Millisecond, retryAfter(call("client", "/log.v1.Log/ListTopics", nil, nil)))
+
+	// Consumed bytes are charged after the response
+	now = now.Add(time.Minute)
+	consumed := &api.ConsumeResponse{Record: &api.Record{Value: make([]byte, 20)}}
+	require.NoError(t, call("client", consumeMethod, &api.ConsumeRequest{}, consumed))
+	now = now.Add(time.Second)
+	require.Equal(t, codes.ResourceExhausted, status.Code(call("client", consumeMethod, &api.ConsumeRequest{}, consumed)))
+
+	// A call rejected by one quota isn't charged to the others
+	require.NoError(t, call("bytes", produceMethod, produce, nil))
+	require.Equal(t, codes.ResourceExhausted, status.Code(call("bytes", produceMethod, produce, nil)))
+	require.NoError(t, call("bytes", "/log.v1.Log/ListTopics", nil, nil))
+
+	// Quotas are per subject, and zero limits are unlimited
+	require.NoError(t, call("other", produceMethod, produce, nil))
+	for i := 0; i < 10; i++ {
+		require.NoError(t, call("server", produceMethod, produce, nil))
+	}
+}
+
+func TestQuotasThrottleStreams(t *testing.T) {
+	quotas := NewQuotas(QuotaConfig{
+		Default: Quota{ConsumeBytesPerSecond: 1000},
+	})
+
+	stream := &sendCounter{ctx: context.WithValue(context.Background(), subjectContextKey{}, "client")}
+	res := &api.ConsumeResponse{Record: &api.Record{Value: make([]byte, 1500)}}
+
+	start := time.Now()
+	err := quotas.streamInterceptor(nil, stream, &grpc.StreamServerInfo{FullMethod: consumeStreamMethod},
+		func(srv interface{}, ss grpc.ServerStream) error {
+			for i := 0; i < 2; i++ {
+				if err := ss.SendMsg(res); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	require.NoError(t, err)
+	require.Equal(t, 2, stream.sent)
+
+	// The second message waits until the debt of the first one is paid
+	require.True(t, time.Since(start) >= 500*time.Millisecond)
+}
+
+type sendCounter struct {
+	ctx  context.Context
+	sent int
+}
+
+func (s *sendCounter) SetHeader(metadata.MD) error  { return nil }
+func (s *sendCounter) SendHeader(metadata.MD) error { return nil }
+func (s *sendCounter) SetTrailer(metadata.MD)       {}
+func (s *sendCounter) Context() context.Context     { return s.ctx }
+func (s *sendCounter) RecvMsg(interface{}) error    { return nil }
+func (s *sendCounter) SendMsg(interface{}) error {
+	s.sent++
+	return nil
+}
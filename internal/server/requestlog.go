@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+func ParseLevel(s string) (Level, error) {
+	for l := LevelDebug; l <= LevelError; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown level %q", s)
+}
+
+type RequestLogConfig struct {
+	// Entries are written as JSON lines
+	Writer io.Writer
+	// Lowest level which is logged. Successful requests are info, client errors warn and server errors error
+	Level Level
+	// Fraction of successful requests which are logged, every one if it is 0. Errors are always logged.
+	SampleRate float64
+}
+
+// RequestLogger logs every gRPC and HTTP request as a JSON line
+type RequestLogger struct {
+	config RequestLogConfig
+
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewRequestLogger(c RequestLogConfig) *RequestLogger {
+	return &RequestLogger{config: c, enc: json.NewEncoder(c.Writer)}
+}
+
+type requestEntry struct {
+	Time          time.Time `json:"time"`
+	Level         string    `json:"level"`
+	Protocol      string    `json:"protocol"`
+	Method        string    `json:"method"`
+	Subject       string    `json:"subject,omitempty"`
+	Peer          string    `json:"peer,omitempty"`
+	Offset        *uint64   `json:"offset,omitempty"`
+	DurationMs    float64   `json:"duration_ms"`
+	Code          string    `json:"code"`
+	RequestBytes  int       `json:"request_bytes"`
+	ResponseBytes int       `json:"response_bytes"`
+	Error         string    `json:"error,omitempty"`
+
+	level Level
+}
+
+type entryKey struct{}
+
+// Entry of the request in the context, so that the subject and offset are filled in by handlers
+func entryFromContext(ctx context.Context) *requestEntry {
+	e, _ := ctx.Value(entryKey{}).(*requestEntry)
+
+	return e
+}
+
+func setEntrySubject(ctx context.Context, subject string) {
+	if e := entryFromContext(ctx); e != nil {
+		e.Subject = subject
+	}
+}
+
+func setEntryOffset(ctx context.Context, offset uint64) {
+	if e := entryFromContext(ctx); e != nil {
+		e.Offset = &offset
+	}
+}
+
+func (l *RequestLogger) write(e *requestEntry, start time.Time) {
+	e.Time = start.UTC()
+	e.DurationMs = float64(time.Since(start)) / float64(time.Millisecond)
+	e.Level = e.level.String()
+
+	if e.level < l.config.Level {
+		return
+	}
+	if e.level <= LevelInfo && l.config.SampleRate > 0 && rand.Float64() >= l.config.SampleRate {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.enc.Encode(e); err != nil {
+		log.Printf("[ERROR] proglog: failed to log request: %v", err)
+	}
+}
+
+// Level of a gRPC status, codes caused by the client are warnings
+func codeLevel(code codes.Code) Level {
+	switch code {
+	case codes.OK:
+		return LevelInfo
+	case codes.Canceled, codes.InvalidArgument, codes.NotFound, codes.AlreadyExists, codes.PermissionDenied,
+		codes.FailedPrecondition, codes.OutOfRange, codes.Unauthenticated, codes.ResourceExhausted:
+		return LevelWarn
+	}
+
+	// Errors of the api package have HTTP-like codes, like 404 of offsets out of range
+	if code >= 400 && code < 500 {
+		return LevelWarn
+	}
+
+	return LevelError
+}
+
+func (l *RequestLogger) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	e := newGRPCEntry(ctx, info.FullMethod)
+
+	res, err := handler(context.WithValue(ctx, entryKey{}, e), req)
+
+	e.RequestBytes = messageSize(req)
+	e.ResponseBytes = messageSize(res)
+	// Responses of failed requests are empty
+	if e.Offset == nil && err == nil {
+		e.Offset = messageOffset(res, req)
+	} else if e.Offset == nil {
+		e.Offset = messageOffset(req)
+	}
+	l.finishGRPC(e, start, err)
+
+	return res, err
+}
+
+func (l *RequestLogger) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	e := newGRPCEntry(ss.Context(), info.FullMethod)
+
+	wrapped := &loggedStream{ServerStream: ss, ctx: context.WithValue(ss.Context(), entryKey{}, e), entry: e}
+	err := handler(srv, wrapped)
+	l.finishGRPC(e, start, err)
+
+	return err
+}
+
+func newGRPCEntry(ctx context.Context, method string) *requestEntry {
+	e := &requestEntry{Protocol: "grpc", Method: method}
+	if p, ok := peer.FromContext(ctx); ok {
+		e.Peer = p.Addr.String()
+	}
+
+	return e
+}
+
+func (l *RequestLogger) finishGRPC(e *requestEntry, start time.Time, err error) {
+	code := status.Code(err)
+	e.Code = code.String()
+	e.level = codeLevel(code)
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	l.write(e, start)
+}
+
+// Stream which counts the bytes of the messages, and carries the entry in its context
+type loggedStream struct {
+	grpc.ServerStream
+	ctx   context.Context
+	entry *requestEntry
+}
+
+func (s *loggedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *loggedStream) SendMsg(m interface{}) error {
+	s.entry.ResponseBytes += messageSize(m)
+
+	return s.ServerStream.SendMsg(m)
+}
+
+func (s *loggedStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.entry.RequestBytes += messageSize(m)
+		if s.entry.Offset == nil {
+			s.entry.Offset = messageOffset(m)
+		}
+	}
+
+	return err
+}
+
+func messageSize(m interface{}) int {
+	if msg, ok := m.(proto.Message); ok && msg != nil {
+		return proto.Size(msg)
+	}
+
+	return 0
+}
+
+// Offset of the first message which has one, like the offset of produce responses and consume requests
+func messageOffset(messages ...interface{}) *uint64 {
+	for _, m := range messages {
+		if o, ok := m.(interface{ GetOffset() uint64 }); ok && o != nil {
+			offset := o.GetOffset()
+			return &offset
+		}
+	}
+
+	return nil
+}
+
+// Log HTTP requests of the router
+func (l *RequestLogger) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		e := &requestEntry{
+			Protocol:     "http",
+			Method:       r.Method + " " + r.URL.Path,
+			Peer:         r.RemoteAddr,
+			RequestBytes: int(r.ContentLength),
+		}
+		if e.RequestBytes < 0 {
+			e.RequestBytes = 0
+		}
+
+		rw := &loggedResponseWriter{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), entryKey{}, e)))
+
+		e.Code = fmt.Sprint(rw.code)
+		e.ResponseBytes = rw.size
+		switch {
+		case rw.code >= 500:
+			e.level = LevelError
+		case rw.code >= 400:
+			e.level = LevelWarn
+		default:
+			e.level = LevelInfo
+		}
+
+		l.write(e, start)
+	})
+}
+
+type loggedResponseWriter struct {
+	http.ResponseWriter
+	code int
+	size int
+}
+
+func (w *loggedResponseWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *loggedResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.size += n
+
+	return n, err
+}
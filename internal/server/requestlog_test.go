@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestRequestLog(t *testing.T) {
+	produce := &grpc.UnaryServerInfo{FullMethod: "/log.v1.Log/Produce"}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}})
+	req := &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}}
+
+	cases := map[string]struct {
+		config RequestLogConfig
+		err    error
+		logged bool
+		level  string
+		code   string
+	}{
+		"success":               {RequestLogConfig{}, nil, true, "info", "OK"},
+		"client error":          {RequestLogConfig{}, status.Error(codes.PermissionDenied, "denied"), true, "warn", "PermissionDenied"},
+		"server error":          {RequestLogConfig{}, status.Error(codes.Internal, "failed"), true, "error", "Internal"},
+		"below level":           {RequestLogConfig{Level: LevelWarn}, nil, false, "", ""},
+		"errors aren't sampled": {RequestLogConfig{SampleRate: 0.000001}, status.Error(codes.Internal, "failed"), true, "error", "Internal"},
+	}
+
+	for scenario, c := range cases {
+		t.Run(scenario, func(t *testing.T) {
+			var buf bytes.Buffer
+			c.config.Writer = &buf
+			l := NewRequestLogger(c.config)
+
+			_, err := l.unaryInterceptor(ctx, req, produce, func(ctx context.Context, req interface{}) (interface{}, error) {
+				// Authenticate fills in the subject
+				setEntrySubject(ctx, "root")
+				if c.err != nil {
+					return nil, c.err
+				}
+				return &api.ProduceResponse{Offset: 7}, nil
+			})
+			require.Equal(t, c.err, err)
+
+			if !c.logged {
+				require.Empty(t, buf.String())
+				return
+			}
+
+			entry := map[string]interface{}{}
+			require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+			require.Equal(t, c.level, entry["level"])
+			require.Equal(t, c.code, entry["code"])
+			require.Equal(t, "grpc", entry["protocol"])
+			require.Equal(t, produce.FullMethod, entry["method"])
+			require.Equal(t, "root", entry["subject"])
+			require.Equal(t, "127.0.0.1:1234", entry["peer"])
+			require.NotZero(t, entry["request_bytes"])
+			if c.err == nil {
+				require.Equal(t, float64(7), entry["offset"])
+			}
+		})
+	}
+}
+
+func TestHTTPRequestLog(t *testing.T) {
+	var buf bytes.Buffer
+	srv := NewHttpServerWithConfig(":0", &HTTPConfig{
+		RequestLog: NewRequestLogger(RequestLogConfig{Writer: &buf}),
+	})
+
+	body := `{"record":{"value":"aGVsbG8="}}`
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	entry := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	require.Equal(t, "http", entry["protocol"])
+	require.Equal(t, "POST /", entry["method"])
+	require.Equal(t, "200", entry["code"])
+	require.Equal(t, float64(0), entry["offset"])
+	require.Equal(t, float64(len(body)), entry["request_bytes"])
+	require.Equal(t, float64(rec.Body.Len()), entry["response_bytes"])
+}
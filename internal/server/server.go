@@ -2,26 +2,104 @@ package server
 
 import (
 	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
 	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/internal/auth"
+	"github.com/wuxl-lang/proglog/internal/group"
+	"github.com/wuxl-lang/proglog/internal/log"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 type Config struct {
-	CommitLog  CommitLog
-	Authorizer Authorizer
+	Topics TopicManager
+	Groups GroupCoordinator
+	// Transactions are unavailable if it isn't set
+	Transactions TransactionCoordinator
+	Authorizer   Authorizer
+	// Subjects are the CN of client certificates if it isn't set
+	Authenticator Authenticator
+	// Policies can't be managed by RPCs if it isn't set
+	Policies PolicyManager
+	// Authorization decisions are recorded if it is set
+	Auditor     Auditor
+	GetServerer GetServerer
+	// ID of this server in the server list
+	ServerID string
+	// Forward produce requests to the leader if it is set, otherwise reject them with the leader address
+	Forwarder *Forwarder
+	// Store the producer's trace context in the headers of produced records
+	TraceRecords bool
+	// Requests are logged if it is set
+	RequestLog *RequestLogger
+	// Requests and bytes of each subject are limited if it is set
+	Quotas *Quotas
+	// Mode of the server, which is shared with its HTTP server. The server has its own if it isn't set.
+	Mode *NodeMode
+	// Produced records larger than it once marshaled are rejected, and gRPC messages are limited to fit one.
+	// Logs limit the size of their records too.
+	MaxRecordBytes uint64
 }
 
-// Define the interface of a log
-type CommitLog interface {
-	Append(*api.Record) (uint64, error)
-	Read(uint64) (*api.Record, error)
+// Define the interface to manage topics, each topic has its own log
+type TopicManager interface {
+	// Get an existing topic
+	Topic(name string) (*log.Topic, error)
+	// Get a topic, which is created if it doesn't exist
+	OpenTopic(name string) (*log.Topic, error)
+	CreateTopic(name string, c log.Config) (*log.Topic, error)
+	DeleteTopic(name string) error
+	Topics() []string
+	// Allocate an ID for an idempotent producer
+	RegisterProducer() (uint64, error)
+	// Check that the topics are open and their disk has free space
+	Check() error
+	// Whether the log is read-only for lack of space, until space is freed
+	DiskFull() bool
+}
+
+// Define the interface to coordinate consumer groups and their committed offsets
+type GroupCoordinator interface {
+	CommitOffset(*api.CommitOffsetRequest) (*api.CommitOffsetResponse, error)
+	// Commit the offset in the subject's transaction, it is applied once the transaction commits
+	CommitOffsetInTransaction(req *api.CommitOffsetRequest, subject string, transactions group.Transactions) (*api.CommitOffsetResponse, error)
+	FetchOffset(*api.FetchOffsetRequest) (*api.FetchOffsetResponse, error)
+	JoinGroup(*api.JoinGroupRequest) (*api.JoinGroupResponse, error)
+	Heartbeat(*api.HeartbeatRequest) (*api.HeartbeatResponse, error)
+	LeaveGroup(*api.LeaveGroupRequest) (*api.LeaveGroupResponse, error)
+	// Lag of committed offsets of the topic's partitions
+	Lags(topic string) []*api.ConsumerLag
+	// Remove the committed offsets of a topic which is deleted
+	DropTopic(topic string) error
+}
+
+// Define the interface to run transactions across partitions.
+// A transaction is owned by the subject which began it, other subjects can't write to or end it.
+type TransactionCoordinator interface {
+	Begin(subject string) (uint64, error)
+	// Append a record of the transaction to the topic
+	Append(id uint64, subject string, topic *log.Topic, record *api.Record) (uint32, uint64, error)
+	Commit(id uint64, subject string) error
+	Abort(id uint64, subject string) error
+	// Forget the partitions of a topic which is deleted
+	DropTopic(topic string)
+}
+
+// Define the interface to authenticate the subject of a request
+type Authenticator interface {
+	Authenticate(auth.Credentials) (string, error)
 }
 
 // Define the interface of the authorize
@@ -29,27 +107,146 @@ type Authorizer interface {
 	Authorize(subject, object, action string) error
 }
 
+// Define the interface to manage the policies of the authorizer
+type PolicyManager interface {
+	AddPolicy(*api.Policy) error
+	RemovePolicy(*api.Policy) error
+	Policies() []*api.Policy
+}
+
+// Define the interface to record authorization decisions
+type Auditor interface {
+	Record(*api.AuditEvent) error
+	Events(*api.ListAuditEventsRequest) (*api.ListAuditEventsResponse, error)
+}
+
+// Define the interface to list servers in the cluster
+type GetServerer interface {
+	GetServers() ([]*api.Server, error)
+}
+
+// Objects of ACL policies, topics and groups are prefixed, so that policies can match them by prefix.
+// Internal topics have their own prefix, so that wildcard topic policies don't cover them.
 const (
-	objectWildCard = "*"
-	produceAction  = "produce"
-	consumeAction  = "consume"
+	clusterObject  = "cluster"
+	topicPrefix    = "topic:"
+	internalPrefix = "internal:"
+	groupPrefix    = "group:"
 )
 
-func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, error) {
-	// Add authenticate interceptor
-	opts = append(
-		opts,
-		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(grpc_auth.StreamServerInterceptor(authenticate))),
-		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(grpc_auth.UnaryServerInterceptor(authenticate))),
-	)
+const (
+	produceAction     = "produce"
+	consumeAction     = "consume"
+	createTopicAction = "create_topic"
+	deleteTopicAction = "delete_topic"
+	listTopicsAction  = "list_topics"
+	getServersAction  = "get_servers"
+	forwardAction     = "forward"
+	adminAction       = "admin"
+	describeLogAction = "describe_log"
+	truncateAction    = "truncate"
+	resetAction       = "reset"
+	rollSegmentAction = "roll_segment"
+)
 
-	gsrv := grpc.NewServer(opts...)
+// Requests without topic go to the default topic
+const defaultTopic = "default"
+
+func topicName(topic string) string {
+	if topic == "" {
+		return defaultTopic
+	}
+
+	return topic
+}
+
+func topicObject(topic string) string {
+	if isInternalTopic(topic) {
+		return internalPrefix + topic
+	}
+
+	return topicPrefix + topicName(topic)
+}
+
+func groupObject(group string) string {
+	return groupPrefix + group
+}
+
+// Bytes of a request or response besides its record, like the topic name
+const maxMessageOverhead = 64 << 10
+
+// Reject produced records which are missing, control records or too large
+func (s *grpcServer) validateRecord(record *api.Record) error {
+	if record == nil {
+		return status.Error(codes.InvalidArgument, "record is required")
+	}
+
+	// Control records end transactions, only the transaction coordinator writes them
+	if record.Control != api.ControlType_NONE {
+		return status.Error(codes.InvalidArgument, "control records can't be produced")
+	}
+
+	if size := uint64(proto.Size(record)); s.MaxRecordBytes > 0 && size > s.MaxRecordBytes {
+		return api.ErrRecordTooLarge{Size: size, Max: s.MaxRecordBytes}
+	}
+
+	return nil
+}
+
+// Internal topics, like the committed offsets, are only written by the server
+func isInternalTopic(topic string) bool {
+	return strings.HasPrefix(topic, "__")
+}
+
+// Internal topics are only read by the server, e.g. audit events are listed by admins with their own RPC
+func checkConsumable(topic string) error {
+	if isInternalTopic(topic) {
+		return status.Errorf(codes.InvalidArgument, "internal topic %s can't be consumed", topic)
+	}
+
+	return nil
+}
+
+func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, error) {
 	srv, err := newgrpcServer(config)
 	if err != nil {
 		return nil, err
 	}
 
+	// Add metrics, trace, request log and authenticate interceptors, so that unauthenticated requests are covered.
+	// The mode and quotas come after authentication, so that they only apply to known subjects.
+	streams := []grpc.StreamServerInterceptor{metricsStreamInterceptor, traceStreamInterceptor}
+	unaries := []grpc.UnaryServerInterceptor{metricsUnaryInterceptor, traceUnaryInterceptor}
+	if config.RequestLog != nil {
+		streams = append(streams, config.RequestLog.streamInterceptor)
+		unaries = append(unaries, config.RequestLog.unaryInterceptor)
+	}
+	streams = append(streams, grpc_auth.StreamServerInterceptor(authenticate(config.Authenticator)))
+	unaries = append(unaries, grpc_auth.UnaryServerInterceptor(authenticate(config.Authenticator)))
+	streams = append(streams, srv.Mode.streamInterceptor)
+	unaries = append(unaries, srv.Mode.unaryInterceptor)
+	if config.Quotas != nil {
+		streams = append(streams, config.Quotas.streamInterceptor)
+		unaries = append(unaries, config.Quotas.unaryInterceptor)
+	}
+
+	// Options of the caller come later, so that they take precedence
+	if config.MaxRecordBytes > 0 {
+		size := int(config.MaxRecordBytes) + maxMessageOverhead
+		opts = append([]grpc.ServerOption{grpc.MaxRecvMsgSize(size), grpc.MaxSendMsgSize(size)}, opts...)
+	}
+
+	opts = append(
+		opts,
+		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(streams...)),
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(unaries...)),
+	)
+
+	gsrv := grpc.NewServer(opts...)
 	api.RegisterLogServer(gsrv, srv)
+	api.RegisterAdminServer(gsrv, &adminServer{grpcServer: srv})
+	healthpb.RegisterHealthService(gsrv, healthpb.NewHealthService(&healthServer{Config: config}))
+	reflection.Register(gsrv)
 
 	return gsrv, nil
 }
@@ -59,52 +256,170 @@ var _ api.LogServer = (*grpcServer)(nil)
 type grpcServer struct {
 	api.UnimplementedLogServer
 	*Config
+
+	streams *streamOffsets
 }
 
 func newgrpcServer(config *Config) (srv *grpcServer, err error) {
+	if config.Mode == nil {
+		config.Mode = NewNodeMode()
+	}
+
 	srv = &grpcServer{
-		Config: config,
+		Config:  config,
+		streams: newStreamOffsets(),
 	}
+	srv.registerLagMetrics()
+	srv.Mode.registerMetrics(config.ServerID)
 
 	return srv, nil
 }
 
+// Stop reporting the metrics of the server with the ID once it is stopped,
+// so that the stopped server isn't referenced by the registry anymore
+func UnregisterMetrics(serverID string) {
+	streamLagGauge.Delete(serverID)
+	nodeModeGauge.Delete(serverID)
+}
+
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
 	// Check ACL
-	if err := s.Authorizer.Authorize(
-		subject(ctx),
-		objectWildCard,
+	if err := s.authorize(
+		ctx,
+		topicObject(req.Topic),
 		produceAction,
 	); err != nil {
 		return nil, err
 	}
 
-	offset, err := s.CommitLog.Append(req.Record)
+	// The producer's span is stored before the size is checked, so that a record which passes still fits the log
+	if s.TraceRecords && req.Record != nil {
+		traceRecord(ctx, req.Record)
+	}
+
+	if err := s.validateRecord(req.Record); err != nil {
+		return nil, err
+	}
+
+	// Only the leader can write
+	leader, err := s.remoteLeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if leader != nil {
+		return s.Forwarder.Produce(ctx, leader.RpcAddr, req)
+	}
+
+	if isInternalTopic(req.Topic) {
+		return nil, status.Errorf(codes.InvalidArgument, "internal topic %s is read-only", req.Topic)
+	}
+
+	topic, err := s.Topics.OpenTopic(topicName(req.Topic))
+	if err != nil {
+		return nil, err
+	}
+
+	// Route record to a partition by its key
+	var partition uint32
+	var offset uint64
+	if req.Record.TransactionId != 0 {
+		if s.Transactions == nil {
+			return nil, status.Error(codes.Unimplemented, "transactions are not available")
+		}
+		partition, offset, err = s.Transactions.Append(req.Record.TransactionId, s.originSubject(ctx), topic, req.Record)
+	} else {
+		partition, offset, err = topic.AppendContext(ctx, req.Record)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &api.ProduceResponse{Offset: offset}, nil
+	return &api.ProduceResponse{Offset: offset, Partition: partition}, nil
 }
 
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
 	// Check ACL
-	if err := s.Authorizer.Authorize(
-		subject(ctx),
-		objectWildCard,
+	if err := s.authorize(
+		ctx,
+		topicObject(req.Topic),
 		consumeAction,
 	); err != nil {
 		return nil, err
 	}
 
-	record, err := s.CommitLog.Read(req.Offset)
+	if err := checkConsumable(req.Topic); err != nil {
+		return nil, err
+	}
+
+	if req.AllPartitions {
+		return nil, status.Error(codes.InvalidArgument, "all partitions can only be consumed by stream")
+	}
+
+	return s.consume(ctx, req)
+}
+
+// Read the record at the offset, the caller must be authorized
+func (s *grpcServer) consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
+	topic, err := s.Topics.Topic(topicName(req.Topic))
 	if err != nil {
 		return nil, err
 	}
 
+	l, err := topic.Partition(req.Partition)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read committed consumers don't see records of open and aborted transactions
+	var record *api.Record
+	if req.ReadCommitted {
+		record, err = l.ReadCommitted(req.Offset)
+	} else {
+		record, err = l.ReadContext(ctx, req.Offset)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Control records mark the end of transactions, they aren't consumed
+	if record.Control != api.ControlType_NONE {
+		return nil, api.ErrRecordNotVisible{Offset: req.Offset}
+	}
+
+	linkRecord(ctx, record)
+
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
+// Allocate an ID for an idempotent producer, which attaches increasing sequences to its records,
+// so that retried records are acknowledged with their original offsets instead of appended again
+func (s *grpcServer) RegisterProducer(ctx context.Context, req *api.RegisterProducerRequest) (*api.RegisterProducerResponse, error) {
+	// Check ACL
+	if err := s.authorize(
+		ctx,
+		clusterObject,
+		produceAction,
+	); err != nil {
+		return nil, err
+	}
+
+	// Only the leader can write
+	leader, err := s.remoteLeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if leader != nil {
+		return s.Forwarder.RegisterProducer(ctx, leader.RpcAddr, req)
+	}
+
+	id, err := s.Topics.RegisterProducer()
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.RegisterProducerResponse{ProducerId: id}, nil
+}
+
 // Bidirectional streaming RPC
 // Client stream data into server' log and the server can tell the client whether each request succeeded.
 func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
@@ -127,49 +442,167 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 
 // Sever-side streaming
 // Client tells the server where in the log to read records, and then the server will stream every record that follows
+// Client reads one partition, or every partition from the same offset
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	// Authorized once for the stream rather than every read
+	if err := s.authorize(
+		stream.Context(),
+		topicObject(req.Topic),
+		consumeAction,
+	); err != nil {
+		return err
+	}
+
+	if err := checkConsumable(req.Topic); err != nil {
+		return err
+	}
+
+	if !req.AllPartitions {
+		return s.consumePartition(stream.Context(), req, stream.Send)
+	}
+
+	topic, err := s.Topics.Topic(topicName(req.Topic))
+	if err != nil {
+		return err
+	}
+
+	// Partitions share the stream, so sending is serialized
+	var mu sync.Mutex
+	send := func(res *api.ConsumeResponse) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return stream.Send(res)
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	errc := make(chan error, len(topic.Partitions))
+	for p := range topic.Partitions {
+		preq := &api.ConsumeRequest{
+			Topic:         req.Topic,
+			Partition:     uint32(p),
+			Offset:        req.Offset,
+			ReadCommitted: req.ReadCommitted,
+		}
+
+		go func() {
+			errc <- s.consumePartition(ctx, preq, send)
+		}()
+	}
+
+	// Stop every partition once one of them stops, and wait for them before the stream ends
+	err = <-errc
+	cancel()
+	for i := 1; i < len(topic.Partitions); i++ {
+		<-errc
+	}
+
+	return err
+}
+
+// Send every record in a partition from the offset until the context is done
+func (s *grpcServer) consumePartition(ctx context.Context, req *api.ConsumeRequest, send func(*api.ConsumeResponse) error) error {
+	stream := &streamOffset{
+		subject:   subject(ctx),
+		topic:     topicName(req.Topic),
+		partition: req.Partition,
+		offset:    req.Offset,
+	}
+	defer s.streams.add(stream)()
+
 	for {
 		select {
-		case <-stream.Context().Done():
+		case <-ctx.Done():
 			return nil
 		default:
-			res, err := s.Consume(stream.Context(), req)
+			res, err := s.consume(ctx, req)
 			switch err.(type) {
 			case nil:
 			case api.ErrOffsetOutOfRange:
 				continue
+			case api.ErrRecordNotVisible:
+				req.Offset++
+				atomic.StoreUint64(&stream.offset, req.Offset)
+				continue
 			default:
 				return err
 			}
 
-			if err = stream.Send(res); err != nil {
+			if err = send(res); err != nil {
 				return err
 			}
 
 			req.Offset++
+			atomic.StoreUint64(&stream.offset, req.Offset)
 		}
 	}
 }
 
-// An interceptor that reads the subject out of the client's cert (CN) and writes it to RPC's context.
-func authenticate(ctx context.Context) (context.Context, error) {
-	peer, ok := peer.FromContext(ctx)
-	if !ok {
-		return ctx, status.New(
-			codes.Unknown,
-			"could not find peer info",
-		).Err()
+// Return the servers in the cluster, so that clients can discover the leader and followers
+func (s *grpcServer) GetServers(ctx context.Context, req *api.GetServersRequest) (*api.GetServersResponse, error) {
+	// Check ACL
+	if err := s.authorize(
+		ctx,
+		clusterObject,
+		getServersAction,
+	); err != nil {
+		return nil, err
+	}
+
+	if s.GetServerer == nil {
+		return nil, status.Error(codes.Unimplemented, "server list is not available")
+	}
+
+	servers, err := s.GetServerer.GetServers()
+	if err != nil {
+		return nil, err
 	}
 
-	if peer.AuthInfo == nil {
-		return context.WithValue(ctx, subjectContextKey{}, ""), nil
+	return &api.GetServersResponse{Servers: servers}, nil
+}
+
+// An interceptor that authenticates the subject with the client's cert or bearer token, and writes it to RPC's context.
+// Requests without credentials have an empty subject, which isn't permitted by policies.
+func authenticate(authenticator Authenticator) grpc_auth.AuthFunc {
+	if authenticator == nil {
+		authenticator = auth.CommonName{}
 	}
 
-	tlsInfo := peer.AuthInfo.(credentials.TLSInfo)
-	subject := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
-	ctx = context.WithValue(ctx, subjectContextKey{}, subject)
+	return func(ctx context.Context) (context.Context, error) {
+		peer, ok := peer.FromContext(ctx)
+		if !ok {
+			return ctx, status.New(
+				codes.Unknown,
+				"could not find peer info",
+			).Err()
+		}
+
+		creds := auth.Credentials{}
+		if tlsInfo, ok := peer.AuthInfo.(credentials.TLSInfo); ok {
+			creds.TLS = &tlsInfo.State
+		}
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get("authorization"); len(values) > 0 {
+				creds.Token = auth.BearerToken(values[0])
+			}
+		}
+
+		subject, err := authenticator.Authenticate(creds)
+		if err == auth.ErrNoCredentials {
+			subject, err = "", nil
+		}
+		setEntrySubject(ctx, subject)
+		if err != nil {
+			if _, ok := status.FromError(err); !ok {
+				err = status.Error(codes.Unauthenticated, err.Error())
+			}
+			return ctx, err
+		}
 
-	return ctx, nil
+		return context.WithValue(ctx, subjectContextKey{}, subject), nil
+	}
 }
 
 // Read subject from context
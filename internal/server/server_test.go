@@ -2,19 +2,36 @@ package server
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	api "github.com/wuxl-lang/proglog/api/v1"
 	"github.com/wuxl-lang/proglog/config"
+	"github.com/wuxl-lang/proglog/internal/audit"
 	auth "github.com/wuxl-lang/proglog/internal/auth"
+	"github.com/wuxl-lang/proglog/internal/group"
 	"github.com/wuxl-lang/proglog/internal/log"
+	"github.com/wuxl-lang/proglog/internal/trace"
+	"github.com/wuxl-lang/proglog/internal/transaction"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 var test_record *api.Record = &api.Record{
@@ -27,6 +44,18 @@ func TestServer(t *testing.T) {
 		"test consume beyond boundary": testConsumePastBoundary,
 		"test stream":                  testProduceConsumeStream,
 		"test unauthorize":             testUnauthroized,
+		"test topics":                  testTopics,
+		"test partitions":              testPartitions,
+		"test consumer group":          testConsumerGroup,
+		"test idempotent producer":     testIdempotentProducer,
+		"test transaction":             testTransaction,
+		"test policies":                testPolicies,
+		"test bearer token":            testBearerToken,
+		"test audit":                   testAudit,
+		"test metrics":                 testMetrics,
+		"test tracing":                 testTracing,
+		"test offsets":                 testOffsets,
+		"test record validation":       testRecordValidation,
 	}
 
 	for scenario, fn := range cases {
@@ -39,6 +68,28 @@ func TestServer(t *testing.T) {
 	}
 }
 
+func TestTopicObject(t *testing.T) {
+	authorizer := auth.New(config.ACLModelFile, config.ACLPolicyFile)
+
+	cases := map[string]struct {
+		subject string
+		topic   string
+		allowed bool
+	}{
+		"wildcard topic":          {"reader", "orders", true},
+		"default topic":           {"reader", "", true},
+		"internal topic":          {"reader", "__audit", false},
+		"internal topic by admin": {"root", "__audit", true},
+	}
+
+	for scenario, c := range cases {
+		t.Run(scenario, func(t *testing.T) {
+			err := authorizer.Authorize(c.subject, topicObject(c.topic), consumeAction)
+			require.Equal(t, c.allowed, err == nil)
+		})
+	}
+}
+
 func testProduceConsume(t *testing.T, client, _ api.LogClient, cfg *Config) {
 	ctx := context.Background()
 
@@ -164,6 +215,600 @@ func testUnauthroized(t *testing.T, _, client api.LogClient, cfg *Config) {
 	if gotCode != codes.PermissionDenied {
 		t.Fatalf("got code: %d, want %d", gotCode, codes.PermissionDenied)
 	}
+
+	_, err = client.GetServers(ctx, &api.GetServersRequest{})
+	gotCode = status.Code(err)
+	if gotCode != codes.PermissionDenied {
+		t.Fatalf("got code: %d, want %d", gotCode, codes.PermissionDenied)
+	}
+}
+
+func testTopics(t *testing.T, client, nobodyClient api.LogClient, cfg *Config) {
+	ctx := context.Background()
+
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic:  "payments",
+		Config: &api.TopicConfig{MaxStoreBytes: 1024},
+	})
+	require.NoError(t, err)
+
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Topic: "payments"})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	// Reading a topic which doesn't exist
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "orders"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// Each topic has its own offsets, orders is lazily created
+	for i, topic := range []string{"orders", "payments", "orders"} {
+		produce, err := client.Produce(ctx, &api.ProduceRequest{
+			Topic:  topic,
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i/2), produce.Offset)
+	}
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Topic: "orders", Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 2"), consume.Record.Value)
+
+	list, err := client.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders", "payments"}, list.Topics)
+
+	_, err = nobodyClient.DeleteTopic(ctx, &api.DeleteTopicRequest{Topic: "orders"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "billing", Topic: "orders", Offset: 1})
+	require.NoError(t, err)
+
+	_, err = client.DeleteTopic(ctx, &api.DeleteTopicRequest{Topic: "orders"})
+	require.NoError(t, err)
+
+	// Committed offsets of the deleted topic are dropped
+	_, err = client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "billing", Topic: "orders"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// Internal topics can't be created or deleted by clients, even by admins
+	_, err = client.DeleteTopic(ctx, &api.DeleteTopicRequest{Topic: "__consumer_offsets"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Topic: "__internal"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	list, err = client.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"payments"}, list.Topics)
+}
+
+func testPartitions(t *testing.T, client, _ api.LogClient, cfg *Config) {
+	ctx := context.Background()
+
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic:  "orders",
+		Config: &api.TopicConfig{Partitions: 2},
+	})
+	require.NoError(t, err)
+
+	// Records with the same key are in the same partition
+	var keyed []*api.ProduceResponse
+	for i := 0; i < 2; i++ {
+		produce, err := client.Produce(ctx, &api.ProduceRequest{
+			Topic:  "orders",
+			Record: &api.Record{Key: []byte("customer"), Value: []byte("keyed")},
+		})
+		require.NoError(t, err)
+		keyed = append(keyed, produce)
+	}
+	require.Equal(t, keyed[0].Partition, keyed[1].Partition)
+	require.Equal(t, keyed[0].Offset+1, keyed[1].Offset)
+
+	// The other partition has a record without key
+	total := len(keyed)
+	other := 1 - keyed[0].Partition
+	for {
+		total++
+		produce, err := client.Produce(ctx, &api.ProduceRequest{
+			Topic:  "orders",
+			Record: &api.Record{Value: []byte("unkeyed")},
+		})
+		require.NoError(t, err)
+
+		if produce.Partition == other {
+			break
+		}
+	}
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Topic: "orders", Partition: other})
+	require.NoError(t, err)
+	require.Equal(t, []byte("unkeyed"), consume.Record.Value)
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "orders", Partition: 2})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// Stream records of every partition
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Topic: "orders", AllPartitions: true})
+	require.NoError(t, err)
+
+	partitions := map[uint32]int{}
+	for i := 0; i < total; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(partitions[res.Record.Partition]), res.Record.Offset, "Each partition is in order")
+		partitions[res.Record.Partition]++
+	}
+	require.Len(t, partitions, 2)
+}
+
+func testConsumerGroup(t *testing.T, client, nobodyClient api.LogClient, cfg *Config) {
+	ctx := context.Background()
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: test_record})
+	require.NoError(t, err)
+
+	join, err := client.JoinGroup(ctx, &api.JoinGroupRequest{
+		Group:  "billing",
+		Topics: []string{defaultTopic},
+	})
+	require.NoError(t, err)
+	require.Len(t, join.Assignment, 1)
+
+	_, err = nobodyClient.JoinGroup(ctx, &api.JoinGroupRequest{Group: "billing"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// Commit the next offset to consume
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group:      "billing",
+		Topic:      defaultTopic,
+		Offset:     produce.Offset + 1,
+		MemberId:   join.MemberId,
+		Generation: join.Generation,
+	})
+	require.NoError(t, err)
+
+	fetch, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{
+		Group: "billing",
+		Topic: defaultTopic,
+	})
+	require.NoError(t, err)
+	require.Equal(t, produce.Offset+1, fetch.Offset)
+
+	hb, err := client.Heartbeat(ctx, &api.HeartbeatRequest{
+		Group:      "billing",
+		MemberId:   join.MemberId,
+		Generation: join.Generation,
+	})
+	require.NoError(t, err)
+	require.False(t, hb.Rebalance)
+
+	_, err = client.LeaveGroup(ctx, &api.LeaveGroupRequest{Group: "billing", MemberId: join.MemberId})
+	require.NoError(t, err)
+
+	// Committed offsets are only written by the server
+	_, err = client.Produce(ctx, &api.ProduceRequest{Topic: group.OffsetsTopic, Record: test_record})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testIdempotentProducer(t *testing.T, client, _ api.LogClient, cfg *Config) {
+	ctx := context.Background()
+
+	producer, err := client.RegisterProducer(ctx, &api.RegisterProducerRequest{})
+	require.NoError(t, err)
+	require.NotZero(t, producer.ProducerId)
+
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+
+	// The second record is sent again as its response is lost
+	for i, seq := range []uint64{1, 2, 2, 3} {
+		err = stream.Send(&api.ProduceRequest{
+			Record: &api.Record{
+				Value:      []byte(fmt.Sprintf("record %d", seq)),
+				ProducerId: producer.ProducerId,
+				Sequence:   seq,
+			},
+		})
+		require.NoError(t, err)
+
+		res, err := stream.Recv()
+		require.NoError(t, err)
+
+		want := seq - 1
+		require.Equal(t, want, res.Offset, "Record %d is acknowledged with its original offset", i)
+	}
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 3})
+	require.Error(t, err, "Duplicate isn't appended")
+}
+
+func testTransaction(t *testing.T, client, _ api.LogClient, cfg *Config) {
+	ctx := context.Background()
+
+	txn, err := client.BeginTransaction(ctx, &api.BeginTransactionRequest{})
+	require.NoError(t, err)
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("in transaction"), TransactionId: txn.TransactionId},
+	})
+	require.NoError(t, err)
+
+	// Offset is committed with the transaction
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group:         "billing",
+		Topic:         defaultTopic,
+		Offset:        produce.Offset + 1,
+		TransactionId: txn.TransactionId,
+	})
+	require.NoError(t, err)
+
+	_, err = client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "billing", Topic: defaultTopic})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// Read uncommitted consumers see the record, read committed consumers wait for the transaction
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, []byte("in transaction"), consume.Record.Value)
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset, ReadCommitted: true})
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: produce.Offset}.GRPCStatus().Code(), status.Code(err))
+
+	// Clients can't end the transaction with a forged control record
+	forged := &api.Record{TransactionId: txn.TransactionId, Control: api.ControlType_ABORT}
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: forged})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{Record: forged}))
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Other producers can't write to or end the transaction
+	writerCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+signToken(t, testSecret, "writer"))
+	_, err = client.Produce(writerCtx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("foreign"), TransactionId: txn.TransactionId},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.AbortTransaction(writerCtx, &api.AbortTransactionRequest{TransactionId: txn.TransactionId})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.CommitTransaction(ctx, &api.CommitTransactionRequest{TransactionId: txn.TransactionId})
+	require.NoError(t, err)
+
+	consume, err = client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset, ReadCommitted: true})
+	require.NoError(t, err)
+	require.Equal(t, []byte("in transaction"), consume.Record.Value)
+
+	fetch, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "billing", Topic: defaultTopic})
+	require.NoError(t, err)
+	require.Equal(t, produce.Offset+1, fetch.Offset)
+
+	// Control record which commits the transaction isn't consumed
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset + 1})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.CommitTransaction(ctx, &api.CommitTransactionRequest{TransactionId: txn.TransactionId})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Records of an aborted transaction are hidden from read committed consumers
+	txn, err = client.BeginTransaction(ctx, &api.BeginTransactionRequest{})
+	require.NoError(t, err)
+
+	produce, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("aborted"), TransactionId: txn.TransactionId},
+	})
+	require.NoError(t, err)
+
+	_, err = client.AbortTransaction(ctx, &api.AbortTransactionRequest{TransactionId: txn.TransactionId})
+	require.NoError(t, err)
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset, ReadCommitted: true})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// Records can't join an ended transaction
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("late"), TransactionId: txn.TransactionId},
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func testPolicies(t *testing.T, client, nobodyClient api.LogClient, cfg *Config) {
+	ctx := context.Background()
+
+	policy := &api.Policy{Ptype: "p", Rule: []string{"nobody", "topic:orders", "produce"}}
+
+	// Only admins manage policies
+	_, err := nobodyClient.AddPolicy(ctx, &api.AddPolicyRequest{Policy: policy})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = nobodyClient.Produce(ctx, &api.ProduceRequest{Topic: "orders", Record: test_record})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.AddPolicy(ctx, &api.AddPolicyRequest{Policy: policy})
+	require.NoError(t, err)
+
+	_, err = nobodyClient.Produce(ctx, &api.ProduceRequest{Topic: "orders", Record: test_record})
+	require.NoError(t, err)
+
+	list, err := client.ListPolicies(ctx, &api.ListPoliciesRequest{})
+	require.NoError(t, err)
+	require.Contains(t, policyLines(list.Policies), "p, nobody, topic:orders, produce")
+
+	_, err = client.RemovePolicy(ctx, &api.RemovePolicyRequest{Policy: policy})
+	require.NoError(t, err)
+
+	_, err = nobodyClient.Produce(ctx, &api.ProduceRequest{Topic: "orders", Record: test_record})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.AddPolicy(ctx, &api.AddPolicyRequest{Policy: &api.Policy{Ptype: "p", Rule: []string{"nobody"}}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func policyLines(policies []*api.Policy) []string {
+	var lines []string
+	for _, p := range policies {
+		lines = append(lines, p.Ptype+", "+strings.Join(p.Rule, ", "))
+	}
+
+	return lines
+}
+
+func testAudit(t *testing.T, client, nobodyClient api.LogClient, cfg *Config) {
+	ctx := context.Background()
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: test_record})
+	require.NoError(t, err)
+
+	_, err = nobodyClient.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// Denials are recorded with the subject and its peer
+	list, err := client.ListAuditEvents(ctx, &api.ListAuditEventsRequest{DeniedOnly: true})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(list.Events))
+	require.Equal(t, "nobody", list.Events[0].Subject)
+	require.Equal(t, topicObject(""), list.Events[0].Object)
+	require.Equal(t, consumeAction, list.Events[0].Action)
+	require.False(t, list.Events[0].Allowed)
+	require.NotEmpty(t, list.Events[0].PeerAddr)
+
+	list, err = client.ListAuditEvents(ctx, &api.ListAuditEventsRequest{Subject: "root", Action: produceAction})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(list.Events))
+	require.True(t, list.Events[0].Allowed)
+
+	// Only admins read the audit log, even through its topic
+	_, err = nobodyClient.ListAuditEvents(ctx, &api.ListAuditEventsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: audit.AuditTopic})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Topic: audit.AuditTopic})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Without auditor, others don't learn that audit is disabled
+	cfg.Auditor = nil
+	_, err = nobodyClient.ListAuditEvents(ctx, &api.ListAuditEventsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.ListAuditEvents(ctx, &api.ListAuditEventsRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func testMetrics(t *testing.T, client, nobodyClient api.LogClient, cfg *Config) {
+	ctx := context.Background()
+
+	denied := deniedTotal.Value(consumeAction)
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: test_record})
+	require.NoError(t, err)
+
+	_, err = nobodyClient.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.Equal(t, denied+1, deniedTotal.Value(consumeAction))
+
+	// Metrics are served by the HTTP server in the Prometheus text format
+	rec := httptest.NewRecorder()
+	NewHttpServer(":0").Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	body := rec.Body.String()
+	require.Contains(t, body, `proglog_grpc_requests_total{method="/log.v1.Log/Produce",code="OK"}`)
+	require.Contains(t, body, `proglog_grpc_requests_total{method="/log.v1.Log/Consume",code="PermissionDenied"}`)
+	require.Contains(t, body, `proglog_grpc_request_duration_seconds_count{method="/log.v1.Log/Produce"}`)
+	require.Contains(t, body, `proglog_log_segments{topic="default",partition="0"} 1`)
+	require.Contains(t, body, "# TYPE proglog_log_append_duration_seconds histogram")
+}
+
+func testRecordValidation(t *testing.T, client, _ api.LogClient, cfg *Config) {
+	ctx := context.Background()
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Logs limit records to their store size
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: make([]byte, 2048)}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// The server's limit is checked before the record is appended
+	cfg.MaxRecordBytes = 64
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: make([]byte, 100)}})
+	require.Equal(t, api.ErrRecordTooLarge{Size: 102, Max: 64}.Error(), status.Convert(err).Err().Error())
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: test_record})
+	require.NoError(t, err)
+}
+
+func testOffsets(t *testing.T, client, nobodyClient api.LogClient, cfg *Config) {
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: test_record})
+		require.NoError(t, err)
+	}
+
+	_, err := client.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group:  "billing",
+		Topic:  defaultTopic,
+		Offset: 1,
+	})
+	require.NoError(t, err)
+
+	_, err = nobodyClient.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	res, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []*api.PartitionOffsets{{
+		LowestOffset:  0,
+		HighestOffset: 2,
+		EndOffset:     3,
+	}}, res.Partitions)
+	require.Equal(t, []*api.ConsumerLag{{
+		Group:  "billing",
+		Topic:  defaultTopic,
+		Offset: 1,
+		Lag:    2,
+	}}, res.Consumers)
+
+	// Streams report their current offset until they are closed
+	streamCtx, cancel := context.WithCancel(ctx)
+	stream, err := client.ConsumeStream(streamCtx, &api.ConsumeRequest{})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = stream.Recv()
+		require.NoError(t, err)
+	}
+
+	streamLag := func() *api.ConsumerLag {
+		res, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+		require.NoError(t, err)
+		for _, lag := range res.Consumers {
+			if lag.Group == "" {
+				return lag
+			}
+		}
+		return nil
+	}
+	require.Eventually(t, func() bool {
+		lag := streamLag()
+		return lag != nil && lag.Offset == 3 && lag.Lag == 0
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, "root", streamLag().Subject)
+
+	cancel()
+	require.Eventually(t, func() bool {
+		return streamLag() == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+// Collect exported spans in memory
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (r *spanRecorder) Export(data *trace.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.spans = append(r.spans, data)
+}
+
+func (r *spanRecorder) find(name string) *trace.SpanData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, span := range r.spans {
+		if span.Name == name {
+			return span
+		}
+	}
+
+	return nil
+}
+
+func testTracing(t *testing.T, client, _ api.LogClient, cfg *Config) {
+	recorder := &spanRecorder{}
+	trace.SetExporter(recorder)
+	defer trace.SetExporter(nil)
+
+	cfg.TraceRecords = true
+
+	// The producer's trace continues on the server
+	ctx, producer := trace.StartSpan(context.Background(), "producer")
+	produce, err := client.Produce(trace.Inject(ctx), &api.ProduceRequest{Record: test_record})
+	require.NoError(t, err)
+
+	consume, err := client.Consume(context.Background(), &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+
+	rpc := recorder.find("/log.v1.Log/Produce")
+	require.NotNil(t, rpc)
+	parent := producer.SpanContext().Traceparent()
+	require.Equal(t, parent[3:35], rpc.TraceID)
+	require.Equal(t, parent[36:52], rpc.ParentID)
+	require.Equal(t, "OK", rpc.Attributes["code"])
+
+	// Storage spans are children of the RPC
+	appendSpan := recorder.find("log.Append")
+	require.NotNil(t, appendSpan)
+	require.Equal(t, rpc.SpanID, appendSpan.ParentID)
+	require.NotNil(t, recorder.find("segment.Append"))
+
+	// The consumer's span links to the producer's span stored in the record
+	traceparent := consume.Record.Headers[trace.TraceparentKey]
+	require.Equal(t, rpc.TraceID, traceparent[3:35])
+	require.Equal(t, rpc.SpanID, traceparent[36:52])
+
+	consumeSpan := recorder.find("/log.v1.Log/Consume")
+	require.NotNil(t, consumeSpan)
+	require.NotEqual(t, rpc.TraceID, consumeSpan.TraceID)
+	require.Equal(t, []string{traceparent}, consumeSpan.Links)
+
+	// The size limit covers the stored span
+	record := &api.Record{Value: make([]byte, 60)}
+	cfg.MaxRecordBytes = uint64(proto.Size(record))
+	_, err = client.Produce(trace.Inject(ctx), &api.ProduceRequest{Record: record})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), "exceeds the maximum")
+}
+
+var testSecret = []byte("secret")
+
+func testBearerToken(t *testing.T, _, nobodyClient api.LogClient, cfg *Config) {
+	ctx := context.Background()
+
+	// Token authenticates the subject instead of the client's cert
+	rootCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+signToken(t, testSecret, "root"))
+	_, err := nobodyClient.Produce(rootCtx, &api.ProduceRequest{Record: test_record})
+	require.NoError(t, err)
+
+	badCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+signToken(t, []byte("guess"), "root"))
+	_, err = nobodyClient.Produce(badCtx, &api.ProduceRequest{Record: test_record})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+// Sign HS256 token for the subject which expires in an hour
+func signToken(t *testing.T, secret []byte, subject string) string {
+	t.Helper()
+
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	signed := encode(map[string]string{"alg": "HS256"}) + "." +
+		encode(map[string]interface{}{"sub": subject, "exp": time.Now().Add(time.Hour).Unix()})
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
 }
 
 func setupTest(t *testing.T) (rootClient api.LogClient, nobodyClient api.LogClient, cfg *Config, teardown func()) {
@@ -177,14 +822,40 @@ func setupTest(t *testing.T) (rootClient api.LogClient, nobodyClient api.LogClie
 	dir, err := ioutil.TempDir("", "server-test")
 	require.NoError(t, err)
 
-	clog, err := log.NewLog(dir, log.Config{})
+	topics, err := log.NewTopicManager(dir, log.Config{})
+	require.NoError(t, err)
+
+	groups, err := group.NewCoordinator(topics, group.Config{})
+	require.NoError(t, err)
+
+	transactions, err := transaction.NewCoordinator(topics, transaction.Config{})
+	require.NoError(t, err)
+
+	// Set up authorizer with the policies stored in the log
+	adapter, err := auth.NewAdapter(topics)
+	require.NoError(t, err)
+	require.NoError(t, adapter.Seed(config.ACLPolicyFile))
+
+	authorizer, err := auth.NewWithAdapter(config.ACLModelFile, adapter)
+	require.NoError(t, err)
+
+	// Set up authenticator, bearer tokens take precedence over client certs
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "hmac.key"), testSecret, 0600))
+	jwt, err := auth.NewJWT(auth.JWTConfig{HMACKeyFile: filepath.Join(dir, "hmac.key")})
+	require.NoError(t, err)
+
+	auditor, err := audit.NewAuditor(topics)
 	require.NoError(t, err)
 
-	// Set up authorizer
-	authorizer := auth.New(config.ACLModelFile, config.ACLPolicyFile)
 	cfg = &Config{
-		CommitLog:  clog,
-		Authorizer: authorizer,
+		Topics:        topics,
+		Groups:        groups,
+		Transactions:  transactions,
+		Authorizer:    authorizer,
+		Authenticator: auth.Chain{jwt, auth.CommonName{}},
+		Policies:      authorizer,
+		Auditor:       auditor,
+		RequestLog:    NewRequestLogger(RequestLogConfig{Writer: ioutil.Discard}),
 	}
 
 	// Set up server
@@ -212,10 +883,14 @@ func setupTest(t *testing.T) (rootClient api.LogClient, nobodyClient api.LogClie
 
 	return rootClient, nobodyClient, cfg, func() {
 		server.Stop()
+		UnregisterMetrics(cfg.ServerID)
 		rootConn.Close()
 		nobodyConn.Close()
 		l.Close()
-		clog.Remove()
+		groups.Close()
+		transactions.Close()
+		auditor.Close()
+		topics.Remove()
 	}
 }
 
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/internal/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Create a topic with its own config
+func (s *grpcServer) CreateTopic(ctx context.Context, req *api.CreateTopicRequest) (*api.CreateTopicResponse, error) {
+	// Check ACL
+	if err := s.authorize(
+		ctx,
+		topicObject(req.Topic),
+		createTopicAction,
+	); err != nil {
+		return nil, err
+	}
+
+	// Internal topics are held by the server, like the committed offsets
+	if isInternalTopic(req.Topic) {
+		return nil, status.Errorf(codes.InvalidArgument, "internal topic %s is managed by the server", req.Topic)
+	}
+
+	// Only the leader can write
+	leader, err := s.remoteLeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if leader != nil {
+		return s.Forwarder.CreateTopic(ctx, leader.RpcAddr, req)
+	}
+
+	c := log.Config{}
+	if req.Config != nil {
+		c.Segment.MaxStoreBytes = req.Config.MaxStoreBytes
+		c.Segment.MaxIndexBytes = req.Config.MaxIndexBytes
+		c.Topic.Partitions = req.Config.Partitions
+		c.Segment.MaxRecordBytes = req.Config.MaxRecordBytes
+	}
+
+	if _, err := s.Topics.CreateTopic(req.Topic, c); err != nil {
+		return nil, err
+	}
+
+	return &api.CreateTopicResponse{Topic: req.Topic}, nil
+}
+
+// Delete a topic with all its records
+func (s *grpcServer) DeleteTopic(ctx context.Context, req *api.DeleteTopicRequest) (*api.DeleteTopicResponse, error) {
+	// Check ACL
+	if err := s.authorize(
+		ctx,
+		topicObject(req.Topic),
+		deleteTopicAction,
+	); err != nil {
+		return nil, err
+	}
+
+	// Internal topics are held by the server, like the committed offsets
+	if isInternalTopic(req.Topic) {
+		return nil, status.Errorf(codes.InvalidArgument, "internal topic %s is managed by the server", req.Topic)
+	}
+
+	// Only the leader can write
+	leader, err := s.remoteLeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if leader != nil {
+		return s.Forwarder.DeleteTopic(ctx, leader.RpcAddr, req)
+	}
+
+	// The coordinators let go of the topic before its logs are closed
+	if s.Groups != nil {
+		if err := s.Groups.DropTopic(req.Topic); err != nil {
+			return nil, err
+		}
+	}
+	if s.Transactions != nil {
+		s.Transactions.DropTopic(req.Topic)
+	}
+
+	if err := s.Topics.DeleteTopic(req.Topic); err != nil {
+		return nil, err
+	}
+
+	return &api.DeleteTopicResponse{}, nil
+}
+
+func (s *grpcServer) ListTopics(ctx context.Context, req *api.ListTopicsRequest) (*api.ListTopicsResponse, error) {
+	// Check ACL
+	if err := s.authorize(
+		ctx,
+		clusterObject,
+		listTopicsAction,
+	); err != nil {
+		return nil, err
+	}
+
+	// Internal topics are hidden from clients
+	var topics []string
+	for _, topic := range s.Topics.Topics() {
+		if !isInternalTopic(topic) {
+			topics = append(topics, topic)
+		}
+	}
+
+	return &api.ListTopicsResponse{Topics: topics}, nil
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/internal/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Start a span of each RPC, which is a child of the caller's span in the metadata
+func traceUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, span := startRPCSpan(ctx, info.FullMethod)
+	res, err := handler(ctx, req)
+	endRPCSpan(span, err)
+
+	return res, err
+}
+
+func traceStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, span := startRPCSpan(ss.Context(), info.FullMethod)
+
+	wrapped := grpc_middleware.WrapServerStream(ss)
+	wrapped.WrappedContext = ctx
+
+	err := handler(srv, wrapped)
+	endRPCSpan(span, err)
+
+	return err
+}
+
+func startRPCSpan(ctx context.Context, method string) (context.Context, *trace.Span) {
+	parent, _ := trace.Extract(ctx)
+	ctx, span := trace.StartSpanWithParent(ctx, method, parent)
+	if hasForwardedMetadata(ctx) {
+		span.SetAttribute("forwarded", "true")
+	}
+
+	return ctx, span
+}
+
+func endRPCSpan(span *trace.Span, err error) {
+	span.SetAttribute("code", status.Code(err).String())
+	span.End(err)
+}
+
+// Store the producer's span in the record, so that consumers can link to it
+func traceRecord(ctx context.Context, record *api.Record) {
+	span := trace.FromContext(ctx)
+	if span == nil {
+		return
+	}
+
+	if record.Headers == nil {
+		record.Headers = make(map[string]string)
+	}
+	if _, ok := record.Headers[trace.TraceparentKey]; !ok {
+		record.Headers[trace.TraceparentKey] = span.SpanContext().Traceparent()
+	}
+}
+
+// Link the consumer's span to the producer's span of the record
+func linkRecord(ctx context.Context, record *api.Record) {
+	if sc, ok := trace.ParseTraceparent(record.Headers[trace.TraceparentKey]); ok {
+		trace.FromContext(ctx).AddLink(sc)
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Transactions are run by producers, they must be permitted to produce.
+// Only the subject which began a transaction can produce in it and end it.
+func (s *grpcServer) authorizeTransaction(ctx context.Context) error {
+	if s.Transactions == nil {
+		return status.Error(codes.Unimplemented, "transactions are not available")
+	}
+
+	return s.authorize(
+		ctx,
+		clusterObject,
+		produceAction,
+	)
+}
+
+// Begin a transaction, records produced with its ID are visible to read committed consumers
+// only after it is committed
+func (s *grpcServer) BeginTransaction(ctx context.Context, req *api.BeginTransactionRequest) (*api.BeginTransactionResponse, error) {
+	if err := s.authorizeTransaction(ctx); err != nil {
+		return nil, err
+	}
+
+	// Only the leader can write
+	leader, err := s.remoteLeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if leader != nil {
+		return s.Forwarder.BeginTransaction(ctx, leader.RpcAddr, req)
+	}
+
+	id, err := s.Transactions.Begin(s.originSubject(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.BeginTransactionResponse{TransactionId: id}, nil
+}
+
+func (s *grpcServer) CommitTransaction(ctx context.Context, req *api.CommitTransactionRequest) (*api.CommitTransactionResponse, error) {
+	if err := s.authorizeTransaction(ctx); err != nil {
+		return nil, err
+	}
+
+	leader, err := s.remoteLeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if leader != nil {
+		return s.Forwarder.CommitTransaction(ctx, leader.RpcAddr, req)
+	}
+
+	if err = s.Transactions.Commit(req.TransactionId, s.originSubject(ctx)); err != nil {
+		return nil, err
+	}
+
+	return &api.CommitTransactionResponse{}, nil
+}
+
+func (s *grpcServer) AbortTransaction(ctx context.Context, req *api.AbortTransactionRequest) (*api.AbortTransactionResponse, error) {
+	if err := s.authorizeTransaction(ctx); err != nil {
+		return nil, err
+	}
+
+	leader, err := s.remoteLeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if leader != nil {
+		return s.Forwarder.AbortTransaction(ctx, leader.RpcAddr, req)
+	}
+
+	if err = s.Transactions.Abort(req.TransactionId, s.originSubject(ctx)); err != nil {
+		return nil, err
+	}
+
+	return &api.AbortTransactionResponse{}, nil
+}
@@ -0,0 +1,27 @@
+package trace
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+)
+
+// WriterExporter writes each span as a JSON line, like to stdout or a file for local testing
+type WriterExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{enc: json.NewEncoder(w)}
+}
+
+func (e *WriterExporter) Export(data *SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.enc.Encode(data); err != nil {
+		log.Printf("[ERROR] proglog: failed to export span: %v", err)
+	}
+}
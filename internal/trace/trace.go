@@ -0,0 +1,252 @@
+// Package trace records spans of requests across servers.
+// Span contexts are propagated in the W3C traceparent format, in gRPC metadata and record headers,
+// and finished spans are exported once an exporter is set.
+package trace
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Key of the span context in gRPC metadata and record headers
+const TraceparentKey = "traceparent"
+
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Format the span context as a traceparent value, like 00-<trace id>-<span id>-01
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]))
+}
+
+// Parse a traceparent value, it is invalid if the value is malformed
+func ParseTraceparent(s string) (SpanContext, bool) {
+	var sc SpanContext
+
+	parts := strings.Split(s, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+
+	return sc, sc.IsValid()
+}
+
+// Finished span as it is exported
+type SpanData struct {
+	Name       string            `json:"name"`
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_id,omitempty"`
+	Links      []string          `json:"links,omitempty"`
+	Start      time.Time         `json:"start"`
+	Duration   time.Duration     `json:"duration"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+type Exporter interface {
+	Export(*SpanData)
+}
+
+var (
+	exporterMu sync.RWMutex
+	exporter   Exporter
+)
+
+// Export finished spans to the exporter, spans aren't exported if it is nil
+func SetExporter(e Exporter) {
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+
+	exporter = e
+}
+
+func currentExporter() Exporter {
+	exporterMu.RLock()
+	defer exporterMu.RUnlock()
+
+	return exporter
+}
+
+// Span of an operation, which is safe to use from goroutines of the operation
+type Span struct {
+	mu sync.Mutex
+
+	sc     SpanContext
+	parent SpanContext
+	data   SpanData
+	ended  bool
+}
+
+type spanKey struct{}
+
+// IDs only need to be unique, so they don't pay for crypto/rand
+var (
+	randMu sync.Mutex
+	random = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func randomID() uint64 {
+	randMu.Lock()
+	defer randMu.Unlock()
+
+	// Zero is invalid
+	for {
+		if id := random.Uint64(); id != 0 {
+			return id
+		}
+	}
+}
+
+// Start a span which is a child of the span in the context, or the root of a new trace
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	var parent SpanContext
+	if s := FromContext(ctx); s != nil {
+		parent = s.sc
+	}
+
+	return StartSpanWithParent(ctx, name, parent)
+}
+
+// Start a span only within a trace, like of storage operations which aren't worth a trace of their own.
+// The span is nil if the context has no span, and methods of a nil span do nothing.
+func StartChildSpan(ctx context.Context, name string) (context.Context, *Span) {
+	if FromContext(ctx) == nil {
+		return ctx, nil
+	}
+
+	return StartSpan(ctx, name)
+}
+
+// Start a span which is a child of the remote parent, or the root of a new trace if the parent is invalid
+func StartSpanWithParent(ctx context.Context, name string, parent SpanContext) (context.Context, *Span) {
+	s := &Span{parent: parent}
+	if parent.IsValid() {
+		s.sc.TraceID = parent.TraceID
+	} else {
+		binary.BigEndian.PutUint64(s.sc.TraceID[:8], randomID())
+		binary.BigEndian.PutUint64(s.sc.TraceID[8:], randomID())
+	}
+	binary.BigEndian.PutUint64(s.sc.SpanID[:], randomID())
+
+	s.data = SpanData{Name: name, Start: time.Now()}
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Span in the context, nil if there isn't one
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+
+	return s
+}
+
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+
+	return s.sc
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]string)
+	}
+	s.data.Attributes[key] = value
+}
+
+// Links of a span are limited, since streams may link every record they send
+const maxLinks = 128
+
+// Link to a span of another trace, like the producer's span of a consumed record
+func (s *Span) AddLink(sc SpanContext) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.data.Links) >= maxLinks {
+		return
+	}
+	s.data.Links = append(s.data.Links, sc.Traceparent())
+}
+
+// Finish the span with the error of the operation, and export it
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+
+	data := s.data
+	data.Duration = time.Since(data.Start)
+	data.TraceID = hex.EncodeToString(s.sc.TraceID[:])
+	data.SpanID = hex.EncodeToString(s.sc.SpanID[:])
+	if s.parent.IsValid() {
+		data.ParentID = hex.EncodeToString(s.parent.SpanID[:])
+	}
+	if err != nil {
+		data.Error = err.Error()
+	}
+	s.mu.Unlock()
+
+	if e := currentExporter(); e != nil {
+		e.Export(&data)
+	}
+}
+
+// Propagate the span in the context to the outgoing gRPC metadata
+func Inject(ctx context.Context) context.Context {
+	s := FromContext(ctx)
+	if s == nil {
+		return ctx
+	}
+
+	return metadata.AppendToOutgoingContext(ctx, TraceparentKey, s.sc.Traceparent())
+}
+
+// Span context of the caller in the incoming gRPC metadata
+func Extract(ctx context.Context) (SpanContext, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get(TraceparentKey)) == 0 {
+		return SpanContext{}, false
+	}
+
+	return ParseTraceparent(md.Get(TraceparentKey)[0])
+}
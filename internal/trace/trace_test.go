@@ -0,0 +1,80 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestTraceparent(t *testing.T) {
+	_, span := StartSpan(context.Background(), "root")
+	sc := span.SpanContext()
+	require.True(t, sc.IsValid())
+
+	parsed, ok := ParseTraceparent(sc.Traceparent())
+	require.True(t, ok)
+	require.Equal(t, sc, parsed)
+
+	cases := map[string]string{
+		"empty":        "",
+		"short":        "00-abc-def-01",
+		"not hex":      "00-zzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzz-0000000000000001-01",
+		"zero span id": "00-0000000000000000000000000000000a-0000000000000000-01",
+	}
+	for scenario, value := range cases {
+		t.Run(scenario, func(t *testing.T) {
+			_, ok := ParseTraceparent(value)
+			require.False(t, ok)
+		})
+	}
+}
+
+func TestSpans(t *testing.T) {
+	var buf bytes.Buffer
+	SetExporter(NewWriterExporter(&buf))
+	defer SetExporter(nil)
+
+	// Storage spans aren't recorded outside a trace
+	_, orphan := StartChildSpan(context.Background(), "orphan")
+	require.Nil(t, orphan)
+	orphan.SetAttribute("ignored", "true")
+	orphan.End(nil)
+
+	ctx, root := StartSpan(context.Background(), "root")
+
+	// The span is propagated to the callee in the metadata
+	md, _ := metadata.FromOutgoingContext(Inject(ctx))
+	remote, ok := Extract(metadata.NewIncomingContext(context.Background(), md))
+	require.True(t, ok)
+	require.Equal(t, root.SpanContext(), remote)
+
+	_, child := StartChildSpan(ctx, "child")
+	child.SetAttribute("offset", "1")
+	child.AddLink(remote)
+	child.End(errors.New("failed"))
+	child.End(nil)
+	root.End(nil)
+
+	var spans []SpanData
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var data SpanData
+		require.NoError(t, dec.Decode(&data))
+		spans = append(spans, data)
+	}
+
+	// Spans are exported once when they end
+	require.Equal(t, 2, len(spans))
+	require.Equal(t, "child", spans[0].Name)
+	require.Equal(t, spans[1].TraceID, spans[0].TraceID)
+	require.Equal(t, spans[1].SpanID, spans[0].ParentID)
+	require.Equal(t, "1", spans[0].Attributes["offset"])
+	require.Equal(t, []string{remote.Traceparent()}, spans[0].Links)
+	require.Equal(t, "failed", spans[0].Error)
+	require.Empty(t, spans[1].ParentID)
+}
@@ -0,0 +1,317 @@
+package transaction
+
+import (
+	stdlog "log"
+	"sync"
+	"time"
+
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/internal/log"
+)
+
+// Internal topic which records the transactions and their decisions.
+// A begin record has no transaction ID, the ID is its offset plus one;
+// a decision record is a control record of the transaction.
+const TransactionsTopic = "__transactions"
+
+type Config struct {
+	// An ongoing transaction is aborted if it isn't ended within the timeout
+	Timeout time.Duration
+}
+
+// Coordinator runs transactions across the partitions of one or more topics.
+// Records of a transaction are appended as usual, and when the transaction ends,
+// a control record is appended to every partition it wrote, so that read committed
+// consumers can hide records of open and aborted transactions.
+//
+// The lock is held while records are appended to the topics, so transactional appends are serialized.
+// The transactions topic is neither compacted nor truncated, it grows by two records per transaction.
+type Coordinator struct {
+	mu sync.Mutex
+
+	Config Config
+	log    *log.Log
+	// Ongoing transactions by ID
+	ongoing map[uint64]*transaction
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type transaction struct {
+	started time.Time
+	// Subject which began the transaction, only it can write and end the transaction
+	owner string
+	// Set once the decision is recorded, the transaction is ongoing until every partition is ended
+	decision api.ControlType
+	// Partitions written by the transaction, and not ended yet, by their logs
+	partitions map[*log.Log]partitionRef
+}
+
+type partitionRef struct {
+	topic     string
+	partition uint32
+}
+
+// Construct coordinator and end the transactions which were open before restart.
+// Transactions which were decided to commit are committed, the others are aborted.
+func NewCoordinator(topics *log.TopicManager, c Config) (*Coordinator, error) {
+	if c.Timeout == 0 {
+		c.Timeout = time.Minute
+	}
+
+	tc := log.Config{}
+	tc.Topic.Partitions = 1
+	topic, err := topics.OpenTopicWithConfig(TransactionsTopic, tc)
+	if err != nil {
+		return nil, err
+	}
+
+	co := &Coordinator{
+		Config:  c,
+		log:     topic.Partitions[0],
+		ongoing: make(map[uint64]*transaction),
+		done:    make(chan struct{}),
+	}
+
+	if err = co.recover(topics); err != nil {
+		return nil, err
+	}
+
+	go co.expire()
+
+	return co, nil
+}
+
+// Begin a transaction owned by the subject and return its ID
+func (c *Coordinator) Begin(subject string) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	off, err := c.log.Append(&api.Record{})
+	if err != nil {
+		return 0, err
+	}
+
+	id := off + 1
+	c.ongoing[id] = &transaction{
+		started:    time.Now(),
+		owner:      subject,
+		partitions: make(map[*log.Log]partitionRef),
+	}
+
+	return id, nil
+}
+
+// Append a record of the subject's transaction to the topic, return the partition and the offset
+func (c *Coordinator) Append(id uint64, subject string, topic *log.Topic, record *api.Record) (uint32, uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	txn, err := c.owned(id, subject)
+	if err != nil {
+		return 0, 0, err
+	}
+	// A decided transaction is ending, it takes no more records
+	if txn.decision != api.ControlType_NONE {
+		return 0, 0, api.ErrUnknownTransaction{TransactionID: id}
+	}
+
+	record.TransactionId = id
+	partition, off, err := topic.Append(record)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	l, err := topic.Partition(partition)
+	if err != nil {
+		return 0, 0, err
+	}
+	txn.partitions[l] = partitionRef{topic: topic.Name, partition: partition}
+
+	return partition, off, nil
+}
+
+// Commit the subject's transaction, its records become visible to read committed consumers.
+// If it fails, the transaction stays ongoing and the commit can be retried.
+func (c *Coordinator) Commit(id uint64, subject string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := c.owned(id, subject); err != nil {
+		return err
+	}
+
+	return c.end(id, api.ControlType_COMMIT)
+}
+
+// Abort the subject's transaction, its records are hidden from read committed consumers
+func (c *Coordinator) Abort(id uint64, subject string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := c.owned(id, subject); err != nil {
+		return err
+	}
+
+	return c.end(id, api.ControlType_ABORT)
+}
+
+// Forget the partitions of the topic before it is deleted, so that ending transactions doesn't append to its logs
+func (c *Coordinator) DropTopic(topic string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, txn := range c.ongoing {
+		for l, p := range txn.partitions {
+			if p.topic == topic {
+				delete(txn.partitions, l)
+			}
+		}
+	}
+}
+
+// Stop aborting timed out transactions
+func (c *Coordinator) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+
+	return nil
+}
+
+// Ongoing transaction of the subject. Caller must hold the lock.
+func (c *Coordinator) owned(id uint64, subject string) (*transaction, error) {
+	txn, ok := c.ongoing[id]
+	if !ok {
+		return nil, api.ErrUnknownTransaction{TransactionID: id}
+	}
+	if txn.owner != subject {
+		return nil, api.ErrTransactionNotOwned{TransactionID: id, Subject: subject}
+	}
+
+	return txn, nil
+}
+
+// Record the decision, then append a control record to every partition written by the transaction.
+// The transaction stays ongoing until every partition is ended, so that a failed end is retried
+// by ending it again with the same decision, or by the timeout.
+// Caller must hold the lock.
+func (c *Coordinator) end(id uint64, control api.ControlType) error {
+	txn, ok := c.ongoing[id]
+	if !ok {
+		return api.ErrUnknownTransaction{TransactionID: id}
+	}
+
+	switch txn.decision {
+	case api.ControlType_NONE:
+		if _, err := c.log.Append(&api.Record{TransactionId: id, Control: control}); err != nil {
+			return err
+		}
+		txn.decision = control
+	case control:
+	default:
+		return api.ErrTransactionDecided{TransactionID: id, Decision: txn.decision}
+	}
+
+	for l, p := range txn.partitions {
+		err := appendControl(l, p.partition, id, control)
+		// A topic deleted after it is written has no records left to end
+		if _, ok := err.(api.ErrLogClosed); ok {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		delete(txn.partitions, l)
+	}
+	delete(c.ongoing, id)
+
+	return nil
+}
+
+// Rebuild the decisions, and end open transactions of every partition
+func (c *Coordinator) recover(topics *log.TopicManager) error {
+	committed := make(map[uint64]bool)
+
+	lowest, err := c.log.LowestOffset()
+	if err != nil {
+		return err
+	}
+
+	for off := lowest; ; off++ {
+		record, err := c.log.Read(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if record.Control == api.ControlType_COMMIT {
+			committed[record.TransactionId] = true
+		}
+	}
+
+	for _, name := range topics.Topics() {
+		topic, err := topics.Topic(name)
+		if err != nil {
+			return err
+		}
+
+		for partition, l := range topic.Partitions {
+			for _, id := range l.OpenTransactions() {
+				control := api.ControlType_ABORT
+				if committed[id] {
+					control = api.ControlType_COMMIT
+				}
+
+				if err = appendControl(l, uint32(partition), id, control); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Abort transactions which are ongoing longer than the timeout, and retry ending the decided ones
+func (c *Coordinator) expire() {
+	ticker := time.NewTicker(c.Config.Timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			deadline := time.Now().Add(-c.Config.Timeout)
+			for id, txn := range c.ongoing {
+				if !txn.started.Before(deadline) {
+					continue
+				}
+
+				control := txn.decision
+				if control == api.ControlType_NONE {
+					control = api.ControlType_ABORT
+				}
+				if err := c.end(id, control); err != nil {
+					stdlog.Printf("[WARN] proglog: failed to end transaction %d: %v", id, err)
+				}
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+func appendControl(l *log.Log, partition uint32, id uint64, control api.ControlType) error {
+	_, err := l.Append(&api.Record{
+		Partition:     partition,
+		TransactionId: id,
+		Control:       control,
+	})
+
+	return err
+}
@@ -0,0 +1,239 @@
+package transaction
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/wuxl-lang/proglog/api/v1"
+	"github.com/wuxl-lang/proglog/internal/log"
+)
+
+// Subject which runs the transactions
+const producer = "producer"
+
+func TestCoordinator(t *testing.T) {
+	cases := map[string]func(t *testing.T, topics *log.TopicManager, c *Coordinator){
+		"commit across partitions": testCommit,
+		"abort":                    testAbort,
+		"timeout":                  testTimeout,
+		"recover open":             testRecover,
+		"deleted topic":            testDeletedTopic,
+		"owner":                    testOwner,
+		"retry failed end":         testRetryEnd,
+	}
+
+	for scenario, fn := range cases {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "transaction-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			topics, err := log.NewTopicManager(dir, log.Config{})
+			require.NoError(t, err)
+
+			// A topic with 2 partitions
+			tc := log.Config{}
+			tc.Topic.Partitions = 2
+			_, err = topics.CreateTopic("orders", tc)
+			require.NoError(t, err)
+
+			c, err := NewCoordinator(topics, Config{Timeout: 50 * time.Millisecond})
+			require.NoError(t, err)
+			defer c.Close()
+
+			fn(t, topics, c)
+		})
+	}
+}
+
+// Append a record with the key to each partition
+func appendEach(t *testing.T, topics *log.TopicManager, c *Coordinator, id uint64) *log.Topic {
+	t.Helper()
+
+	topic, err := topics.Topic("orders")
+	require.NoError(t, err)
+
+	partitions := make(map[uint32]bool)
+	for i := 0; len(partitions) < 2; i++ {
+		p, _, err := c.Append(id, producer, topic, &api.Record{Key: []byte{byte(i)}, Value: []byte("order")})
+		require.NoError(t, err)
+		partitions[p] = true
+	}
+
+	return topic
+}
+
+func testCommit(t *testing.T, topics *log.TopicManager, c *Coordinator) {
+	id, err := c.Begin(producer)
+	require.NoError(t, err)
+
+	topic := appendEach(t, topics, c, id)
+
+	for _, l := range topic.Partitions {
+		require.Equal(t, []uint64{id}, l.OpenTransactions())
+	}
+
+	require.NoError(t, c.Commit(id, producer))
+
+	for _, l := range topic.Partitions {
+		require.Empty(t, l.OpenTransactions())
+
+		record, err := l.ReadCommitted(0)
+		require.NoError(t, err)
+		require.Equal(t, id, record.TransactionId)
+	}
+
+	require.Equal(t, api.ErrUnknownTransaction{TransactionID: id}, c.Commit(id, producer))
+}
+
+func testAbort(t *testing.T, topics *log.TopicManager, c *Coordinator) {
+	id, err := c.Begin(producer)
+	require.NoError(t, err)
+
+	topic := appendEach(t, topics, c, id)
+
+	require.NoError(t, c.Abort(id, producer))
+
+	for _, l := range topic.Partitions {
+		_, err = l.ReadCommitted(0)
+		require.Equal(t, api.ErrRecordNotVisible{Offset: 0}, err)
+	}
+
+	_, _, err = c.Append(id, producer, topic, &api.Record{Value: []byte("order")})
+	require.Equal(t, api.ErrUnknownTransaction{TransactionID: id}, err)
+}
+
+func testTimeout(t *testing.T, topics *log.TopicManager, c *Coordinator) {
+	id, err := c.Begin(producer)
+	require.NoError(t, err)
+
+	topic := appendEach(t, topics, c, id)
+
+	require.Eventually(t, func() bool {
+		for _, l := range topic.Partitions {
+			if len(l.OpenTransactions()) > 0 {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 10*time.Millisecond)
+
+	require.Equal(t, api.ErrUnknownTransaction{TransactionID: id}, c.Commit(id, producer))
+}
+
+func testRecover(t *testing.T, topics *log.TopicManager, c *Coordinator) {
+	open, err := c.Begin(producer)
+	require.NoError(t, err)
+	appendEach(t, topics, c, open)
+
+	// The decision to commit is recorded, but the markers aren't written before restart
+	decided, err := c.Begin(producer)
+	require.NoError(t, err)
+	topic := appendEach(t, topics, c, decided)
+
+	_, err = c.log.Append(&api.Record{TransactionId: decided, Control: api.ControlType_COMMIT})
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+
+	r, err := NewCoordinator(topics, Config{Timeout: time.Minute})
+	require.NoError(t, err)
+	defer r.Close()
+
+	for _, l := range topic.Partitions {
+		require.Empty(t, l.OpenTransactions())
+
+		// Records of the open transaction are aborted, the decided ones are committed
+		var visible []uint64
+		for off := uint64(0); off < l.LastStableOffset(); off++ {
+			record, err := l.ReadCommitted(off)
+			if _, ok := err.(api.ErrRecordNotVisible); ok {
+				continue
+			}
+			require.NoError(t, err)
+
+			if record.Control == api.ControlType_NONE {
+				visible = append(visible, record.TransactionId)
+			}
+		}
+		require.NotEmpty(t, visible)
+		for _, id := range visible {
+			require.Equal(t, decided, id)
+		}
+	}
+}
+
+func testDeletedTopic(t *testing.T, topics *log.TopicManager, c *Coordinator) {
+	id, err := c.Begin(producer)
+	require.NoError(t, err)
+	appendEach(t, topics, c, id)
+
+	// The transaction ends without the partitions of the deleted topic
+	c.DropTopic("orders")
+	require.NoError(t, topics.DeleteTopic("orders"))
+	require.NoError(t, c.Commit(id, producer))
+
+	// Partitions closed without being dropped are skipped too
+	other, err := topics.OpenTopic("payments")
+	require.NoError(t, err)
+
+	id, err = c.Begin(producer)
+	require.NoError(t, err)
+	_, _, err = c.Append(id, producer, other, &api.Record{Value: []byte("payment")})
+	require.NoError(t, err)
+
+	require.NoError(t, topics.DeleteTopic("payments"))
+	require.NoError(t, c.Abort(id, producer))
+}
+
+func testOwner(t *testing.T, topics *log.TopicManager, c *Coordinator) {
+	id, err := c.Begin(producer)
+	require.NoError(t, err)
+	topic := appendEach(t, topics, c, id)
+
+	// Other subjects can't write to or end the transaction
+	notOwned := api.ErrTransactionNotOwned{TransactionID: id, Subject: "other"}
+	_, _, err = c.Append(id, "other", topic, &api.Record{Value: []byte("order")})
+	require.Equal(t, notOwned, err)
+	require.Equal(t, notOwned, c.Commit(id, "other"))
+	require.Equal(t, notOwned, c.Abort(id, "other"))
+
+	require.NoError(t, c.Commit(id, producer))
+}
+
+func testRetryEnd(t *testing.T, topics *log.TopicManager, c *Coordinator) {
+	id, err := c.Begin(producer)
+	require.NoError(t, err)
+	topic := appendEach(t, topics, c, id)
+
+	// The decision can't be recorded
+	closed, err := topics.OpenTopic("closed")
+	require.NoError(t, err)
+	require.NoError(t, closed.Partitions[0].Close())
+
+	transactions := c.log
+	c.log = closed.Partitions[0]
+	require.Error(t, c.Commit(id, producer))
+	c.log = transactions
+
+	// The transaction is still ongoing, and ending it again ends every partition
+	for _, l := range topic.Partitions {
+		require.Equal(t, []uint64{id}, l.OpenTransactions())
+	}
+	require.NoError(t, c.Commit(id, producer))
+
+	for _, l := range topic.Partitions {
+		require.Empty(t, l.OpenTransactions())
+	}
+
+	// A decided transaction isn't ended against its decision
+	id, err = c.Begin(producer)
+	require.NoError(t, err)
+	c.mu.Lock()
+	c.ongoing[id].decision = api.ControlType_COMMIT
+	c.mu.Unlock()
+	require.Equal(t, api.ErrTransactionDecided{TransactionID: id, Decision: api.ControlType_COMMIT}, c.Abort(id, producer))
+	require.NoError(t, c.Commit(id, producer))
+}